@@ -2,6 +2,8 @@ package audit
 
 import (
 	"database/sql"
+	"encoding/json"
+	"log"
 	"time"
 
 	"github.com/google/uuid"
@@ -44,3 +46,41 @@ func EnqueueEvent(action string, userID *string, details interface{}) bool {
 	}
 	return Q.Enqueue(ev)
 }
+
+// Record enqueues an audit event attributed to userID. It is meant for code paths
+// that run outside AuditMiddlewareMux (e.g. public authentication routes). If the
+// queue is not running or is full, the row is written synchronously instead.
+func Record(db *sql.DB, action string, userID *uuid.UUID, details interface{}) {
+	ev := AuditEvent{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Action:    action,
+		Details:   details,
+		Timestamp: time.Now(),
+	}
+	if Q != nil && Q.Enqueue(ev) {
+		return
+	}
+
+	detailsBytes, err := json.Marshal(details)
+	if err != nil {
+		detailsBytes = []byte(`"audit:marshal_error"`)
+	}
+	_, err = db.Exec(`INSERT INTO "audit_log" (id, user_id, impersonator_id, action, details, timestamp) VALUES ($1, $2, $3, $4, $5, $6)`,
+		ev.ID, ev.UserID, ev.ImpersonatorID, ev.Action, string(detailsBytes), ev.Timestamp)
+	if err != nil {
+		log.Printf("audit: failed to insert audit log: %v (action=%s)\n", err, action)
+	}
+}
+
+// RecordTx writes an audit row within tx, so the row is only kept if the change
+// it records is committed, and the change is only committed with its row
+func RecordTx(tx *sql.Tx, action string, userID *uuid.UUID, details interface{}) error {
+	detailsBytes, err := json.Marshal(details)
+	if err != nil {
+		detailsBytes = []byte(`"audit:marshal_error"`)
+	}
+	_, err = tx.Exec(`INSERT INTO "audit_log" (id, user_id, action, details, timestamp) VALUES ($1, $2, $3, $4, $5)`,
+		uuid.New(), userID, action, string(detailsBytes), time.Now())
+	return err
+}
@@ -11,11 +11,12 @@ import (
 
 // AuditEvent is the structure enqueued for async processing
 type AuditEvent struct {
-	ID        uuid.UUID   `json:"id"`
-	UserID    *uuid.UUID  `json:"user_id,omitempty"`
-	Action    string      `json:"action"`
-	Details   interface{} `json:"details,omitempty"`
-	Timestamp time.Time   `json:"timestamp"`
+	ID             uuid.UUID   `json:"id"`
+	UserID         *uuid.UUID  `json:"user_id,omitempty"`
+	ImpersonatorID *uuid.UUID  `json:"impersonator_id,omitempty"` // set when UserID was being impersonated
+	Action         string      `json:"action"`
+	Details        interface{} `json:"details,omitempty"`
+	Timestamp      time.Time   `json:"timestamp"`
 }
 
 // Queue is a simple in-memory, bounded audit queue with a background worker
@@ -68,8 +69,8 @@ func (q *Queue) worker() {
 
 		// best-effort insert; log error but continue
 		_, err = q.db.Exec(
-			`INSERT INTO "audit_log" (id, user_id, action, details, timestamp) VALUES ($1, $2, $3, $4, $5)`,
-			ev.ID, ev.UserID, ev.Action, string(detailsBytes), ev.Timestamp,
+			`INSERT INTO "audit_log" (id, user_id, impersonator_id, action, details, timestamp) VALUES ($1, $2, $3, $4, $5, $6)`,
+			ev.ID, ev.UserID, ev.ImpersonatorID, ev.Action, string(detailsBytes), ev.Timestamp,
 		)
 		if err != nil {
 			log.Printf("audit: failed to insert audit log: %v (action=%s)\n", err, ev.Action)
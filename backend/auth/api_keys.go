@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"strings"
+)
+
+// APIKeyPrefix marks personal access tokens so they can be told apart from
+// JWTs in the Authorization header (and found by secret scanners)
+const APIKeyPrefix = "pillow_pat_"
+
+// apiKeyDisplayLength is how much of a key, including APIKeyPrefix, is kept in
+// clear text to identify it in listings
+const apiKeyDisplayLength = len(APIKeyPrefix) + 6
+
+// GenerateAPIKey returns a new personal access token together with its display
+// prefix. Store HashToken(key), never the key itself.
+func GenerateAPIKey() (key, prefix string, err error) {
+	secret, err := GenerateOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	key = APIKeyPrefix + secret
+	return key, key[:apiKeyDisplayLength], nil
+}
+
+// IsAPIKey reports whether a bearer credential is a personal access token
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
@@ -2,18 +2,38 @@ package auth
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"pillow/config"
+	"pillow/models"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var jwtSecret []byte
 
+// Issuer is the "iss" claim of every token minted by pillow
+const Issuer = "pillow-user-management"
+
+// Token audiences. Each kind of token pillow signs gets its own audience.
+const (
+	AudienceAPI               = "pillow-api"
+	AudienceOAuthClient       = "pillow-oauth-client"
+	AudienceEmailVerification = "pillow-email-verification"
+	AudienceMFAChallenge      = "pillow-mfa-challenge"
+)
+
+// Token lifetimes, configurable through ACCESS_TOKEN_TTL and REFRESH_TOKEN_TTL
+// (Go duration strings such as "15m" or "720h").
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
 func init() {
 	// Load .env file if it exists
 	godotenv.Load()
@@ -28,69 +48,189 @@ func init() {
 		secret = "dev-or-test-secret"
 	}
 	jwtSecret = []byte(secret)
+
+	accessTokenTTL = config.Duration("ACCESS_TOKEN_TTL", accessTokenTTL)
+	refreshTokenTTL = config.Duration("REFRESH_TOKEN_TTL", refreshTokenTTL)
 }
 
-// Claims represents the JWT claims
+// AccessTokenTTL returns the configured lifetime of access tokens
+func AccessTokenTTL() time.Duration {
+	return accessTokenTTL
+}
+
+// RefreshTokenTTL returns the configured lifetime of refresh tokens
+func RefreshTokenTTL() time.Duration {
+	return refreshTokenTTL
+}
+
+// Claims represents the JWT claims. Every token carries a unique ID in the
+// registered "jti" claim so it can be individually revoked.
 type Claims struct {
-	UserID   uuid.UUID `json:"user_id"`
-	Username string    `json:"username"`
+	UserID        uuid.UUID  `json:"user_id"`
+	Username      string     `json:"username"`
+	SessionID     *uuid.UUID `json:"sid,omitempty"`            // session family the token was issued for
+	ClientID      string     `json:"client_id,omitempty"`      // OAuth client the token was issued to, if any
+	Scope         string     `json:"scope,omitempty"`          // space separated OAuth scopes granted to ClientID
+	PrincipalType string     `json:"principal_type,omitempty"` // set to "service_account" for service account tokens
+	Actor         *Actor     `json:"act,omitempty"`            // impersonator, for impersonation tokens
 	jwt.RegisteredClaims
 }
 
-// HashPassword hashes a password using bcrypt
+// Actor identifies who is acting on behalf of the token subject, as in the
+// "act" claim of RFC 8693 token exchange
+type Actor struct {
+	Subject  uuid.UUID `json:"sub"`
+	Username string    `json:"username,omitempty"`
+}
+
+// HashPassword hashes a password with the configured algorithm (argon2id by default)
 func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(bytes), err
+	return passwordHashers[passwordHashAlgorithm].Hash(password)
 }
 
-// CheckPasswordHash verifies a password against its hash
+// CheckPasswordHash verifies a password against a hash of any registered algorithm
 func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	h, ok := hasherFor(hash)
+	return ok && h.Verify(password, hash)
+}
+
+// GenerateJWT generates a short-lived access token for a user bound to the given session family
+func GenerateJWT(userID uuid.UUID, username string, sessionID uuid.UUID) (string, error) {
+	return signToken(newAccessClaims(userID, username, sessionID))
 }
 
-// GenerateJWT generates a JWT token for a user
-func GenerateJWT(userID uuid.UUID, username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour) // 24 hours
+// GenerateClientAccessToken generates an access token issued to an OAuth client
+// through the OIDC flow. It records the client and the scopes the user granted to
+// it and has its own audience, so it is only accepted by the routes that serve
+// OAuth clients (see ValidateClientAccessToken), not by the rest of the API.
+func GenerateClientAccessToken(userID uuid.UUID, username string, sessionID uuid.UUID, clientID, scope string) (string, error) {
+	claims := newAccessClaims(userID, username, sessionID)
+	claims.ClientID = clientID
+	claims.Scope = scope
+	claims.Audience = jwt.ClaimStrings{AudienceOAuthClient}
+	return signToken(claims)
+}
+
+// GenerateServiceAccountToken generates an access token for a service account
+// that authenticated with the client_credentials grant. There is no session and
+// no refresh token behind it; the account requests a new token when it expires.
+func GenerateServiceAccountToken(accountID uuid.UUID, name string) (string, error) {
+	claims := newAccessClaims(accountID, name, uuid.Nil)
+	claims.SessionID = nil
+	claims.ClientID = accountID.String()
+	claims.PrincipalType = models.PrincipalTypeServiceAccount
+	return signToken(claims)
+}
 
-	claims := &Claims{
-		UserID:   userID,
-		Username: username,
+// GenerateImpersonationToken generates an access token for targetID that is
+// used by impersonatorID. It lives for ttl, has no session or refresh token and
+// carries the impersonator in the "act" claim.
+func GenerateImpersonationToken(targetID uuid.UUID, targetUsername string, impersonatorID uuid.UUID, impersonatorUsername string, ttl time.Duration) (string, *Claims, error) {
+	claims := newAccessClaims(targetID, targetUsername, uuid.Nil)
+	claims.SessionID = nil
+	claims.Actor = &Actor{Subject: impersonatorID, Username: impersonatorUsername}
+	claims.ExpiresAt = jwt.NewNumericDate(claims.IssuedAt.Add(ttl))
+	token, err := signToken(claims)
+	return token, claims, err
+}
+
+// newAccessClaims builds the claims shared by all access tokens
+func newAccessClaims(userID uuid.UUID, username string, sessionID uuid.UUID) *Claims {
+	now := time.Now()
+	return &Claims{
+		UserID:    userID,
+		Username:  username,
+		SessionID: &sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    "pillow-user-management",
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    Issuer,
 			Subject:   userID.String(),
+			Audience:  jwt.ClaimStrings{AudienceAPI},
+			ID:        uuid.New().String(),
 		},
 	}
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
-	if err != nil {
-		return "", err
+// ValidateJWT validates an access token and returns the claims
+func ValidateJWT(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	if err := parseToken(tokenString, claims, AudienceAPI); err != nil {
+		return nil, err
 	}
-
-	return tokenString, nil
+	return claims, nil
 }
 
-// ValidateJWT validates a JWT token and returns the claims
-func ValidateJWT(tokenString string) (*Claims, error) {
+// ValidateClientAccessToken validates an access token issued to an OAuth client
+// and returns the claims. The caller checks the granted scopes in claims.Scope.
+func ValidateClientAccessToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
+	if err := parseToken(tokenString, claims, AudienceOAuthClient); err != nil {
+		return nil, err
+	}
+	if claims.ClientID == "" {
+		return nil, errors.New("token was not issued to a client")
+	}
+	return claims, nil
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+// IssuedToClient reports whether the claims belong to an access token issued to
+// an OAuth client
+func (c *Claims) IssuedToClient() bool {
+	for _, aud := range c.Audience {
+		if aud == AudienceOAuthClient {
+			return true
+		}
+	}
+	return false
+}
+
+// signToken signs claims with the configured signing key. Asymmetric tokens
+// carry the key's "kid" header so verifiers can pick the right public key.
+func signToken(claims jwt.Claims) (string, error) {
+	if signingAlg == AlgHS256 {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString(jwtSecret)
+	}
+
+	key := keys.currentKey()
+	if key == nil {
+		return "", errors.New("signing key not loaded")
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
 
+// parseToken verifies a token signed by signToken and decodes it into claims.
+// The audience check keeps tokens minted for one purpose (e.g. email
+// verification) from being accepted for another (e.g. API access).
+func parseToken(tokenString string, claims jwt.Claims, audience string) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if signingAlg == AlgHS256 {
+			return jwtSecret, nil
+		}
+		kid, _ := token.Header["kid"].(string)
+		key := keys.lookup(kid)
+		if key == nil {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key.private.Public(), nil
+	},
+		jwt.WithValidMethods([]string{signingAlg}),
+		jwt.WithIssuer(Issuer),
+		jwt.WithAudience(audience),
+	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if !token.Valid {
-		return nil, errors.New("invalid token")
+		return errors.New("invalid token")
 	}
 
-	return claims, nil
+	return nil
 }
 
 // ExtractTokenFromHeader extracts the JWT token from the Authorization header
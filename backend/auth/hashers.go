@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"pillow/config"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hash algorithms. Every stored hash is self-describing (PHC string
+// for argon2id, modular crypt format for bcrypt), so hashes of all registered
+// algorithms stay verifiable while new ones use PASSWORD_HASH_ALGORITHM.
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+// passwordHasher is one entry of the hasher registry
+type passwordHasher interface {
+	// Hash encodes password with the configured parameters
+	Hash(password string) (string, error)
+	// Verify checks password against an encoded hash of this algorithm
+	Verify(password, encoded string) bool
+	// Matches reports whether encoded was produced by this algorithm
+	Matches(encoded string) bool
+	// Outdated reports whether encoded uses other parameters than the configured ones
+	Outdated(encoded string) bool
+}
+
+// argon2idHasher hashes with argon2id. Memory is in KiB.
+type argon2idHasher struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	saltLength  int
+	keyLength   uint32
+}
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.iterations, h.memory, h.parallelism, h.keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.iterations, h.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// argon2idParams is a decoded argon2id PHC string
+type argon2idParams struct {
+	version     int
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt, key   []byte
+}
+
+func decodeArgon2id(encoded string) (*argon2idParams, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	p := &argon2idParams{}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &p.version); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (h argon2idHasher) Verify(password, encoded string) bool {
+	p, err := decodeArgon2id(encoded)
+	if err != nil || p.version != argon2.Version || len(p.key) == 0 {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1
+}
+
+func (h argon2idHasher) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h argon2idHasher) Outdated(encoded string) bool {
+	p, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return p.version != argon2.Version || p.memory != h.memory || p.iterations != h.iterations ||
+		p.parallelism != h.parallelism || len(p.salt) != h.saltLength || len(p.key) != int(h.keyLength)
+}
+
+// bcryptHasher hashes with bcrypt
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(bytes), err
+}
+
+func (h bcryptHasher) Verify(password, encoded string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+}
+
+func (h bcryptHasher) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h bcryptHasher) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+// Hasher registry and the algorithm used for new hashes. Parameters come from
+// ARGON2_MEMORY (KiB), ARGON2_ITERATIONS, ARGON2_PARALLELISM and BCRYPT_COST.
+var (
+	passwordHashers = map[string]passwordHasher{
+		HashArgon2id: argon2idHasher{memory: 64 * 1024, iterations: 3, parallelism: 2, saltLength: 16, keyLength: 32},
+		HashBcrypt:   bcryptHasher{cost: bcrypt.DefaultCost},
+	}
+	passwordHashAlgorithm = HashArgon2id
+)
+
+func init() {
+	argon := passwordHashers[HashArgon2id].(argon2idHasher)
+	argon.memory = uint32(config.Int("ARGON2_MEMORY", int(argon.memory)))
+	argon.iterations = uint32(config.Int("ARGON2_ITERATIONS", int(argon.iterations)))
+	if p := config.Int("ARGON2_PARALLELISM", int(argon.parallelism)); p <= 255 {
+		argon.parallelism = uint8(p)
+	}
+	passwordHashers[HashArgon2id] = argon
+
+	cost := config.Int("BCRYPT_COST", bcrypt.DefaultCost)
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		log.Printf("WARNING: invalid BCRYPT_COST %d; using default %d\n", cost, bcrypt.DefaultCost)
+		cost = bcrypt.DefaultCost
+	}
+	passwordHashers[HashBcrypt] = bcryptHasher{cost: cost}
+
+	if v := os.Getenv("PASSWORD_HASH_ALGORITHM"); v != "" {
+		if _, ok := passwordHashers[v]; ok {
+			passwordHashAlgorithm = v
+		} else {
+			log.Printf("WARNING: unknown PASSWORD_HASH_ALGORITHM %q; using %s\n", v, passwordHashAlgorithm)
+		}
+	}
+}
+
+// hasherFor returns the registered hasher that produced encoded
+func hasherFor(encoded string) (passwordHasher, bool) {
+	for _, h := range passwordHashers {
+		if h.Matches(encoded) {
+			return h, true
+		}
+	}
+	return nil, false
+}
+
+// PasswordNeedsRehash reports whether a stored hash should be replaced because
+// it uses another algorithm than PASSWORD_HASH_ALGORITHM or outdated parameters
+func PasswordNeedsRehash(encoded string) bool {
+	current := passwordHashers[passwordHashAlgorithm]
+	return !current.Matches(encoded) || current.Outdated(encoded)
+}
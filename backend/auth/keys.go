@@ -0,0 +1,357 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"pillow/config"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Supported values for JWT_SIGNING_ALG. HS256 keeps the single shared JWT_SECRET;
+// the asymmetric algorithms use rotating key pairs stored in "signing_keys".
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// keyRotationLockID is the Postgres advisory lock taken while rotating keys so
+// only one replica generates the next key
+const keyRotationLockID = 7_146_530_001
+
+// signingKey is one asymmetric key pair identified by its "kid"
+type signingKey struct {
+	kid       string
+	alg       string
+	method    jwt.SigningMethod
+	private   crypto.Signer
+	createdAt time.Time
+}
+
+// keyring holds the key used for signing (current) and the key it replaced
+// (previous). Tokens signed with either are accepted.
+type keyring struct {
+	mu         sync.RWMutex
+	db         *sql.DB
+	current    *signingKey
+	previous   *signingKey
+	lastReload time.Time
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+var (
+	signingAlg          = AlgHS256
+	keyRotationInterval = 30 * 24 * time.Hour
+	keys                = &keyring{}
+)
+
+func init() {
+	if v := os.Getenv("JWT_SIGNING_ALG"); v != "" {
+		switch strings.ToUpper(v) {
+		case AlgHS256:
+			signingAlg = AlgHS256
+		case AlgRS256:
+			signingAlg = AlgRS256
+		case "EDDSA", "ED25519":
+			signingAlg = AlgEdDSA
+		default:
+			log.Printf("WARNING: unsupported JWT_SIGNING_ALG %q; using %s\n", v, signingAlg)
+		}
+	}
+	keyRotationInterval = config.OptionalDuration("JWT_KEY_ROTATION_INTERVAL", keyRotationInterval)
+}
+
+// SigningAlgorithm returns the configured JWT signing algorithm
+func SigningAlgorithm() string {
+	return signingAlg
+}
+
+// StartKeyManager loads the asymmetric signing keys from the database, creates the
+// first key if there is none, and starts a background worker that rotates the key
+// every JWT_KEY_ROTATION_INTERVAL (0 disables rotation) and picks up keys rotated
+// by other replicas. It is a no-op when signing with HS256.
+func StartKeyManager(db *sql.DB) error {
+	if signingAlg == AlgHS256 {
+		return nil
+	}
+
+	keys.mu.Lock()
+	keys.db = db
+	keys.mu.Unlock()
+
+	if err := keys.rotateIfDue(); err != nil {
+		return err
+	}
+	if err := keys.reload(); err != nil {
+		return err
+	}
+
+	keys.stop = make(chan struct{})
+	keys.done = make(chan struct{})
+	go keys.worker()
+	return nil
+}
+
+// StopKeyManager stops the background rotation worker
+func StopKeyManager() {
+	if keys.stop != nil {
+		close(keys.stop)
+		<-keys.done
+		keys.stop = nil
+	}
+}
+
+// worker periodically reloads keys and rotates them when due
+func (k *keyring) worker() {
+	defer close(k.done)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+			if err := k.rotateIfDue(); err != nil {
+				log.Printf("auth: key rotation failed: %v\n", err)
+			}
+			if err := k.reload(); err != nil {
+				log.Printf("auth: failed to reload signing keys: %v\n", err)
+			}
+		}
+	}
+}
+
+// reload reads the two newest keys for the configured algorithm
+func (k *keyring) reload() error {
+	rows, err := k.db.Query(`SELECT kid, private_key, created_at FROM "signing_keys"
+		WHERE algorithm = $1 ORDER BY created_at DESC LIMIT 2`, signingAlg)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var loaded []*signingKey
+	for rows.Next() {
+		var kid, privatePEM string
+		var createdAt time.Time
+		if err := rows.Scan(&kid, &privatePEM, &createdAt); err != nil {
+			return err
+		}
+		key, err := decodeSigningKey(kid, signingAlg, privatePEM, createdAt)
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(loaded) == 0 {
+		return errors.New("auth: no signing keys available")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current = loaded[0]
+	k.previous = nil
+	if len(loaded) > 1 {
+		k.previous = loaded[1]
+	}
+	k.lastReload = time.Now()
+	return nil
+}
+
+// rotateIfDue generates a new key when there is none yet or the newest one is
+// older than the rotation interval. The check runs under an advisory lock so
+// concurrent replicas don't both rotate.
+func (k *keyring) rotateIfDue() error {
+	tx, err := k.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, keyRotationLockID); err != nil {
+		return err
+	}
+
+	var newest sql.NullTime
+	if err := tx.QueryRow(`SELECT MAX(created_at) FROM "signing_keys" WHERE algorithm = $1`, signingAlg).Scan(&newest); err != nil {
+		return err
+	}
+	if newest.Valid && (keyRotationInterval == 0 || time.Since(newest.Time) < keyRotationInterval) {
+		return nil
+	}
+
+	kid, privatePEM, err := generateSigningKey(signingAlg)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO "signing_keys" (kid, algorithm, private_key, created_at) VALUES ($1, $2, $3, $4)`,
+		kid, signingAlg, privatePEM, time.Now())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("auth: rotated %s signing key, new kid=%s\n", signingAlg, kid)
+	return tx.Commit()
+}
+
+// currentKey returns the key new tokens are signed with
+func (k *keyring) currentKey() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// lookup finds a verification key by kid. An unknown kid triggers a reload
+// (at most every few seconds) in case another replica just rotated.
+func (k *keyring) lookup(kid string) *signingKey {
+	find := func() *signingKey {
+		k.mu.RLock()
+		defer k.mu.RUnlock()
+		for _, key := range []*signingKey{k.current, k.previous} {
+			if key != nil && key.kid == kid {
+				return key
+			}
+		}
+		return nil
+	}
+
+	if key := find(); key != nil {
+		return key
+	}
+
+	k.mu.RLock()
+	canReload := k.db != nil && time.Since(k.lastReload) > 5*time.Second
+	k.mu.RUnlock()
+	if canReload {
+		if err := k.reload(); err != nil {
+			log.Printf("auth: failed to reload signing keys: %v\n", err)
+		}
+		return find()
+	}
+	return nil
+}
+
+// generateSigningKey creates a new key pair and returns its kid and PKCS#8 PEM encoding
+func generateSigningKey(alg string) (string, string, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", "", fmt.Errorf("auth: cannot generate key for algorithm %s", alg)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", "", err
+	}
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return uuid.New().String(), string(privatePEM), nil
+}
+
+// decodeSigningKey parses a stored PKCS#8 PEM key
+func decodeSigningKey(kid, alg, privatePEM string, createdAt time.Time) (*signingKey, error) {
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return nil, fmt.Errorf("auth: signing key %s is not valid PEM", kid)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("auth: signing key %s: %w", kid, err)
+	}
+
+	key := &signingKey{kid: kid, alg: alg, createdAt: createdAt}
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		if alg != AlgRS256 {
+			return nil, fmt.Errorf("auth: signing key %s is RSA but algorithm is %s", kid, alg)
+		}
+		key.private = private
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		if alg != AlgEdDSA {
+			return nil, fmt.Errorf("auth: signing key %s is Ed25519 but algorithm is %s", kid, alg)
+		}
+		key.private = private
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("auth: signing key %s has unsupported type %T", kid, parsed)
+	}
+	return key, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWKS returns the public halves of the current and previous signing keys.
+// With HS256 there is nothing that can be published, so the set is empty.
+func PublicJWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	if signingAlg == AlgHS256 {
+		return set
+	}
+
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	for _, key := range []*signingKey{keys.current, keys.previous} {
+		if key == nil {
+			continue
+		}
+		jwk := JWK{Use: "sig", Alg: key.alg, Kid: key.kid}
+		switch pub := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"database/sql"
+	"pillow/config"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Brute-force protection settings. Failed logins are counted per account and per
+// source IP within LOGIN_FAILURE_WINDOW. Each failure on an account delays the next
+// attempt (LOGIN_DELAY_BASE doubling up to LOGIN_DELAY_MAX); reaching
+// LOGIN_MAX_FAILURES (account) or LOGIN_MAX_IP_FAILURES (IP) locks the key for
+// LOGIN_LOCKOUT_DURATION. IPs are not delayed so shared NATs are only affected by
+// an actual lockout.
+var (
+	loginMaxFailures   = 5
+	loginMaxIPFailures = 50
+	loginFailureWindow = 15 * time.Minute
+	loginLockout       = 15 * time.Minute
+	loginDelayBase     = time.Second
+	loginDelayMax      = 30 * time.Second
+)
+
+func init() {
+	loginMaxFailures = config.Int("LOGIN_MAX_FAILURES", loginMaxFailures)
+	loginMaxIPFailures = config.Int("LOGIN_MAX_IP_FAILURES", loginMaxIPFailures)
+	loginFailureWindow = config.Duration("LOGIN_FAILURE_WINDOW", loginFailureWindow)
+	loginLockout = config.Duration("LOGIN_LOCKOUT_DURATION", loginLockout)
+	// Zero disables the delays
+	loginDelayBase = config.OptionalDuration("LOGIN_DELAY_BASE", loginDelayBase)
+	loginDelayMax = config.OptionalDuration("LOGIN_DELAY_MAX", loginDelayMax)
+}
+
+// accountThrottleKey and ipThrottleKey name the rows of "login_throttle"
+func accountThrottleKey(userID uuid.UUID) string { return "account:" + userID.String() }
+func ipThrottleKey(ip string) string             { return "ip:" + ip }
+
+// LoginFailure describes the state after a failed login was recorded
+type LoginFailure struct {
+	AccountFailures int
+	IPFailures      int
+	AccountLocked   bool
+	IPLocked        bool
+	LockedUntil     time.Time
+}
+
+// LoginRetryAfter returns how long the caller has to wait before another login
+// attempt for the account (if known) from ip is allowed. Zero means go ahead.
+func LoginRetryAfter(db *sql.DB, userID *uuid.UUID, ip string) (time.Duration, error) {
+	keys := []interface{}{ipThrottleKey(ip)}
+	query := `SELECT MAX(GREATEST(next_attempt_at, locked_until)) FROM "login_throttle" WHERE key = $1`
+	if userID != nil {
+		keys = append(keys, accountThrottleKey(*userID))
+		query += ` OR key = $2`
+	}
+
+	var until sql.NullTime
+	if err := db.QueryRow(query, keys...).Scan(&until); err != nil {
+		return 0, err
+	}
+	if !until.Valid {
+		return 0, nil
+	}
+	if wait := time.Until(until.Time); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// RecordLoginFailure counts a failed login for the account (if known) and the
+// source IP and applies the progressive delay or lockout that results from it
+func RecordLoginFailure(db *sql.DB, userID *uuid.UUID, ip string) (*LoginFailure, error) {
+	result := &LoginFailure{}
+	now := time.Now()
+
+	var err error
+	result.IPFailures, result.IPLocked, err = recordThrottleFailure(db, ipThrottleKey(ip), loginMaxIPFailures, 0, now)
+	if err != nil {
+		return nil, err
+	}
+	if userID != nil {
+		result.AccountFailures, result.AccountLocked, err = recordThrottleFailure(db, accountThrottleKey(*userID), loginMaxFailures, loginDelayBase, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if result.AccountLocked || result.IPLocked {
+		result.LockedUntil = now.Add(loginLockout)
+	}
+	return result, nil
+}
+
+// recordThrottleFailure increments the failure counter of key, restarting it when
+// the previous failure is outside the window. It returns the new count and whether
+// the key just got locked. Locking resets the counter so the key starts fresh
+// once the lockout expires.
+func recordThrottleFailure(db *sql.DB, key string, maxFailures int, delayBase time.Duration, now time.Time) (int, bool, error) {
+	var failures int
+	err := db.QueryRow(`INSERT INTO "login_throttle" (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN "login_throttle".last_failure_at < $3 THEN 1 ELSE "login_throttle".failures + 1 END,
+			last_failure_at = $2
+		RETURNING failures`, key, now, now.Add(-loginFailureWindow)).Scan(&failures)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if failures >= maxFailures {
+		_, err = db.Exec(`UPDATE "login_throttle" SET failures = 0, next_attempt_at = NULL, locked_until = $1 WHERE key = $2`,
+			now.Add(loginLockout), key)
+		return failures, true, err
+	}
+
+	if delayBase > 0 {
+		delay := delayBase << uint(failures-1)
+		if delay > loginDelayMax || delay <= 0 {
+			delay = loginDelayMax
+		}
+		_, err = db.Exec(`UPDATE "login_throttle" SET next_attempt_at = $1 WHERE key = $2`, now.Add(delay), key)
+	}
+	return failures, false, err
+}
+
+// ResetLoginFailures clears the failure counter of an account after a successful
+// login. The IP counter is left alone so a valid login cannot be used to reset it.
+func ResetLoginFailures(db *sql.DB, userID uuid.UUID) error {
+	_, err := db.Exec(`DELETE FROM "login_throttle" WHERE key = $1`, accountThrottleKey(userID))
+	return err
+}
+
+// UnlockAccount lifts a lockout or delay on an account and reports whether there was one
+func UnlockAccount(db *sql.DB, userID uuid.UUID) (bool, error) {
+	res, err := db.Exec(`DELETE FROM "login_throttle" WHERE key = $1`, accountThrottleKey(userID))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// MFAChallengeClaims are the claims of the short-lived token returned by the first
+// login step when the user has MFA enabled
+type MFAChallengeClaims struct {
+	UserID uuid.UUID `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+// GenerateMFAChallengeToken signs a token proving that userID passed the password step
+func GenerateMFAChallengeToken(userID uuid.UUID, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := &MFAChallengeClaims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    Issuer,
+			Subject:   userID.String(),
+			Audience:  jwt.ClaimStrings{AudienceMFAChallenge},
+			ID:        uuid.New().String(),
+		},
+	}
+	return signToken(claims)
+}
+
+// ValidateMFAChallengeToken verifies a token from GenerateMFAChallengeToken
+func ValidateMFAChallengeToken(tokenString string) (*MFAChallengeClaims, error) {
+	claims := &MFAChallengeClaims{}
+	if err := parseToken(tokenString, claims, AudienceMFAChallenge); err != nil {
+		return nil, err
+	}
+	if claims.UserID == uuid.Nil {
+		return nil, errors.New("invalid MFA challenge token")
+	}
+	return claims, nil
+}
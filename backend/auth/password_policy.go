@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"pillow/models"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Limits that apply regardless of policy. bcrypt (still selectable with
+// PASSWORD_HASH_ALGORITHM) rejects passwords longer than 72 bytes; history is
+// pruned beyond MaxPasswordHistory entries per user.
+const (
+	MaxPasswordBytes   = 72
+	MaxPasswordHistory = 24
+)
+
+// userInfoMinLength is the shortest username or email local part that is checked
+// for with DisallowUserInfo, so very short names do not reject half of all passwords
+const userInfoMinLength = 3
+
+// PolicyViolation is one broken password rule, in the same shape as the field
+// errors returned by middleware.ValidateBody
+type PolicyViolation struct {
+	Field  string `json:"field"`
+	Tag    string `json:"tag"`
+	Param  string `json:"param"`
+	Reason string `json:"reason"`
+}
+
+// DefaultPasswordPolicy is used when no global policy has been configured
+func DefaultPasswordPolicy() models.PasswordPolicy {
+	return models.PasswordPolicy{
+		MinLength:        8,
+		BannedWords:      []string{},
+		DisallowUserInfo: true,
+	}
+}
+
+// ValidatePassword checks password against every rule of policy except history,
+// which needs the database (see PasswordReused). username and email may be empty.
+func ValidatePassword(policy models.PasswordPolicy, password, username, email string) []PolicyViolation {
+	var violations []PolicyViolation
+	add := func(tag, param, reason string) {
+		violations = append(violations, PolicyViolation{Field: "password", Tag: tag, Param: param, Reason: reason})
+	}
+
+	if n := utf8.RuneCountInString(password); n < policy.MinLength || n == 0 {
+		min := policy.MinLength
+		if min < 1 {
+			min = 1
+		}
+		add("min", strconv.Itoa(min), fmt.Sprintf("Password must be at least %d characters", min))
+	}
+	if len(password) > MaxPasswordBytes {
+		add("max", strconv.Itoa(MaxPasswordBytes), fmt.Sprintf("Password must be at most %d bytes", MaxPasswordBytes))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	if policy.RequireUppercase && !upper {
+		add("uppercase", "", "Password must contain an uppercase letter")
+	}
+	if policy.RequireLowercase && !lower {
+		add("lowercase", "", "Password must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !digit {
+		add("digit", "", "Password must contain a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		add("symbol", "", "Password must contain a symbol")
+	}
+
+	lowered := strings.ToLower(password)
+	for _, word := range policy.BannedWords {
+		if word != "" && strings.Contains(lowered, strings.ToLower(word)) {
+			add("banned_word", word, "Password contains a banned word")
+		}
+	}
+
+	if policy.DisallowUserInfo {
+		if username != "" && len(username) >= userInfoMinLength && strings.Contains(lowered, strings.ToLower(username)) {
+			add("user_info", "username", "Password must not contain the username")
+		}
+		local := strings.SplitN(email, "@", 2)[0]
+		if len(local) >= userInfoMinLength && strings.Contains(lowered, strings.ToLower(local)) {
+			add("user_info", "email", "Password must not contain the email address")
+		}
+	}
+
+	return violations
+}
+
+// mergePasswordPolicies returns the strictest combination of two policies
+func mergePasswordPolicies(a, b models.PasswordPolicy) models.PasswordPolicy {
+	merged := a
+	if b.MinLength > merged.MinLength {
+		merged.MinLength = b.MinLength
+	}
+	merged.RequireUppercase = a.RequireUppercase || b.RequireUppercase
+	merged.RequireLowercase = a.RequireLowercase || b.RequireLowercase
+	merged.RequireDigit = a.RequireDigit || b.RequireDigit
+	merged.RequireSymbol = a.RequireSymbol || b.RequireSymbol
+	merged.DisallowUserInfo = a.DisallowUserInfo || b.DisallowUserInfo
+	if b.HistorySize > merged.HistorySize {
+		merged.HistorySize = b.HistorySize
+	}
+	if b.MaxAgeDays > 0 && (merged.MaxAgeDays == 0 || b.MaxAgeDays < merged.MaxAgeDays) {
+		merged.MaxAgeDays = b.MaxAgeDays
+	}
+
+	seen := make(map[string]bool)
+	merged.BannedWords = []string{}
+	for _, word := range append(append([]string{}, a.BannedWords...), b.BannedWords...) {
+		key := strings.ToLower(word)
+		if !seen[key] {
+			seen[key] = true
+			merged.BannedWords = append(merged.BannedWords, word)
+		}
+	}
+	return merged
+}
+
+const passwordPolicyColumns = `org_id, min_length, require_uppercase, require_lowercase, require_digit, require_symbol,
+	banned_words, disallow_user_info, history_size, max_age_days, updated_at`
+
+// scanPasswordPolicy scans a row selected with passwordPolicyColumns
+func scanPasswordPolicy(row interface{ Scan(...interface{}) error }) (models.PasswordPolicy, error) {
+	var p models.PasswordPolicy
+	var updatedAt time.Time
+	err := row.Scan(&p.OrgID, &p.MinLength, &p.RequireUppercase, &p.RequireLowercase, &p.RequireDigit, &p.RequireSymbol,
+		pq.Array(&p.BannedWords), &p.DisallowUserInfo, &p.HistorySize, &p.MaxAgeDays, &updatedAt)
+	p.UpdatedAt = &updatedAt
+	if p.BannedWords == nil {
+		p.BannedWords = []string{}
+	}
+	return p, err
+}
+
+// LoadPasswordPolicy loads the policy stored for an organization, or the global
+// policy when orgID is nil. It returns sql.ErrNoRows when none is configured.
+func LoadPasswordPolicy(db *sql.DB, orgID *uuid.UUID) (models.PasswordPolicy, error) {
+	if orgID == nil {
+		return scanPasswordPolicy(db.QueryRow(`SELECT ` + passwordPolicyColumns + ` FROM "password_policies" WHERE org_id IS NULL`))
+	}
+	return scanPasswordPolicy(db.QueryRow(`SELECT `+passwordPolicyColumns+` FROM "password_policies" WHERE org_id = $1`, *orgID))
+}
+
+// SavePasswordPolicy creates or replaces the policy of an organization, or the
+// global policy when policy.OrgID is nil
+func SavePasswordPolicy(db *sql.DB, policy models.PasswordPolicy) (models.PasswordPolicy, error) {
+	conflict := `(org_id) WHERE org_id IS NOT NULL`
+	if policy.OrgID == nil {
+		conflict = `((org_id IS NULL)) WHERE org_id IS NULL`
+	}
+	if policy.BannedWords == nil {
+		policy.BannedWords = []string{}
+	}
+	return scanPasswordPolicy(db.QueryRow(`INSERT INTO "password_policies" (id, org_id, min_length, require_uppercase,
+			require_lowercase, require_digit, require_symbol, banned_words, disallow_user_info, history_size, max_age_days,
+			created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		ON CONFLICT `+conflict+` DO UPDATE SET
+			min_length = EXCLUDED.min_length,
+			require_uppercase = EXCLUDED.require_uppercase,
+			require_lowercase = EXCLUDED.require_lowercase,
+			require_digit = EXCLUDED.require_digit,
+			require_symbol = EXCLUDED.require_symbol,
+			banned_words = EXCLUDED.banned_words,
+			disallow_user_info = EXCLUDED.disallow_user_info,
+			history_size = EXCLUDED.history_size,
+			max_age_days = EXCLUDED.max_age_days,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING `+passwordPolicyColumns,
+		uuid.New(), policy.OrgID, policy.MinLength, policy.RequireUppercase, policy.RequireLowercase, policy.RequireDigit,
+		policy.RequireSymbol, pq.Array(policy.BannedWords), policy.DisallowUserInfo, policy.HistorySize, policy.MaxAgeDays))
+}
+
+// EffectivePasswordPolicy combines the global policy (or the built-in default)
+// with the policies of every organization the user belongs to. A nil userID
+// yields the global policy, which is what applies to new registrations.
+func EffectivePasswordPolicy(db *sql.DB, userID *uuid.UUID) (models.PasswordPolicy, error) {
+	rows, err := db.Query(`SELECT `+passwordPolicyColumns+` FROM "password_policies"
+		WHERE org_id IS NULL OR org_id IN (SELECT org_id FROM "user_organizations" WHERE user_id = $1)`, userID)
+	if err != nil {
+		return models.PasswordPolicy{}, err
+	}
+	defer rows.Close()
+
+	global := DefaultPasswordPolicy()
+	var orgPolicies []models.PasswordPolicy
+	for rows.Next() {
+		p, err := scanPasswordPolicy(rows)
+		if err != nil {
+			return models.PasswordPolicy{}, err
+		}
+		if p.OrgID == nil {
+			global = p
+		} else {
+			orgPolicies = append(orgPolicies, p)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return models.PasswordPolicy{}, err
+	}
+
+	effective := global
+	for _, p := range orgPolicies {
+		effective = mergePasswordPolicies(effective, p)
+	}
+	effective.OrgID = nil
+	effective.UpdatedAt = nil
+	return effective, nil
+}
+
+// PasswordReused reports whether password matches the user's current password
+// or one of the historySize-1 before it
+func PasswordReused(db *sql.DB, userID uuid.UUID, password string, historySize int) (bool, error) {
+	if historySize <= 0 {
+		return false, nil
+	}
+	if historySize > MaxPasswordHistory {
+		historySize = MaxPasswordHistory
+	}
+
+	rows, err := db.Query(`SELECT password_hash FROM "users" WHERE id = $1 AND password_hash <> ''
+		UNION ALL
+		(SELECT password_hash FROM "password_history" WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2)`,
+		userID, historySize-1)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return false, err
+		}
+		if CheckPasswordHash(password, hash) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// UpdatePassword stores a new password hash, moves the previous one into the
+// password history and restarts the password age
+func UpdatePassword(tx *sql.Tx, userID uuid.UUID, newHash string) error {
+	var oldHash string
+	if err := tx.QueryRow(`SELECT password_hash FROM "users" WHERE id = $1 FOR UPDATE`, userID).Scan(&oldHash); err != nil {
+		return err
+	}
+
+	if oldHash != "" {
+		if _, err := tx.Exec(`INSERT INTO "password_history" (id, user_id, password_hash, created_at)
+			VALUES ($1, $2, $3, CURRENT_TIMESTAMP)`, uuid.New(), userID, oldHash); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM "password_history" WHERE user_id = $1 AND id NOT IN
+			(SELECT id FROM "password_history" WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2)`,
+			userID, MaxPasswordHistory); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(`UPDATE "users" SET password_hash = $1, password_changed_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP WHERE id = $2`, newHash, userID)
+	return err
+}
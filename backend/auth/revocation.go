@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RevokeToken adds a token ID to the denylist until the token would have expired anyway.
+// Expired denylist entries are purged on the way since they can no longer match a valid token.
+func RevokeToken(db *sql.DB, jti string, userID uuid.UUID, expiresAt time.Time) error {
+	if _, err := db.Exec(`DELETE FROM "revoked_tokens" WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`INSERT INTO "revoked_tokens" (jti, user_id, expires_at, revoked_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (jti) DO NOTHING`, jti, userID, expiresAt)
+	return err
+}
+
+// RevokeAllUserTokens invalidates every access token issued to a user before now
+// and revokes all of the user's refresh token sessions.
+func RevokeAllUserTokens(db *sql.DB, userID uuid.UUID) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE "users" SET tokens_valid_after = CURRENT_TIMESTAMP WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE "sessions" SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
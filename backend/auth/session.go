@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"pillow/models"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned when a refresh token is unknown
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenExpired is returned when a refresh token is past its expiry
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+	// ErrRefreshTokenReused is returned when an already rotated or revoked refresh
+	// token is presented again. The whole session family is revoked when this happens.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// GenerateOpaqueToken returns a new random, URL-safe token suitable for refresh
+// tokens and other single-use secrets (password reset links, etc.)
+func GenerateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 digest of an opaque token.
+// Only this digest is persisted so a database leak does not expose usable tokens.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession starts a new session family for a user and returns the stored
+// session together with the plaintext refresh token to hand to the client.
+func CreateSession(db *sql.DB, userID uuid.UUID, userAgent, ipAddress string) (*models.Session, string, error) {
+	refreshToken, err := GenerateOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		ID:        uuid.New(),
+		UserID:    userID,
+		FamilyID:  uuid.New(),
+		TokenHash: HashToken(refreshToken),
+		ExpiresAt: now.Add(refreshTokenTTL),
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
+		CreatedAt: now,
+	}
+
+	_, err = db.Exec(`INSERT INTO "sessions" (id, user_id, family_id, refresh_token_hash, expires_at, user_agent, ip_address, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		session.ID, session.UserID, session.FamilyID, session.TokenHash, session.ExpiresAt, session.UserAgent, session.IPAddress, session.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return session, refreshToken, nil
+}
+
+// RotateSession exchanges a refresh token for a new one in the same family.
+// The presented token is marked as replaced so it can only be used once; presenting
+// it again revokes every token in the family and returns ErrRefreshTokenReused.
+func RotateSession(db *sql.DB, refreshToken, userAgent, ipAddress string) (*models.Session, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	var current models.Session
+	err = tx.QueryRow(`SELECT id, user_id, family_id, expires_at, revoked_at, replaced_by
+		FROM "sessions" WHERE refresh_token_hash = $1 FOR UPDATE`,
+		HashToken(refreshToken)).Scan(&current.ID, &current.UserID, &current.FamilyID, &current.ExpiresAt, &current.RevokedAt, &current.ReplacedBy)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", ErrInvalidRefreshToken
+		}
+		return nil, "", err
+	}
+
+	if current.RevokedAt != nil || current.ReplacedBy != nil {
+		// The token was already used: assume it was stolen and kill the whole family.
+		if _, err := tx.Exec(`UPDATE "sessions" SET revoked_at = CURRENT_TIMESTAMP WHERE family_id = $1 AND revoked_at IS NULL`, current.FamilyID); err != nil {
+			return nil, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, "", err
+		}
+		return &current, "", ErrRefreshTokenReused
+	}
+
+	if time.Now().After(current.ExpiresAt) {
+		return nil, "", ErrRefreshTokenExpired
+	}
+
+	newToken, err := GenerateOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	next := &models.Session{
+		ID:        uuid.New(),
+		UserID:    current.UserID,
+		FamilyID:  current.FamilyID,
+		TokenHash: HashToken(newToken),
+		ExpiresAt: now.Add(refreshTokenTTL),
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
+		CreatedAt: now,
+	}
+
+	_, err = tx.Exec(`INSERT INTO "sessions" (id, user_id, family_id, refresh_token_hash, expires_at, user_agent, ip_address, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		next.ID, next.UserID, next.FamilyID, next.TokenHash, next.ExpiresAt, next.UserAgent, next.IPAddress, next.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = tx.Exec(`UPDATE "sessions" SET revoked_at = $1, replaced_by = $2, last_used_at = $1 WHERE id = $3`,
+		now, next.ID, current.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	return next, newToken, nil
+}
+
+// RevokeSessionFamily revokes every refresh token belonging to a session family
+func RevokeSessionFamily(db *sql.DB, familyID uuid.UUID) error {
+	_, err := db.Exec(`UPDATE "sessions" SET revoked_at = CURRENT_TIMESTAMP WHERE family_id = $1 AND revoked_at IS NULL`, familyID)
+	return err
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Int reads a positive integer from the environment, falling back to def
+func Int(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("WARNING: invalid %s %q; using default %d\n", key, v, def)
+	}
+	return def
+}
+
+// Duration reads a positive Go duration such as "15m" from the environment,
+// falling back to def
+func Duration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("WARNING: invalid %s %q; using default %s\n", key, v, def)
+	}
+	return def
+}
+
+// OptionalDuration is Duration for settings where zero turns the feature off
+func OptionalDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			return d
+		}
+		log.Printf("WARNING: invalid %s %q; using default %s\n", key, v, def)
+	}
+	return def
+}
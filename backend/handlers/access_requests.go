@@ -0,0 +1,668 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"pillow/config"
+	"pillow/middleware"
+	"pillow/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// accessRequestMaxDuration caps how long requested access can be held
+// (ACCESS_REQUEST_MAX_DURATION)
+var accessRequestMaxDuration = config.Duration("ACCESS_REQUEST_MAX_DURATION", 24*time.Hour)
+
+// accessRequestTTL is how long a request stays pending before it expires
+// (ACCESS_REQUEST_TTL)
+var accessRequestTTL = config.Duration("ACCESS_REQUEST_TTL", 7*24*time.Hour)
+
+// CreateAccessRequestRequest represents the request payload for requesting a
+// role or a permission. Hours limits the access; without it the assignment does
+// not expire.
+type CreateAccessRequestRequest struct {
+	RoleID        *uuid.UUID `json:"role_id,omitempty"`
+	Permission    string     `json:"permission,omitempty"`
+	Scope         string     `json:"scope,omitempty"`
+	OrgID         *uuid.UUID `json:"org_id,omitempty"`
+	Hours         *int       `json:"hours,omitempty"`
+	Justification string     `json:"justification"`
+}
+
+// AccessRequestDecision represents the request payload for approving or
+// rejecting an access request. Approving a permission request takes the role to
+// assign in RoleID.
+type AccessRequestDecision struct {
+	RoleID *uuid.UUID `json:"role_id,omitempty"`
+	Note   string     `json:"note,omitempty"`
+}
+
+const accessRequestColumns = `ar.id, ar.user_id, u.username, ar.role_id, COALESCE(r.name, ''), ar.permission_id,
+	COALESCE(p.name, ''), ar.scope, ar.org_id, ar.duration_hours, ar.justification, ar.status, ar.decided_by,
+	ar.decided_at, COALESCE(ar.decision_note, ''), ar.valid_from, ar.valid_until, ar.expires_at, ar.created_at,
+	ar.updated_at`
+
+const accessRequestFrom = ` FROM "access_requests" ar
+	INNER JOIN "users" u ON u.id = ar.user_id
+	LEFT JOIN "roles" r ON r.id = ar.role_id
+	LEFT JOIN "permissions" p ON p.id = ar.permission_id`
+
+// scanAccessRequest scans a row selected with accessRequestColumns
+func scanAccessRequest(row interface{ Scan(...interface{}) error }) (models.AccessRequest, error) {
+	var ar models.AccessRequest
+	err := row.Scan(&ar.ID, &ar.UserID, &ar.Username, &ar.RoleID, &ar.RoleName, &ar.PermissionID,
+		&ar.PermissionName, &ar.Scope, &ar.OrgID, &ar.DurationHours, &ar.Justification, &ar.Status, &ar.DecidedBy,
+		&ar.DecidedAt, &ar.DecisionNote, &ar.ValidFrom, &ar.ValidUntil, &ar.ExpiresAt, &ar.CreatedAt,
+		&ar.UpdatedAt)
+	return ar, err
+}
+
+// loadAccessRequest loads an access request with its approvers; it returns
+// sql.ErrNoRows when there is none
+func loadAccessRequest(db *sql.DB, id uuid.UUID) (models.AccessRequest, error) {
+	ar, err := scanAccessRequest(db.QueryRow(`SELECT `+accessRequestColumns+accessRequestFrom+` WHERE ar.id = $1`, id))
+	if err != nil {
+		return ar, err
+	}
+	ar.Approvers, err = accessRequestApprovers(db, ar.RoleID, ar.OrgID)
+	return ar, err
+}
+
+// queryAccessRequests runs a query selecting accessRequestColumns and resolves
+// the approvers of each request
+func queryAccessRequests(db *sql.DB, where string, args ...interface{}) ([]models.AccessRequest, error) {
+	rows, err := db.Query(`SELECT `+accessRequestColumns+accessRequestFrom+` WHERE `+where+` ORDER BY ar.created_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	requests := []models.AccessRequest{}
+	for rows.Next() {
+		ar, err := scanAccessRequest(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		requests = append(requests, ar)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range requests {
+		if requests[i].Approvers, err = accessRequestApprovers(db, requests[i].RoleID, requests[i].OrgID); err != nil {
+			return nil, err
+		}
+	}
+	return requests, nil
+}
+
+// accessRequestApprovers resolves who is asked to decide a request: the owner
+// of the role and the managers of the organization and its parents
+func accessRequestApprovers(db *sql.DB, roleID, orgID *uuid.UUID) ([]uuid.UUID, error) {
+	var chain []uuid.UUID
+	if orgID != nil {
+		var err error
+		if chain, err = middleware.OrgChain(db, *orgID); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.Query(`SELECT owner_id FROM "roles" WHERE id = $1 AND owner_id IS NOT NULL
+		UNION
+		SELECT managed_by FROM "organizations" WHERE id = ANY($2::uuid[]) AND managed_by IS NOT NULL`,
+		roleID, pq.Array(chain))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	approvers := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		approvers = append(approvers, id)
+	}
+	return approvers, rows.Err()
+}
+
+// canDecideAccessRequest reports whether the caller may approve or reject ar:
+// as one of its approvers or by holding assign_roles in its scope. Requesters
+// never decide their own requests.
+func canDecideAccessRequest(db *sql.DB, r *http.Request, callerID uuid.UUID, ar models.AccessRequest) (bool, error) {
+	if ar.UserID == callerID {
+		return false, nil
+	}
+	for _, id := range ar.Approvers {
+		if id == callerID {
+			return true, nil
+		}
+	}
+	return middleware.CheckPermission(db, r, "assign_roles", ar.OrgID)
+}
+
+// accessRequestFromRequest parses the id route variable and loads the access
+// request, writing an error response and returning false when that fails
+func accessRequestFromRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) (models.AccessRequest, bool) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		writeErrorResponse(w, "Invalid access request ID format", http.StatusBadRequest, r)
+		return models.AccessRequest{}, false
+	}
+	ar, err := loadAccessRequest(db, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeErrorResponse(w, "Access request not found", http.StatusNotFound, r)
+			return ar, false
+		}
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+		return ar, false
+	}
+	return ar, true
+}
+
+// pendingAccessRequestFromRequest is accessRequestFromRequest for requests that
+// must still be pending
+func pendingAccessRequestFromRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) (models.AccessRequest, bool) {
+	ar, ok := accessRequestFromRequest(db, w, r)
+	if ok && ar.Status != models.AccessRequestPending {
+		writeErrorResponse(w, "Access request is already "+ar.Status, http.StatusConflict, r)
+		return ar, false
+	}
+	return ar, ok
+}
+
+// CreateAccessRequest lets the current user ask for a role, or for a permission
+// (typically one a 403 named in X-Required-Permission), with a justification
+func CreateAccessRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var req CreateAccessRequestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+		req.Permission = strings.TrimSpace(req.Permission)
+		if (req.RoleID == nil) == (req.Permission == "") {
+			writeErrorResponse(w, "Exactly one of role_id and permission is required", http.StatusBadRequest, r)
+			return
+		}
+		scope, msg := resolveRoleScope(req.Scope, req.OrgID)
+		if msg != "" {
+			writeErrorResponse(w, msg, http.StatusBadRequest, r)
+			return
+		}
+		if req.Hours != nil {
+			maxHours := int(accessRequestMaxDuration.Hours())
+			if *req.Hours < 1 || *req.Hours > maxHours {
+				writeErrorResponse(w, "hours must be between 1 and "+strconv.Itoa(maxHours), http.StatusBadRequest, r)
+				return
+			}
+		}
+		req.Justification = strings.TrimSpace(req.Justification)
+		if req.Justification == "" {
+			writeErrorResponse(w, "justification is required", http.StatusBadRequest, r)
+			return
+		}
+
+		if req.OrgID != nil {
+			exists, err := organizationExists(db, *req.OrgID)
+			if err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if !exists {
+				writeErrorResponse(w, "Organization not found", http.StatusNotFound, r)
+				return
+			}
+		}
+
+		var permissionID *uuid.UUID
+		var held bool
+		if req.RoleID != nil {
+			if _, err := loadRole(db, *req.RoleID); err != nil {
+				if err == sql.ErrNoRows {
+					writeErrorResponse(w, "Role not found", http.StatusNotFound, r)
+					return
+				}
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "active_user_roles"
+				WHERE user_id = $1 AND role_id = $2 AND org_id IS NOT DISTINCT FROM $3)`,
+				user.ID, req.RoleID, req.OrgID).Scan(&held)
+			if err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+		} else {
+			var id uuid.UUID
+			var scopeLevel string
+			err := db.QueryRow(`SELECT id, COALESCE(scope_level, '') FROM "permissions" WHERE name = $1`,
+				req.Permission).Scan(&id, &scopeLevel)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					writeErrorResponse(w, "Permission not found", http.StatusNotFound, r)
+					return
+				}
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if req.OrgID != nil && scopeLevel == models.PermissionScopeSystem {
+				writeErrorResponse(w, "System-level permissions can only be requested globally", http.StatusBadRequest, r)
+				return
+			}
+			permissionID = &id
+			if held, err = middleware.CheckPermission(db, r, req.Permission, req.OrgID); err != nil {
+				writeErrorResponse(w, "Error checking permissions", http.StatusInternalServerError, r)
+				return
+			}
+		}
+		if held {
+			writeErrorResponse(w, "You already have this access in this scope", http.StatusConflict, r)
+			return
+		}
+
+		var pending bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "access_requests"
+			WHERE user_id = $1 AND role_id IS NOT DISTINCT FROM $2 AND permission_id IS NOT DISTINCT FROM $3
+			AND org_id IS NOT DISTINCT FROM $4 AND status = $5)`,
+			user.ID, req.RoleID, permissionID, req.OrgID, models.AccessRequestPending).Scan(&pending)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if pending {
+			writeErrorResponse(w, "You already have a pending request for this access", http.StatusConflict, r)
+			return
+		}
+
+		id := uuid.New()
+		if _, err := db.Exec(`INSERT INTO "access_requests" (id, user_id, role_id, permission_id, scope, org_id,
+				duration_hours, justification, status, expires_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW() + make_interval(secs => $10),
+				CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+			id, user.ID, req.RoleID, permissionID, scope, req.OrgID, req.Hours, req.Justification,
+			models.AccessRequestPending, accessRequestTTL.Seconds()); err != nil {
+			writeErrorResponse(w, "Failed to create access request: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		ar, err := loadAccessRequest(db, id)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "ACCESS_REQUESTED", map[string]interface{}{
+			"request_id":    ar.ID,
+			"role_id":       ar.RoleID,
+			"permission":    ar.PermissionName,
+			"scope":         ar.Scope,
+			"org_id":        ar.OrgID,
+			"hours":         ar.DurationHours,
+			"justification": ar.Justification,
+			"approvers":     ar.Approvers,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ar)
+	}
+}
+
+// GetMyAccessRequests lists the access requests of the current user
+func GetMyAccessRequests(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		requests, err := queryAccessRequests(db, `ar.user_id = $1`, user.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(requests)
+	}
+}
+
+// GetPendingAccessRequests lists the pending requests the current user can
+// decide
+func GetPendingAccessRequests(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		pending, err := queryAccessRequests(db, `ar.status = $1 AND ar.expires_at > NOW() AND ar.user_id <> $2`,
+			models.AccessRequestPending, user.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		requests := []models.AccessRequest{}
+		for _, ar := range pending {
+			allowed, err := canDecideAccessRequest(db, r, user.ID, ar)
+			if err != nil {
+				writeErrorResponse(w, "Error checking permissions", http.StatusInternalServerError, r)
+				return
+			}
+			if allowed {
+				requests = append(requests, ar)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(requests)
+	}
+}
+
+// GetAccessRequest returns an access request to its requester and to those who
+// can decide it
+func GetAccessRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+		ar, ok := accessRequestFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		if ar.UserID != user.ID {
+			allowed, err := canDecideAccessRequest(db, r, user.ID, ar)
+			if err != nil {
+				writeErrorResponse(w, "Error checking permissions", http.StatusInternalServerError, r)
+				return
+			}
+			if !allowed {
+				writeErrorResponse(w, "Access request not found", http.StatusNotFound, r)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ar)
+	}
+}
+
+// decodeAccessRequestDecision reads the optional decision body
+func decodeAccessRequestDecision(w http.ResponseWriter, r *http.Request) (AccessRequestDecision, bool) {
+	var req AccessRequestDecision
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return req, false
+		}
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	return req, true
+}
+
+// ApproveAccessRequest assigns the requested role, or for a permission request
+// the role_id chosen by the approver, which must grant the permission. Access
+// is granted from now, for the requested number of hours when set. Approvers,
+// the role's owner included, must hold every permission of the role in the
+// scope, like GrantUserRole requires.
+func ApproveAccessRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		approver, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+		ar, ok := pendingAccessRequestFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		decision, ok := decodeAccessRequestDecision(w, r)
+		if !ok {
+			return
+		}
+		if ar.UserID == approver.ID {
+			writeErrorResponse(w, "You cannot approve your own access request", http.StatusForbidden, r)
+			return
+		}
+
+		roleID := ar.RoleID
+		if ar.PermissionID != nil {
+			if decision.RoleID == nil {
+				writeErrorResponse(w, "role_id of a role granting "+ar.PermissionName+" is required", http.StatusBadRequest, r)
+				return
+			}
+			var grants bool
+			err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "role_permissions" rp
+				INNER JOIN "role_ancestry" ra ON rp.role_id = ra.ancestor_id
+				WHERE ra.role_id = $1 AND rp.permission_id = $2)`, decision.RoleID, ar.PermissionID).Scan(&grants)
+			if err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if !grants {
+				writeErrorResponse(w, "The role does not grant "+ar.PermissionName, http.StatusBadRequest, r)
+				return
+			}
+			roleID = decision.RoleID
+			if ar.Approvers, err = accessRequestApprovers(db, roleID, ar.OrgID); err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+		}
+
+		allowed, err := canDecideAccessRequest(db, r, approver.ID, ar)
+		if err != nil {
+			writeErrorResponse(w, "Error checking permissions", http.StatusInternalServerError, r)
+			return
+		}
+		if !allowed {
+			writeErrorResponse(w, "Insufficient permissions", http.StatusForbidden, r)
+			return
+		}
+		role, err := loadRole(db, *roleID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		missing, err := missingRolePermissions(db, r, role.ID, ar.OrgID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to compare permissions: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if len(missing) > 0 {
+			writeErrorResponse(w, "Cannot grant a role with permissions you do not hold: "+strings.Join(missing, ", "), http.StatusForbidden, r)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := lockedSoDViolations(tx, &ar.UserID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to check separation of duties: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		res, err := tx.Exec(`UPDATE "access_requests" SET status = $2, role_id = $3, decided_by = $4,
+				decided_at = CURRENT_TIMESTAMP, decision_note = NULLIF($5, ''), valid_from = NOW(),
+				valid_until = NOW() + make_interval(hours => duration_hours), updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND status = $6 AND expires_at > NOW()`,
+			ar.ID, models.AccessRequestApproved, role.ID, approver.ID, decision.Note, models.AccessRequestPending)
+		if err != nil {
+			writeErrorResponse(w, "Failed to approve access request: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeErrorResponse(w, "Access request was decided concurrently or has expired", http.StatusConflict, r)
+			return
+		}
+
+		res, err = tx.Exec(`INSERT INTO "user_roles" (user_id, role_id, scope, org_id, valid_from, valid_until, created_at, updated_at)
+			SELECT ar.user_id, ar.role_id, ar.scope, ar.org_id, ar.valid_from, ar.valid_until, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+			FROM "access_requests" ar WHERE ar.id = $1
+			AND NOT EXISTS (SELECT 1 FROM "user_roles" ur
+				WHERE ur.user_id = ar.user_id AND ur.role_id = ar.role_id AND ur.org_id IS NOT DISTINCT FROM ar.org_id
+				AND (ur.valid_until IS NULL OR ur.valid_until > NOW()))`, ar.ID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to grant role: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeErrorResponse(w, "User already has this role in this scope", http.StatusConflict, r)
+			return
+		}
+		if !checkSeparationOfDuties(tx, w, r, &ar.UserID, before) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		if ar, err = loadAccessRequest(db, ar.ID); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "ACCESS_REQUEST_APPROVED", map[string]interface{}{
+			"request_id":  ar.ID,
+			"user_id":     ar.UserID,
+			"role_id":     ar.RoleID,
+			"role_name":   ar.RoleName,
+			"permission":  ar.PermissionName,
+			"scope":       ar.Scope,
+			"org_id":      ar.OrgID,
+			"valid_from":  ar.ValidFrom,
+			"valid_until": ar.ValidUntil,
+			"note":        ar.DecisionNote,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ar)
+	}
+}
+
+// RejectAccessRequest rejects a pending access request
+func RejectAccessRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		approver, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+		ar, ok := pendingAccessRequestFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		decision, ok := decodeAccessRequestDecision(w, r)
+		if !ok {
+			return
+		}
+		allowed, err := canDecideAccessRequest(db, r, approver.ID, ar)
+		if err != nil {
+			writeErrorResponse(w, "Error checking permissions", http.StatusInternalServerError, r)
+			return
+		}
+		if !allowed {
+			writeErrorResponse(w, "Insufficient permissions", http.StatusForbidden, r)
+			return
+		}
+
+		if !closeAccessRequest(db, w, r, ar.ID, models.AccessRequestRejected, &approver.ID, decision.Note) {
+			return
+		}
+
+		setAuditHeaders(w, r, "ACCESS_REQUEST_REJECTED", map[string]interface{}{
+			"request_id": ar.ID,
+			"user_id":    ar.UserID,
+			"role_id":    ar.RoleID,
+			"permission": ar.PermissionName,
+			"org_id":     ar.OrgID,
+			"note":       decision.Note,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Access request rejected",
+			"id":      ar.ID,
+		})
+	}
+}
+
+// CancelAccessRequest withdraws one of the current user's pending requests
+func CancelAccessRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+		ar, ok := pendingAccessRequestFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		if ar.UserID != user.ID {
+			writeErrorResponse(w, "Access request not found", http.StatusNotFound, r)
+			return
+		}
+
+		if !closeAccessRequest(db, w, r, ar.ID, models.AccessRequestCancelled, nil, "") {
+			return
+		}
+
+		setAuditHeaders(w, r, "ACCESS_REQUEST_CANCELLED", map[string]interface{}{
+			"request_id": ar.ID,
+			"role_id":    ar.RoleID,
+			"permission": ar.PermissionName,
+			"org_id":     ar.OrgID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Access request cancelled",
+			"id":      ar.ID,
+		})
+	}
+}
+
+// closeAccessRequest moves a pending request to status without granting
+// anything, writing an error response and returning false when that fails
+func closeAccessRequest(db *sql.DB, w http.ResponseWriter, r *http.Request, id uuid.UUID, status string, decidedBy *uuid.UUID, note string) bool {
+	res, err := db.Exec(`UPDATE "access_requests" SET status = $2, decided_by = $3, decided_at = CURRENT_TIMESTAMP,
+			decision_note = NULLIF($4, ''), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = $5`, id, status, decidedBy, note, models.AccessRequestPending)
+	if err != nil {
+		writeErrorResponse(w, "Failed to update access request: "+err.Error(), http.StatusInternalServerError, r)
+		return false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeErrorResponse(w, "Access request was decided concurrently", http.StatusConflict, r)
+		return false
+	}
+	return true
+}
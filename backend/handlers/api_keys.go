@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"pillow/auth"
+	"pillow/config"
+	"pillow/middleware"
+	"pillow/models"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// CreateAPIKeyRequest represents the request payload for creating a personal access token
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateAPIKeyResponse carries the new key. The plaintext key is only ever returned here.
+type CreateAPIKeyResponse struct {
+	APIKey models.APIKey `json:"api_key"`
+	Key    string        `json:"key"`
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at`
+
+// scanAPIKey scans a row selected with apiKeyColumns
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (models.APIKey, error) {
+	var key models.APIKey
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &key.ExpiresAt,
+		&key.LastUsedAt, &key.RevokedAt, &key.CreatedAt)
+	if key.Scopes == nil {
+		key.Scopes = []string{}
+	}
+	return key, err
+}
+
+// GetAPIKeys lists the current user's API keys, including revoked and expired ones
+func GetAPIKeys(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		rows, err := db.Query(`SELECT `+apiKeyColumns+` FROM "api_keys" WHERE user_id = $1 ORDER BY created_at DESC`, user.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer rows.Close()
+
+		keys := []models.APIKey{}
+		for rows.Next() {
+			key, err := scanAPIKey(rows)
+			if err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			keys = append(keys, key)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	}
+}
+
+// CreateAPIKey creates a personal access token for the current user. Scopes must
+// be permissions the user currently holds; without scopes the key acts with all
+// of the user's permissions. Keys always expire: API_KEY_DEFAULT_TTL applies when
+// no expiry is given and API_KEY_MAX_TTL caps it.
+func CreateAPIKey(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var req CreateAPIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			writeErrorResponse(w, "API key name is required", http.StatusBadRequest, r)
+			return
+		}
+
+		now := time.Now()
+		maxTTL := config.Duration("API_KEY_MAX_TTL", 365*24*time.Hour)
+		expiresAt := now.Add(config.Duration("API_KEY_DEFAULT_TTL", 90*24*time.Hour))
+		if req.ExpiresAt != nil {
+			expiresAt = *req.ExpiresAt
+		}
+		if !expiresAt.After(now) {
+			writeErrorResponse(w, "expires_at must be in the future", http.StatusBadRequest, r)
+			return
+		}
+		if expiresAt.After(now.Add(maxTTL)) {
+			writeErrorResponse(w, "expires_at exceeds the maximum API key lifetime of "+maxTTL.String(), http.StatusBadRequest, r)
+			return
+		}
+
+		scopes := []string{}
+		if len(req.Scopes) > 0 {
+			permissions, err := middleware.GetUserPermissions(db, user.ID)
+			if err != nil {
+				writeErrorResponse(w, "Failed to load permissions: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			held := make(map[string]bool, len(permissions))
+			for _, p := range permissions {
+				held[p.Name] = true
+			}
+			seen := make(map[string]bool)
+			for _, scope := range req.Scopes {
+				if !held[scope] {
+					writeErrorResponse(w, "You do not have the permission "+scope, http.StatusBadRequest, r)
+					return
+				}
+				if !seen[scope] {
+					seen[scope] = true
+					scopes = append(scopes, scope)
+				}
+			}
+		}
+
+		rawKey, prefix, err := auth.GenerateAPIKey()
+		if err != nil {
+			writeErrorResponse(w, "Failed to generate API key", http.StatusInternalServerError, r)
+			return
+		}
+
+		key, err := scanAPIKey(db.QueryRow(`INSERT INTO "api_keys" (id, user_id, name, prefix, key_hash, scopes, expires_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP)
+			RETURNING `+apiKeyColumns,
+			uuid.New(), user.ID, req.Name, prefix, auth.HashToken(rawKey), pq.Array(scopes), expiresAt))
+		if err != nil {
+			writeErrorResponse(w, "Failed to create API key: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "API_KEY_CREATED", map[string]interface{}{
+			"api_key_id": key.ID,
+			"name":       key.Name,
+			"prefix":     key.Prefix,
+			"scopes":     key.Scopes,
+			"expires_at": key.ExpiresAt,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(CreateAPIKeyResponse{APIKey: key, Key: rawKey})
+	}
+}
+
+// RevokeAPIKey revokes one of the current user's API keys
+func RevokeAPIKey(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		keyID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid API key ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		key, err := scanAPIKey(db.QueryRow(`UPDATE "api_keys" SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP)
+			WHERE id = $1 AND user_id = $2
+			RETURNING `+apiKeyColumns, keyID, user.ID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "API key not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, "Failed to revoke API key: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "API_KEY_REVOKED", map[string]interface{}{
+			"api_key_id": key.ID,
+			"name":       key.Name,
+			"prefix":     key.Prefix,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(key)
+	}
+}
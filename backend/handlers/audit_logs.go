@@ -36,7 +36,9 @@ func GetAuditLogs(db *sql.DB) http.HandlerFunc {
 		offset := (page - 1) * limit
 
 		// Query audit logs with pagination
-		query := `SELECT id, user_id, action, details, timestamp FROM "audit_log" ORDER BY timestamp DESC LIMIT $1 OFFSET $2`
+		query := `SELECT a.id, a.user_id, u.principal_type, a.impersonator_id, a.action, a.details, a.timestamp
+			FROM "audit_log" a LEFT JOIN "users" u ON u.id = a.user_id
+			ORDER BY a.timestamp DESC LIMIT $1 OFFSET $2`
 		rows, err := db.Query(query, limit, offset)
 		if err != nil {
 			logrus.WithError(err).Error("Failed to query audit logs")
@@ -48,7 +50,7 @@ func GetAuditLogs(db *sql.DB) http.HandlerFunc {
 		var auditLogs []models.AuditLog
 		for rows.Next() {
 			var log models.AuditLog
-			err := rows.Scan(&log.ID, &log.UserID, &log.Action, &log.Details, &log.Timestamp)
+			err := rows.Scan(&log.ID, &log.UserID, &log.ActorType, &log.ImpersonatorID, &log.Action, &log.Details, &log.Timestamp)
 			if err != nil {
 				logrus.WithError(err).Error("Failed to scan audit log")
 				continue
@@ -98,8 +100,9 @@ func GetAuditLog(db *sql.DB) http.HandlerFunc {
 		}
 
 		var log models.AuditLog
-		query := `SELECT id, user_id, action, details, timestamp FROM "audit_log" WHERE id = $1`
-		err := db.QueryRow(query, id).Scan(&log.ID, &log.UserID, &log.Action, &log.Details, &log.Timestamp)
+		query := `SELECT a.id, a.user_id, u.principal_type, a.impersonator_id, a.action, a.details, a.timestamp
+			FROM "audit_log" a LEFT JOIN "users" u ON u.id = a.user_id WHERE a.id = $1`
+		err := db.QueryRow(query, id).Scan(&log.ID, &log.UserID, &log.ActorType, &log.ImpersonatorID, &log.Action, &log.Details, &log.Timestamp)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				http.Error(w, "Audit log not found", http.StatusNotFound)
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"pillow/middleware"
+	"pillow/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// MyPermissions lists what the current user may do according to their roles:
+// permissions held everywhere, and permissions held in an organization (and its
+// sub-organizations) by organization ID. Policies can still allow or deny
+// individual requests.
+type MyPermissions struct {
+	Permissions   []string            `json:"permissions"`
+	Organizations map[string][]string `json:"organizations"`
+}
+
+// GetUserEffectivePermissions lists each permission a user holds with the role
+// and scope granting it. Users may list their own; other users' permissions
+// require view_roles.
+func GetUserEffectivePermissions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid user ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		if actor, _ := middleware.GetUserFromContext(r.Context()); actor == nil || actor.ID != userID {
+			allowed, err := middleware.CheckPermission(db, r, "view_roles", nil)
+			if err != nil {
+				writeErrorResponse(w, "Error checking permissions", http.StatusInternalServerError, r)
+				return
+			}
+			if !allowed {
+				writeErrorResponse(w, "Insufficient permissions", http.StatusForbidden, r)
+				return
+			}
+		}
+
+		exists, err := userExists(db, userID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "User not found", http.StatusNotFound, r)
+			return
+		}
+
+		permissions, err := middleware.EffectivePermissions(db, userID, "")
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"user_id":     userID,
+			"permissions": permissions,
+		})
+	}
+}
+
+// GetMyPermissions returns the permissions of the current user so the frontend
+// can hide controls they cannot use. With an API key only its scopes are listed.
+// Permissions a role explicitly denies are left out where the deny applies.
+func GetMyPermissions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		effective, err := middleware.EffectivePermissions(db, user.ID, "")
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		apiKey, isAPIKey := middleware.GetAPIKeyFromContext(r.Context())
+
+		result := MyPermissions{Permissions: []string{}, Organizations: map[string][]string{}}
+		for _, p := range effective {
+			if isAPIKey && !apiKey.AllowsPermission(p.Name) {
+				continue
+			}
+			deniedOrgs := []uuid.UUID{}
+			deniedEverywhere := false
+			for _, d := range p.DeniedBy {
+				if d.OrgID == nil {
+					deniedEverywhere = true
+				} else {
+					deniedOrgs = append(deniedOrgs, *d.OrgID)
+				}
+			}
+			if deniedEverywhere {
+				continue
+			}
+
+			global := false
+			orgs := map[uuid.UUID]bool{}
+			for _, g := range p.GrantedBy {
+				if g.OrgID == nil {
+					global = true
+				} else if p.ScopeLevel != models.PermissionScopeSystem {
+					orgs[*g.OrgID] = true
+				}
+			}
+			if global {
+				// A global grant covers every organization; denies within an
+				// organization are exceptions the listing does not show
+				result.Permissions = append(result.Permissions, p.Name)
+				continue
+			}
+			for orgID := range orgs {
+				if len(deniedOrgs) > 0 {
+					chain, err := middleware.OrgChain(db, orgID)
+					if err != nil {
+						writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+						return
+					}
+					if orgsOverlap(chain, deniedOrgs) {
+						continue
+					}
+				}
+				result.Organizations[orgID.String()] = append(result.Organizations[orgID.String()], p.Name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// orgsOverlap reports whether a and b have an organization in common
+func orgsOverlap(a, b []uuid.UUID) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ExplainAuthorization shows how a permission check for a user is decided:
+// GET /authz/explain?user=<id>&permission=<name>[&org=<id>]. Policies are
+// evaluated with the context of the explain request itself.
+func ExplainAuthorization(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		userID, err := uuid.Parse(query.Get("user"))
+		if err != nil {
+			writeErrorResponse(w, "user must be a user ID", http.StatusBadRequest, r)
+			return
+		}
+		permission := query.Get("permission")
+		if permission == "" {
+			writeErrorResponse(w, "permission is required", http.StatusBadRequest, r)
+			return
+		}
+		var orgID *uuid.UUID
+		if v := query.Get("org"); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil {
+				writeErrorResponse(w, "Invalid organization ID format", http.StatusBadRequest, r)
+				return
+			}
+			orgID = &id
+		}
+
+		exists, err := userExists(db, userID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "User not found", http.StatusNotFound, r)
+			return
+		}
+
+		explanation, err := middleware.Explain(db, r, userID, permission, orgID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(explanation)
+	}
+}
@@ -3,6 +3,9 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+	"os"
+	"pillow/middleware"
+	"strings"
 	"time"
 )
 
@@ -30,3 +33,39 @@ func writeErrorResponse(w http.ResponseWriter, message string, code int, r *http
 
 	json.NewEncoder(w).Encode(errorResp)
 }
+
+// frontendURL returns the base URL of the web frontend used to build links in emails
+func frontendURL() string {
+	if v := os.Getenv("FRONTEND_URL"); v != "" {
+		return strings.TrimRight(v, "/")
+	}
+	return "http://localhost:3000"
+}
+
+// setAuditHeaders exposes an audit event to AuditMiddlewareMux through the response
+// headers. Request metadata, the acting user and their principal type (user or
+// service_account), the impersonator of an impersonated user and, for requests
+// made with an API key, the key are added under "action".
+func setAuditHeaders(w http.ResponseWriter, r *http.Request, action string, details map[string]interface{}) {
+	meta := map[string]interface{}{
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"actor_id":   nil,
+		"ip_address": r.RemoteAddr,
+	}
+	if user, ok := middleware.GetUserFromContext(r.Context()); ok && user != nil {
+		meta["actor_id"] = user.ID.String()
+		meta["actor_type"] = user.PrincipalType
+		if user.ImpersonatorID != nil {
+			meta["impersonator_id"] = user.ImpersonatorID.String()
+		}
+	}
+	if apiKey, ok := middleware.GetAPIKeyFromContext(r.Context()); ok {
+		meta["api_key_id"] = apiKey.ID.String()
+	}
+	details["action"] = meta
+
+	detBytes, _ := json.Marshal(details)
+	w.Header().Set("X-Audit-Action", action)
+	w.Header().Set("X-Audit-Details", string(detBytes))
+}
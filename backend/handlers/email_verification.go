@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"pillow/audit"
+	"pillow/auth"
+	"pillow/config"
+	"pillow/mail"
+	"pillow/models"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VerifyEmailRequest represents the email verification request payload
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// ResendVerificationRequest represents the resend verification email request payload
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// sendVerificationEmail emails a signed verification link and records when it was sent
+func sendVerificationEmail(db *sql.DB, mailer mail.Mailer, userID uuid.UUID, username, email string) error {
+	ttl := config.Duration("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+	token, err := auth.GenerateEmailVerificationToken(userID, email, ttl)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("UPDATE \"users\" SET verification_sent_at = CURRENT_TIMESTAMP WHERE id = $1", userID); err != nil {
+		return err
+	}
+
+	link := frontendURL() + "/verify-email?token=" + url.QueryEscape(token)
+	return mailer.Send(mail.Message{
+		To:      email,
+		Subject: "Verify your Pillow email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm that this is your email address by opening the link below:\n\n%s\n\nThis link expires in %s.\n",
+			username, link, ttl),
+	})
+}
+
+// VerifyEmail activates a pending account using a signed verification token
+func VerifyEmail(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req VerifyEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+
+		if req.Token == "" {
+			writeErrorResponse(w, "Verification token is required", http.StatusBadRequest, r)
+			return
+		}
+
+		claims, err := auth.ValidateEmailVerificationToken(req.Token)
+		if err != nil {
+			writeErrorResponse(w, "Invalid or expired verification token", http.StatusBadRequest, r)
+			return
+		}
+
+		var user models.User
+		err = db.QueryRow("SELECT id, username, email, status FROM \"users\" WHERE id = $1",
+			claims.UserID).Scan(&user.ID, &user.Username, &user.Email, &user.Status)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Invalid or expired verification token", http.StatusBadRequest, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		// The link is bound to the address it was sent to
+		if !strings.EqualFold(user.Email, claims.Email) {
+			writeErrorResponse(w, "Invalid or expired verification token", http.StatusBadRequest, r)
+			return
+		}
+
+		if user.Status != models.UserStatusPendingVerification {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"message": "Email address already verified",
+			})
+			return
+		}
+
+		_, err = db.Exec("UPDATE \"users\" SET status = $1, email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+			models.UserStatusActive, user.ID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to verify email: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		audit.Record(db, "EMAIL_VERIFIED", &user.ID, map[string]interface{}{
+			"email":      user.Email,
+			"ip_address": r.RemoteAddr,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Email address verified",
+		})
+	}
+}
+
+// ResendVerificationEmail sends a fresh verification link to a pending account.
+// Requests are throttled per account by EMAIL_VERIFICATION_RESEND_INTERVAL.
+func ResendVerificationEmail(db *sql.DB, mailer mail.Mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ResendVerificationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+
+		email := strings.TrimSpace(req.Email)
+		if email == "" {
+			writeErrorResponse(w, "Email is required", http.StatusBadRequest, r)
+			return
+		}
+
+		response := map[string]interface{}{
+			"message": "If a pending account with that email exists, a new verification link has been sent",
+		}
+
+		interval := config.Duration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute)
+
+		var user models.User
+		var throttled bool
+		err := db.QueryRow("SELECT id, username, email, verification_sent_at IS NOT NULL AND verification_sent_at > $2 FROM \"users\" WHERE email = $1 AND status = $3",
+			email, time.Now().Add(-interval), models.UserStatusPendingVerification).Scan(&user.ID, &user.Username, &user.Email, &throttled)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		if throttled {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(interval.Seconds())))
+			writeErrorResponse(w, "Verification email was sent recently; please wait before requesting another", http.StatusTooManyRequests, r)
+			return
+		}
+
+		if err := sendVerificationEmail(db, mailer, user.ID, user.Username, user.Email); err != nil {
+			writeErrorResponse(w, "Failed to send verification email", http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+	}
+}
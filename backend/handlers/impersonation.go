@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"pillow/auth"
+	"pillow/config"
+	"pillow/middleware"
+	"pillow/models"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// impersonationTTL is the lifetime of impersonation tokens (IMPERSONATION_TTL).
+// They cannot be refreshed; a new one has to be requested.
+var impersonationTTL = config.Duration("IMPERSONATION_TTL", 15*time.Minute)
+
+// ImpersonateRequest represents the request payload for impersonating a user
+type ImpersonateRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// ImpersonateResponse is returned when an impersonation token is issued
+type ImpersonateResponse struct {
+	Token        string      `json:"token"`
+	TokenType    string      `json:"token_type"`
+	ExpiresIn    int64       `json:"expires_in"`
+	User         models.User `json:"user"`
+	Impersonator models.User `json:"impersonator"`
+}
+
+// missingPermissions returns the permissions held by targetID that the caller
+// does not hold in the same scope, as CheckPermission decides it, so the
+// caller's denies and deny policies count. A system-scope grant of the caller
+// covers the target's grants of that permission in any organization.
+func missingPermissions(db *sql.DB, r *http.Request, targetID uuid.UUID) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT p.name, ur.org_id FROM "permissions" p
+		INNER JOIN "role_permissions" rp ON p.id = rp.permission_id
+		INNER JOIN "role_ancestry" ra ON rp.role_id = ra.ancestor_id
+		INNER JOIN "active_user_roles" ur ON ra.role_id = ur.role_id
+		WHERE ur.user_id = $1 ORDER BY p.name`, targetID)
+	if err != nil {
+		return nil, err
+	}
+	type grant struct {
+		name  string
+		orgID *uuid.UUID
+	}
+	var grants []grant
+	for rows.Next() {
+		var g grant
+		if err := rows.Scan(&g.name, &g.orgID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	seen := make(map[string]bool)
+	for _, g := range grants {
+		if seen[g.name] {
+			continue
+		}
+		held, err := middleware.CheckPermission(db, r, g.name, g.orgID)
+		if err != nil {
+			return nil, err
+		}
+		if !held {
+			missing = append(missing, g.name)
+			seen[g.name] = true
+		}
+	}
+	return missing, nil
+}
+
+// ImpersonateUser issues a short-lived access token that acts as another user
+// for support and debugging. The token carries the administrator in its "act"
+// claim, so every request made with it is audited with both identities. Users
+// holding any permission the administrator lacks cannot be impersonated, nor
+// can service accounts or deactivated users.
+func ImpersonateUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		targetID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid user ID format", http.StatusBadRequest, r)
+			return
+		}
+		if targetID == actor.ID {
+			writeErrorResponse(w, "You cannot impersonate yourself", http.StatusBadRequest, r)
+			return
+		}
+
+		var req ImpersonateRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+				return
+			}
+		}
+
+		var target models.User
+		err = db.QueryRow(`SELECT id, username, email, is_active, status, principal_type, created_at, updated_at
+			FROM "users" WHERE id = $1`, targetID).Scan(&target.ID, &target.Username, &target.Email, &target.IsActive,
+			&target.Status, &target.PrincipalType, &target.CreatedAt, &target.UpdatedAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "User not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if target.PrincipalType == models.PrincipalTypeServiceAccount {
+			writeErrorResponse(w, "Service accounts cannot be impersonated", http.StatusBadRequest, r)
+			return
+		}
+		if !target.IsActive || target.Status == models.UserStatusPendingVerification {
+			writeErrorResponse(w, "Only active users can be impersonated", http.StatusBadRequest, r)
+			return
+		}
+
+		missing, err := missingPermissions(db, r, target.ID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to compare permissions: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if len(missing) > 0 {
+			writeErrorResponse(w, "Cannot impersonate a user with permissions you do not hold", http.StatusForbidden, r)
+			return
+		}
+
+		token, claims, err := auth.GenerateImpersonationToken(target.ID, target.Username, actor.ID, actor.Username, impersonationTTL)
+		if err != nil {
+			writeErrorResponse(w, "Failed to generate token", http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "IMPERSONATION_STARTED", map[string]interface{}{
+			"user_id":         target.ID,
+			"impersonator_id": actor.ID,
+			"jti":             claims.ID,
+			"reason":          req.Reason,
+			"expires_at":      claims.ExpiresAt.Time,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ImpersonateResponse{
+			Token:        token,
+			TokenType:    "Bearer",
+			ExpiresIn:    int64(impersonationTTL.Seconds()),
+			User:         target,
+			Impersonator: *actor,
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"pillow/audit"
+	"pillow/auth"
+	"pillow/middleware"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// checkLoginThrottle rejects a login attempt with 429 while the account or the
+// client IP is delayed or locked out. It returns false when the request was rejected.
+func checkLoginThrottle(db *sql.DB, w http.ResponseWriter, r *http.Request, userID *uuid.UUID) bool {
+	wait, err := auth.LoginRetryAfter(db, userID, middleware.ClientIP(r))
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+		return false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeErrorResponse(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests, r)
+		return false
+	}
+	return true
+}
+
+// recordLoginFailure counts a failed login attempt and audits it, together with
+// any lockout it triggered. The login routes are public, so events go straight
+// to the audit queue instead of through AuditMiddlewareMux.
+func recordLoginFailure(db *sql.DB, r *http.Request, userID *uuid.UUID, identifier, reason string) {
+	ip := middleware.ClientIP(r)
+	failure, err := auth.RecordLoginFailure(db, userID, ip)
+	if err != nil {
+		log.Printf("Failed to record login failure: %v\n", err)
+		return
+	}
+
+	audit.Record(db, "LOGIN_FAILED", userID, map[string]interface{}{
+		"identifier":       identifier,
+		"reason":           reason,
+		"ip_address":       ip,
+		"user_agent":       r.UserAgent(),
+		"account_failures": failure.AccountFailures,
+		"ip_failures":      failure.IPFailures,
+	})
+
+	if failure.AccountLocked {
+		audit.Record(db, "ACCOUNT_LOCKED", userID, map[string]interface{}{
+			"ip_address":   ip,
+			"locked_until": failure.LockedUntil,
+		})
+	}
+	if failure.IPLocked {
+		audit.Record(db, "IP_LOCKED", nil, map[string]interface{}{
+			"ip_address":   ip,
+			"locked_until": failure.LockedUntil,
+		})
+	}
+}
+
+// UnlockUser lifts a login lockout or delay on an account
+func UnlockUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid user ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM \"users\" WHERE id = $1)", userID).Scan(&exists); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "User not found", http.StatusNotFound, r)
+			return
+		}
+
+		wasLocked, err := auth.UnlockAccount(db, userID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to unlock account", http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "ACCOUNT_UNLOCKED", map[string]interface{}{
+			"user_id":    userID,
+			"was_locked": wasLocked,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":    "Account unlocked",
+			"user_id":    userID,
+			"was_locked": wasLocked,
+		})
+	}
+}
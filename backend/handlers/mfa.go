@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"pillow/audit"
+	"pillow/auth"
+	"pillow/config"
+	"pillow/middleware"
+	"pillow/models"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// recoveryCodeCount is the number of recovery codes issued per set
+const recoveryCodeCount = 10
+
+// MFAChallengeResponse is returned by Login instead of tokens when the user has MFA enabled
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// LoginMFARequest represents the second login step payload. Either Code (TOTP)
+// or RecoveryCode must be set.
+type LoginMFARequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// MFACodeRequest represents a request that must be confirmed with a TOTP or recovery code
+type MFACodeRequest struct {
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// mfaIssuer is the issuer name shown in authenticator apps
+func mfaIssuer() string {
+	if v := os.Getenv("MFA_ISSUER"); v != "" {
+		return v
+	}
+	return "Pillow"
+}
+
+// writeMFAChallenge answers the first login step for a user with MFA enabled
+func writeMFAChallenge(w http.ResponseWriter, r *http.Request, user models.User) {
+	ttl := config.Duration("MFA_CHALLENGE_TTL", 5*time.Minute)
+	token, err := auth.GenerateMFAChallengeToken(user.ID, ttl)
+	if err != nil {
+		writeErrorResponse(w, "Failed to generate MFA challenge", http.StatusInternalServerError, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAChallengeResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int64(ttl.Seconds()),
+	})
+}
+
+// verifyTOTPCode checks code against the user's TOTP secret. When enabledOnly is
+// false the pending (unconfirmed) enrollment is used. A code is accepted at most
+// once: the matched time step is recorded and older or equal steps are rejected.
+func verifyTOTPCode(db *sql.DB, userID uuid.UUID, code string, enabledOnly bool) (bool, error) {
+	var secret string
+	err := db.QueryRow("SELECT secret FROM \"user_mfa\" WHERE user_id = $1 AND enabled = $2",
+		userID, enabledOnly).Scan(&secret)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	step, ok := auth.ValidateTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	res, err := db.Exec("UPDATE \"user_mfa\" SET last_used_step = $1, updated_at = CURRENT_TIMESTAMP WHERE user_id = $2 AND (last_used_step IS NULL OR last_used_step < $1)",
+		step, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// useRecoveryCode consumes one of the user's unused recovery codes
+func useRecoveryCode(db *sql.DB, userID uuid.UUID, code string) (bool, error) {
+	res, err := db.Exec("UPDATE \"mfa_recovery_codes\" SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID, auth.HashToken(auth.NormalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// verifyMFAFactor accepts either a TOTP code or a recovery code for an enabled enrollment.
+// The second return value reports whether a recovery code was consumed.
+func verifyMFAFactor(db *sql.DB, userID uuid.UUID, code, recoveryCode string) (bool, bool, error) {
+	if code != "" {
+		ok, err := verifyTOTPCode(db, userID, code, true)
+		return ok, false, err
+	}
+	if recoveryCode != "" {
+		ok, err := useRecoveryCode(db, userID, recoveryCode)
+		return ok, ok, err
+	}
+	return false, false, nil
+}
+
+// replaceRecoveryCodes invalidates the user's existing recovery codes and issues a new set
+func replaceRecoveryCodes(db *sql.DB, userID uuid.UUID) ([]string, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM \"mfa_recovery_codes\" WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec("INSERT INTO \"mfa_recovery_codes\" (id, user_id, code_hash, created_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)",
+			uuid.New(), userID, auth.HashToken(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// userRequiresMFA reports whether any organization the user belongs to requires MFA
+func userRequiresMFA(db *sql.DB, userID uuid.UUID) (bool, error) {
+	var required bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "user_organizations" uo
+		INNER JOIN "organizations" o ON o.id = uo.org_id
+		WHERE uo.user_id = $1 AND o.require_mfa)`, userID).Scan(&required)
+	return required, err
+}
+
+// setMFAAuditHeaders exposes MFA audit details to AuditMiddlewareMux
+func setMFAAuditHeaders(w http.ResponseWriter, r *http.Request, action string, userID uuid.UUID) {
+	details := map[string]interface{}{
+		"user_id": userID,
+		"action": map[string]interface{}{
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"actor_id":   userID.String(),
+			"ip_address": r.RemoteAddr,
+		},
+	}
+	detBytes, _ := json.Marshal(details)
+	w.Header().Set("X-Audit-Action", action)
+	w.Header().Set("X-Audit-Details", string(detBytes))
+}
+
+// LoginMFA completes a login started by Login for a user with MFA enabled
+func LoginMFA(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LoginMFARequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+
+		if req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+			writeErrorResponse(w, "MFA token and a code or recovery code are required", http.StatusBadRequest, r)
+			return
+		}
+
+		claims, err := auth.ValidateMFAChallengeToken(req.MFAToken)
+		if err != nil {
+			writeErrorResponse(w, "Invalid or expired MFA token", http.StatusUnauthorized, r)
+			return
+		}
+
+		var user models.User
+		err = db.QueryRow("SELECT id, username, email, is_active, status, created_at, updated_at FROM \"users\" WHERE id = $1",
+			claims.UserID).Scan(&user.ID, &user.Username, &user.Email, &user.IsActive, &user.Status, &user.CreatedAt, &user.UpdatedAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Invalid or expired MFA token", http.StatusUnauthorized, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		if !user.IsActive {
+			writeErrorResponse(w, "Account is deactivated", http.StatusUnauthorized, r)
+			return
+		}
+
+		// Wrong codes count towards the same lockout as wrong passwords
+		if !checkLoginThrottle(db, w, r, &user.ID) {
+			return
+		}
+
+		ok, usedRecovery, err := verifyMFAFactor(db, user.ID, req.Code, req.RecoveryCode)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !ok {
+			recordLoginFailure(db, r, &user.ID, user.Username, "invalid_mfa_code")
+			writeErrorResponse(w, "Invalid MFA code", http.StatusUnauthorized, r)
+			return
+		}
+
+		if usedRecovery {
+			audit.Record(db, "MFA_RECOVERY_CODE_USED", &user.ID, map[string]interface{}{
+				"ip_address": r.RemoteAddr,
+				"user_agent": r.UserAgent(),
+			})
+		}
+
+		writeLoginResponse(db, w, r, user)
+	}
+}
+
+// GetMFAStatus returns the current user's MFA enrollment state
+func GetMFAStatus(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var enabled bool
+		var confirmedAt *time.Time
+		err := db.QueryRow("SELECT enabled, confirmed_at FROM \"user_mfa\" WHERE user_id = $1", user.ID).Scan(&enabled, &confirmedAt)
+		if err != nil && err != sql.ErrNoRows {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		var remaining int
+		err = db.QueryRow("SELECT COUNT(*) FROM \"mfa_recovery_codes\" WHERE user_id = $1 AND used_at IS NULL", user.ID).Scan(&remaining)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		required, err := userRequiresMFA(db, user.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"enabled":                  enabled,
+			"confirmed_at":             confirmedAt,
+			"required":                 required,
+			"recovery_codes_remaining": remaining,
+		})
+	}
+}
+
+// EnrollTOTP starts (or restarts) TOTP enrollment and returns the secret and otpauth URI.
+// The enrollment only takes effect once confirmed with ConfirmTOTP.
+func EnrollTOTP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var enabled bool
+		err := db.QueryRow("SELECT enabled FROM \"user_mfa\" WHERE user_id = $1", user.ID).Scan(&enabled)
+		if err != nil && err != sql.ErrNoRows {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if enabled {
+			writeErrorResponse(w, "MFA is already enabled; disable it before enrolling again", http.StatusConflict, r)
+			return
+		}
+
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			writeErrorResponse(w, "Failed to generate secret", http.StatusInternalServerError, r)
+			return
+		}
+
+		_, err = db.Exec(`INSERT INTO "user_mfa" (user_id, secret, enabled, created_at, updated_at) VALUES ($1, $2, false, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, enabled = false, confirmed_at = NULL, last_used_step = NULL, updated_at = CURRENT_TIMESTAMP`,
+			user.ID, secret)
+		if err != nil {
+			writeErrorResponse(w, "Failed to start enrollment: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setMFAAuditHeaders(w, r, "MFA_ENROLLMENT_STARTED", user.ID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"secret":      secret,
+			"otpauth_uri": auth.TOTPProvisioningURI(mfaIssuer(), user.Email, secret),
+		})
+	}
+}
+
+// ConfirmTOTP enables MFA after the user proves the authenticator is set up, and
+// returns a fresh set of recovery codes. The codes are only shown once.
+func ConfirmTOTP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var req MFACodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+		if req.Code == "" {
+			writeErrorResponse(w, "Code is required", http.StatusBadRequest, r)
+			return
+		}
+
+		valid, err := verifyTOTPCode(db, user.ID, req.Code, false)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !valid {
+			writeErrorResponse(w, "Invalid code or no pending enrollment", http.StatusBadRequest, r)
+			return
+		}
+
+		_, err = db.Exec("UPDATE \"user_mfa\" SET enabled = true, confirmed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE user_id = $1", user.ID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to enable MFA: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		codes, err := replaceRecoveryCodes(db, user.ID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to generate recovery codes: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setMFAAuditHeaders(w, r, "MFA_ENABLED", user.ID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":        "MFA enabled",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+// DisableTOTP turns MFA off for the current user. It requires a valid TOTP or
+// recovery code and is refused while one of the user's organizations requires MFA.
+func DisableTOTP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var req MFACodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+
+		required, err := userRequiresMFA(db, user.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if required {
+			writeErrorResponse(w, "MFA is required by your organization and cannot be disabled", http.StatusConflict, r)
+			return
+		}
+
+		valid, _, err := verifyMFAFactor(db, user.ID, req.Code, req.RecoveryCode)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !valid {
+			writeErrorResponse(w, "Invalid MFA code", http.StatusBadRequest, r)
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM \"user_mfa\" WHERE user_id = $1", user.ID); err != nil {
+			writeErrorResponse(w, "Failed to disable MFA: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM \"mfa_recovery_codes\" WHERE user_id = $1", user.ID); err != nil {
+			writeErrorResponse(w, "Failed to remove recovery codes: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setMFAAuditHeaders(w, r, "MFA_DISABLED", user.ID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "MFA disabled",
+		})
+	}
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes after
+// confirming a valid TOTP code
+func RegenerateRecoveryCodes(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var req MFACodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+		if req.Code == "" {
+			writeErrorResponse(w, "Code is required", http.StatusBadRequest, r)
+			return
+		}
+
+		valid, err := verifyTOTPCode(db, user.ID, req.Code, true)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !valid {
+			writeErrorResponse(w, "Invalid MFA code", http.StatusBadRequest, r)
+			return
+		}
+
+		codes, err := replaceRecoveryCodes(db, user.ID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to generate recovery codes: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setMFAAuditHeaders(w, r, "MFA_RECOVERY_CODES_REGENERATED", user.ID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"recovery_codes": codes,
+		})
+	}
+}
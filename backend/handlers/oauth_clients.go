@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"pillow/auth"
+	"pillow/models"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// CreateOAuthClientRequest represents the request payload for registering a client application
+type CreateOAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Confidential bool     `json:"confidential"`
+}
+
+// UpdateOAuthClientRequest represents the request payload for updating a client application
+type UpdateOAuthClientRequest struct {
+	Name         string   `json:"name,omitempty"`
+	RedirectURIs []string `json:"redirect_uris,omitempty"`
+}
+
+const oauthClientColumns = `id, name, secret_hash, redirect_uris, created_at, updated_at`
+
+// scanOAuthClient scans a row selected with oauthClientColumns
+func scanOAuthClient(row interface{ Scan(...interface{}) error }) (models.OAuthClient, error) {
+	var client models.OAuthClient
+	err := row.Scan(&client.ID, &client.Name, &client.SecretHash, pq.Array(&client.RedirectURIs), &client.CreatedAt, &client.UpdatedAt)
+	client.Confidential = client.SecretHash != nil
+	return client, err
+}
+
+// loadOAuthClient loads a registered client by ID
+func loadOAuthClient(db *sql.DB, id uuid.UUID) (models.OAuthClient, error) {
+	return scanOAuthClient(db.QueryRow(`SELECT `+oauthClientColumns+` FROM "oauth_clients" WHERE id = $1`, id))
+}
+
+// validateRedirectURIs checks that every redirect URI is absolute and has no
+// fragment. Plain http is only accepted for loopback addresses (local development
+// and native apps).
+func validateRedirectURIs(uris []string) string {
+	if len(uris) == 0 {
+		return "At least one redirect URI is required"
+	}
+	for _, raw := range uris {
+		u, err := url.Parse(raw)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return "Invalid redirect URI: " + raw
+		}
+		if u.Fragment != "" {
+			return "Redirect URIs must not contain a fragment: " + raw
+		}
+		switch u.Scheme {
+		case "https":
+		case "http":
+			host := u.Hostname()
+			if host != "localhost" && host != "127.0.0.1" && host != "::1" {
+				return "Redirect URIs must use https: " + raw
+			}
+		default:
+			return "Unsupported redirect URI scheme: " + raw
+		}
+	}
+	return ""
+}
+
+// GetOAuthClients lists all registered client applications
+func GetOAuthClients(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`SELECT ` + oauthClientColumns + ` FROM "oauth_clients" ORDER BY name`)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer rows.Close()
+
+		clients := []models.OAuthClient{}
+		for rows.Next() {
+			client, err := scanOAuthClient(rows)
+			if err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			clients = append(clients, client)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clients)
+	}
+}
+
+// GetOAuthClient retrieves a single client application
+func GetOAuthClient(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid client ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		client, err := loadOAuthClient(db, clientID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Client not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(client)
+	}
+}
+
+// CreateOAuthClient registers a client application. Confidential clients get a
+// secret that is returned once and only stored hashed.
+func CreateOAuthClient(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreateOAuthClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			writeErrorResponse(w, "Client name is required", http.StatusBadRequest, r)
+			return
+		}
+		if msg := validateRedirectURIs(req.RedirectURIs); msg != "" {
+			writeErrorResponse(w, msg, http.StatusBadRequest, r)
+			return
+		}
+
+		var secret string
+		var secretHash *string
+		if req.Confidential {
+			var err error
+			secret, err = auth.GenerateOpaqueToken()
+			if err != nil {
+				writeErrorResponse(w, "Failed to generate client secret", http.StatusInternalServerError, r)
+				return
+			}
+			hash := auth.HashToken(secret)
+			secretHash = &hash
+		}
+
+		client, err := scanOAuthClient(db.QueryRow(`INSERT INTO "oauth_clients" (id, name, secret_hash, redirect_uris, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP) RETURNING `+oauthClientColumns,
+			uuid.New(), req.Name, secretHash, pq.Array(req.RedirectURIs)))
+		if err != nil {
+			writeErrorResponse(w, "Failed to create client: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "OAUTH_CLIENT_CREATED", map[string]interface{}{"client_after": client, "client_before": nil})
+
+		response := map[string]interface{}{
+			"message": "Client created successfully",
+			"client":  client,
+		}
+		if secret != "" {
+			response["client_secret"] = secret
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// UpdateOAuthClient updates a client's name or redirect URIs
+func UpdateOAuthClient(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid client ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		var req UpdateOAuthClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+
+		existing, err := loadOAuthClient(db, clientID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Client not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		name := existing.Name
+		if strings.TrimSpace(req.Name) != "" {
+			name = strings.TrimSpace(req.Name)
+		}
+		redirectURIs := existing.RedirectURIs
+		if req.RedirectURIs != nil {
+			if msg := validateRedirectURIs(req.RedirectURIs); msg != "" {
+				writeErrorResponse(w, msg, http.StatusBadRequest, r)
+				return
+			}
+			redirectURIs = req.RedirectURIs
+		}
+
+		client, err := scanOAuthClient(db.QueryRow(`UPDATE "oauth_clients" SET name = $1, redirect_uris = $2, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $3 RETURNING `+oauthClientColumns, name, pq.Array(redirectURIs), clientID))
+		if err != nil {
+			writeErrorResponse(w, "Failed to update client: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "OAUTH_CLIENT_UPDATED", map[string]interface{}{"client_after": client, "client_before": existing})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Client updated successfully",
+			"client":  client,
+		})
+	}
+}
+
+// RotateOAuthClientSecret issues a new secret for a client, replacing the old one.
+// Calling it on a public client turns it into a confidential one.
+func RotateOAuthClientSecret(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid client ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		secret, err := auth.GenerateOpaqueToken()
+		if err != nil {
+			writeErrorResponse(w, "Failed to generate client secret", http.StatusInternalServerError, r)
+			return
+		}
+
+		client, err := scanOAuthClient(db.QueryRow(`UPDATE "oauth_clients" SET secret_hash = $1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $2 RETURNING `+oauthClientColumns, auth.HashToken(secret), clientID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Client not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, "Failed to rotate client secret: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "OAUTH_CLIENT_SECRET_ROTATED", map[string]interface{}{"client_id": client.ID})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":       "Client secret rotated successfully",
+			"client":        client,
+			"client_secret": secret,
+		})
+	}
+}
+
+// DeleteOAuthClient removes a client application together with its pending authorization codes
+func DeleteOAuthClient(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid client ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		client, err := loadOAuthClient(db, clientID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Client not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		if _, err := db.Exec(`DELETE FROM "oauth_clients" WHERE id = $1`, clientID); err != nil {
+			writeErrorResponse(w, "Failed to delete client: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "OAUTH_CLIENT_DELETED", map[string]interface{}{"client": client})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":   "Client deleted successfully",
+			"client_id": clientID,
+		})
+	}
+}
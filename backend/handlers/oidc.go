@@ -0,0 +1,540 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"pillow/audit"
+	"pillow/auth"
+	"pillow/config"
+	"pillow/middleware"
+	"pillow/models"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errOIDCProviderDisabled explains why the authorization code flow is unavailable
+const errOIDCProviderDisabled = "The OpenID provider is disabled; it requires JWT_SIGNING_ALG RS256 or EdDSA"
+
+// oauthError is an OAuth 2.0 error (RFC 6749 section 4.1.2.1 and 5.2)
+type oauthError struct {
+	Code        string
+	Description string
+}
+
+// authorizationRequest is a validated /authorize request
+type authorizationRequest struct {
+	Client        models.OAuthClient
+	RedirectURI   string
+	Scope         string
+	State         string
+	Nonce         string
+	CodeChallenge string
+	Prompt        string
+}
+
+// TokenResponse represents a successful response of the token endpoint
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// parseAuthorizationRequest validates the parameters of an authorization request.
+// When the client or redirect URI is invalid the returned request is nil and the
+// error must be shown to the user; any other error is reported back to the
+// client by redirecting to its redirect URI.
+func parseAuthorizationRequest(db *sql.DB, params url.Values) (*authorizationRequest, *oauthError) {
+	if !auth.OIDCProviderEnabled() {
+		return nil, &oauthError{"server_error", errOIDCProviderDisabled}
+	}
+	clientID, err := uuid.Parse(params.Get("client_id"))
+	if err != nil {
+		return nil, &oauthError{"invalid_request", "Missing or invalid client_id"}
+	}
+	client, err := loadOAuthClient(db, clientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &oauthError{"invalid_client", "Unknown client"}
+		}
+		return nil, &oauthError{"server_error", "Failed to load client"}
+	}
+
+	// The redirect URI must match a registered one exactly. It may only be omitted
+	// when the client has exactly one.
+	redirectURI := params.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	registered := false
+	for _, uri := range client.RedirectURIs {
+		if uri == redirectURI {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return nil, &oauthError{"invalid_request", "redirect_uri is not registered for this client"}
+	}
+
+	req := &authorizationRequest{
+		Client:        client,
+		RedirectURI:   redirectURI,
+		State:         params.Get("state"),
+		Nonce:         params.Get("nonce"),
+		CodeChallenge: params.Get("code_challenge"),
+		Prompt:        params.Get("prompt"),
+	}
+
+	if params.Get("response_type") != "code" {
+		return req, &oauthError{"unsupported_response_type", "Only the authorization code flow is supported"}
+	}
+
+	// Unknown scopes are dropped rather than rejected
+	var scopes []string
+	for _, s := range strings.Fields(params.Get("scope")) {
+		for _, supported := range auth.SupportedScopes {
+			if s == supported && !auth.HasScope(strings.Join(scopes, " "), s) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	req.Scope = strings.Join(scopes, " ")
+	if !auth.HasScope(req.Scope, auth.ScopeOpenID) {
+		return req, &oauthError{"invalid_scope", "The openid scope is required"}
+	}
+
+	if req.CodeChallenge == "" {
+		return req, &oauthError{"invalid_request", "PKCE code_challenge is required"}
+	}
+	if method := params.Get("code_challenge_method"); method != "S256" {
+		return req, &oauthError{"invalid_request", "code_challenge_method must be S256"}
+	}
+
+	return req, nil
+}
+
+// redirect builds the URL the user agent is sent back to, carrying either the
+// authorization code or an error
+func (req *authorizationRequest) redirect(values url.Values) string {
+	u, _ := url.Parse(req.RedirectURI)
+	q := u.Query()
+	for k, v := range values {
+		q[k] = v
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// errorRedirect returns the redirect URL reporting oerr to the client
+func (req *authorizationRequest) errorRedirect(oerr *oauthError) string {
+	return req.redirect(url.Values{"error": {oerr.Code}, "error_description": {oerr.Description}})
+}
+
+// issueAuthorizationCode stores a new single-use code for an approved request
+// and returns the URL to redirect the user agent to
+func issueAuthorizationCode(db *sql.DB, r *http.Request, req *authorizationRequest, userID uuid.UUID) (string, error) {
+	code, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	ttl := config.Duration("OIDC_AUTH_CODE_TTL", time.Minute)
+	_, err = db.Exec(`INSERT INTO "oauth_authorization_codes"
+		(code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP)`,
+		auth.HashToken(code), req.Client.ID, userID, req.RedirectURI, req.Scope, req.Nonce, req.CodeChallenge, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	audit.Record(db, "OIDC_AUTHORIZATION_GRANTED", &userID, map[string]interface{}{
+		"client_id":  req.Client.ID,
+		"scope":      req.Scope,
+		"ip_address": r.RemoteAddr,
+	})
+
+	return req.redirect(url.Values{"code": {code}}), nil
+}
+
+// Authorize is the OIDC authorization endpoint. Requests carrying a valid access
+// token are approved straight away. Otherwise the user is sent to the frontend,
+// which signs them in and completes the request through ApproveAuthorization.
+func Authorize(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, oerr := parseAuthorizationRequest(db, r.URL.Query())
+		if req == nil {
+			writeErrorResponse(w, oerr.Description, http.StatusBadRequest, r)
+			return
+		}
+		if oerr != nil {
+			http.Redirect(w, r, req.errorRedirect(oerr), http.StatusFound)
+			return
+		}
+
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			if req.Prompt == "none" {
+				http.Redirect(w, r, req.errorRedirect(&oauthError{"login_required", "The user is not signed in"}), http.StatusFound)
+				return
+			}
+			http.Redirect(w, r, frontendURL()+"/oauth/authorize?"+r.URL.RawQuery, http.StatusFound)
+			return
+		}
+
+		location, err := issueAuthorizationCode(db, r, req, user.ID)
+		if err != nil {
+			http.Redirect(w, r, req.errorRedirect(&oauthError{"server_error", "Failed to issue authorization code"}), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, location, http.StatusFound)
+	}
+}
+
+// ApproveAuthorization completes an authorization request for the signed-in user.
+// It takes the original /authorize query parameters as a JSON object and returns
+// the URL the frontend should navigate to.
+func ApproveAuthorization(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+		params := url.Values{}
+		for k, v := range body {
+			params.Set(k, v)
+		}
+
+		req, oerr := parseAuthorizationRequest(db, params)
+		if req == nil {
+			writeErrorResponse(w, oerr.Description, http.StatusBadRequest, r)
+			return
+		}
+
+		location := ""
+		if oerr != nil {
+			location = req.errorRedirect(oerr)
+		} else {
+			var err error
+			location, err = issueAuthorizationCode(db, r, req, user.ID)
+			if err != nil {
+				writeErrorResponse(w, "Failed to issue authorization code", http.StatusInternalServerError, r)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"redirect_to": location})
+	}
+}
+
+// writeOAuthError sends an error response from the token endpoint
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pillow"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// clientCredentials returns the client ID and secret of a token request, sent
+// either with HTTP Basic authentication or in the form body
+func clientCredentials(r *http.Request) (id, secret string) {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		return id, secret
+	}
+	return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+}
+
+// authenticateOAuthClient identifies the client calling the token endpoint, using
+// HTTP Basic credentials or client_id/client_secret form fields. Public clients
+// only send their client_id.
+func authenticateOAuthClient(db *sql.DB, r *http.Request) (*models.OAuthClient, bool) {
+	id, secret := clientCredentials(r)
+
+	clientID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, false
+	}
+	client, err := loadOAuthClient(db, clientID)
+	if err != nil {
+		return nil, false
+	}
+
+	if client.SecretHash == nil {
+		return &client, secret == ""
+	}
+	if secret == "" || subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(*client.SecretHash)) != 1 {
+		return nil, false
+	}
+	return &client, true
+}
+
+// Token is the OAuth2/OIDC token endpoint. It exchanges an authorization code
+// and its PKCE verifier for an access token and an ID token, and issues access
+// tokens to service accounts through the client_credentials grant.
+func Token(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed request body")
+			return
+		}
+
+		// Service accounts are their own clients and authenticate against "service_accounts"
+		if r.PostForm.Get("grant_type") == "client_credentials" {
+			exchangeClientCredentials(db, w, r)
+			return
+		}
+
+		client, ok := authenticateOAuthClient(db, r)
+		if !ok {
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+			return
+		}
+
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			if !auth.OIDCProviderEnabled() {
+				writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", errOIDCProviderDisabled)
+				return
+			}
+			exchangeAuthorizationCode(db, w, r, client)
+		default:
+			writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type")
+		}
+	}
+}
+
+// exchangeAuthorizationCode implements the authorization_code grant
+func exchangeAuthorizationCode(db *sql.DB, w http.ResponseWriter, r *http.Request, client *models.OAuthClient) {
+	code := r.PostForm.Get("code")
+	verifier := r.PostForm.Get("code_verifier")
+	if code == "" || verifier == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "code and code_verifier are required")
+		return
+	}
+
+	authCode, err := consumeAuthorizationCode(db, code)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+			return
+		}
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to redeem authorization code")
+		return
+	}
+	if authCode.UsedAt != nil {
+		// A code presented twice may have been intercepted: revoke what the first redemption issued.
+		if authCode.SessionID != nil {
+			auth.RevokeSessionFamily(db, *authCode.SessionID)
+		}
+		audit.Record(db, "OIDC_AUTHORIZATION_CODE_REUSED", &authCode.UserID, map[string]interface{}{
+			"client_id":  client.ID,
+			"ip_address": r.RemoteAddr,
+		})
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+		return
+	}
+
+	if authCode.ClientID != client.ID || time.Now().After(authCode.ExpiresAt) ||
+		r.PostForm.Get("redirect_uri") != authCode.RedirectURI || !auth.VerifyPKCE(verifier, authCode.CodeChallenge) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+		return
+	}
+
+	var user models.User
+	err = db.QueryRow(`SELECT id, username, is_active, status FROM "users" WHERE id = $1`, authCode.UserID).
+		Scan(&user.ID, &user.Username, &user.IsActive, &user.Status)
+	if err != nil || !user.IsActive || user.Status != models.UserStatusActive {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The user can no longer sign in")
+		return
+	}
+
+	session, _, err := auth.CreateSession(db, user.ID, r.UserAgent(), middleware.ClientIP(r))
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to create session")
+		return
+	}
+	db.Exec(`UPDATE "oauth_authorization_codes" SET session_id = $1 WHERE code_hash = $2`, session.FamilyID, authCode.CodeHash)
+
+	accessToken, err := auth.GenerateClientAccessToken(user.ID, user.Username, session.FamilyID, client.ID.String(), authCode.Scope)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to generate token")
+		return
+	}
+
+	claims, err := loadOIDCClaims(db, user.ID, authCode.Scope)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to load user claims")
+		return
+	}
+	claims.Nonce = authCode.Nonce
+	idToken, err := auth.GenerateIDToken(user.ID, client.ID.String(), claims)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to generate ID token")
+		return
+	}
+
+	audit.Record(db, "OIDC_TOKEN_ISSUED", &user.ID, map[string]interface{}{
+		"client_id":  client.ID,
+		"scope":      authCode.Scope,
+		"session_id": session.FamilyID,
+		"ip_address": r.RemoteAddr,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(auth.AccessTokenTTL().Seconds()),
+		IDToken:     idToken,
+		Scope:       authCode.Scope,
+	})
+}
+
+// consumeAuthorizationCode marks a code as used and returns it as it was before,
+// so a non-nil UsedAt means the code had already been redeemed
+func consumeAuthorizationCode(db *sql.DB, code string) (*models.OAuthAuthorizationCode, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var c models.OAuthAuthorizationCode
+	err = tx.QueryRow(`SELECT code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, expires_at, used_at, session_id
+		FROM "oauth_authorization_codes" WHERE code_hash = $1 FOR UPDATE`, auth.HashToken(code)).
+		Scan(&c.CodeHash, &c.ClientID, &c.UserID, &c.RedirectURI, &c.Scope, &c.Nonce, &c.CodeChallenge, &c.ExpiresAt, &c.UsedAt, &c.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.UsedAt == nil {
+		if _, err := tx.Exec(`UPDATE "oauth_authorization_codes" SET used_at = CURRENT_TIMESTAMP WHERE code_hash = $1`, c.CodeHash); err != nil {
+			return nil, err
+		}
+	}
+
+	return &c, tx.Commit()
+}
+
+// loadOIDCClaims collects the user claims released for the granted scopes.
+// Roles come from the current assignments in user_roles and memberships from
+// user_organizations.
+func loadOIDCClaims(db *sql.DB, userID uuid.UUID, scope string) (*auth.IDTokenClaims, error) {
+	claims := &auth.IDTokenClaims{}
+
+	var username, email string
+	var emailVerifiedAt *time.Time
+	err := db.QueryRow(`SELECT username, COALESCE(email, ''), email_verified_at FROM "users" WHERE id = $1`, userID).
+		Scan(&username, &email, &emailVerifiedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.HasScope(scope, auth.ScopeProfile) {
+		claims.PreferredUsername = username
+	}
+	if auth.HasScope(scope, auth.ScopeEmail) {
+		verified := emailVerifiedAt != nil
+		claims.Email = email
+		claims.EmailVerified = &verified
+	}
+
+	if auth.HasScope(scope, auth.ScopeRoles) {
+		rows, err := db.Query(`SELECT DISTINCT r.name FROM "roles" r
+			INNER JOIN "active_user_roles" ur ON ur.role_id = r.id
+			WHERE ur.user_id = $1 ORDER BY r.name`, userID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		claims.Roles = []string{}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			claims.Roles = append(claims.Roles, name)
+		}
+	}
+
+	if auth.HasScope(scope, auth.ScopeOrganizations) {
+		rows, err := db.Query(`SELECT o.id, o.name, COALESCE(r.name, '') FROM "user_organizations" uo
+			INNER JOIN "organizations" o ON o.id = uo.org_id
+			LEFT JOIN "roles" r ON r.id = uo.role_id
+			WHERE uo.user_id = $1 ORDER BY o.name`, userID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		claims.Organizations = []auth.OrganizationClaim{}
+		for rows.Next() {
+			var org auth.OrganizationClaim
+			if err := rows.Scan(&org.ID, &org.Name, &org.Role); err != nil {
+				return nil, err
+			}
+			claims.Organizations = append(claims.Organizations, org)
+		}
+	}
+
+	return claims, nil
+}
+
+// UserInfo is the OIDC userinfo endpoint. It returns the claims released for the
+// scopes of the presented access token; first-party tokens get the basic profile.
+func UserInfo(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenClaims, ok := middleware.GetClaimsFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "Authentication required", http.StatusUnauthorized, r)
+			return
+		}
+
+		scope := tokenClaims.Scope
+		if tokenClaims.ClientID == "" {
+			scope = strings.Join([]string{auth.ScopeOpenID, auth.ScopeProfile, auth.ScopeEmail}, " ")
+		}
+		if !auth.HasScope(scope, auth.ScopeOpenID) {
+			writeErrorResponse(w, "Token was not issued with the openid scope", http.StatusForbidden, r)
+			return
+		}
+
+		claims, err := loadOIDCClaims(db, tokenClaims.UserID, scope)
+		if err != nil {
+			writeErrorResponse(w, "Failed to load user claims", http.StatusInternalServerError, r)
+			return
+		}
+		claims.Subject = tokenClaims.UserID.String()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(claims)
+	}
+}
@@ -0,0 +1,416 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"pillow/middleware"
+	"pillow/models"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// AddOrganizationMemberRequest represents the request payload for adding a
+// member to an organization. RoleID is the member's role in the organization.
+type AddOrganizationMemberRequest struct {
+	UserID uuid.UUID  `json:"user_id"`
+	RoleID *uuid.UUID `json:"role_id,omitempty"`
+}
+
+const organizationMemberColumns = `uo.id, uo.user_id, uo.org_id, uo.role_id, uo.invited_by,
+	COALESCE(uo.created_at, CURRENT_TIMESTAMP), COALESCE(uo.updated_at, CURRENT_TIMESTAMP),
+	u.username, COALESCE(u.email, ''), o.name, COALESCE(r.name, '')`
+
+const organizationMemberJoins = `FROM "user_organizations" uo
+	INNER JOIN "users" u ON u.id = uo.user_id
+	INNER JOIN "organizations" o ON o.id = uo.org_id
+	LEFT JOIN "roles" r ON r.id = uo.role_id`
+
+func scanOrganizationMember(row interface{ Scan(...interface{}) error }) (models.OrganizationMember, error) {
+	var m models.OrganizationMember
+	err := row.Scan(&m.ID, &m.UserID, &m.OrgID, &m.RoleID, &m.InvitedBy, &m.CreatedAt, &m.UpdatedAt,
+		&m.Username, &m.Email, &m.OrgName, &m.RoleName)
+	return m, err
+}
+
+// queryOrganizationMembers lists the memberships matching where
+func queryOrganizationMembers(db *sql.DB, where string, args ...interface{}) ([]models.OrganizationMember, error) {
+	rows, err := db.Query(`SELECT `+organizationMemberColumns+` `+organizationMemberJoins+` WHERE `+where+`
+		ORDER BY o.name, u.username`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.OrganizationMember{}
+	for rows.Next() {
+		m, err := scanOrganizationMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// GetOrganizationMembers lists the members of an organization with their role in it
+func GetOrganizationMembers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid organization ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		exists, err := organizationExists(db, orgID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "Organization not found", http.StatusNotFound, r)
+			return
+		}
+
+		members, err := queryOrganizationMembers(db, "uo.org_id = $1", orgID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+	}
+}
+
+// AddOrganizationMember adds a user to an organization, or changes the role of
+// an existing member. The member's role is assigned in the organization scope,
+// replacing the assignment the membership made for the previous role; roles
+// granted to the user in the organization otherwise are kept. Handing out or
+// replacing a role requires assign_roles in the organization and every
+// permission of the new role and of the role it replaces. A user who already
+// holds the new role in the organization is refused.
+func AddOrganizationMember(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid organization ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		actor, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var req AddOrganizationMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+		if req.UserID == uuid.Nil {
+			writeErrorResponse(w, "user_id is required", http.StatusBadRequest, r)
+			return
+		}
+		if req.RoleID != nil && *req.RoleID == uuid.Nil {
+			req.RoleID = nil
+		}
+
+		exists, err := organizationExists(db, orgID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "Organization not found", http.StatusNotFound, r)
+			return
+		}
+		if exists, err = userExists(db, req.UserID); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "User not found", http.StatusNotFound, r)
+			return
+		}
+
+		var existing models.UserOrganization
+		err = db.QueryRow(`SELECT id, role_id FROM "user_organizations" WHERE user_id = $1 AND org_id = $2`,
+			req.UserID, orgID).Scan(&existing.ID, &existing.RoleID)
+		isMember := err == nil
+		if err != nil && err != sql.ErrNoRows {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		sameRole := (existing.RoleID == nil && req.RoleID == nil) ||
+			(existing.RoleID != nil && req.RoleID != nil && *existing.RoleID == *req.RoleID)
+		if isMember && sameRole {
+			writeErrorResponse(w, "User is already a member of this organization with this role", http.StatusConflict, r)
+			return
+		}
+
+		var role models.Role
+		if req.RoleID != nil {
+			if role, err = loadRole(db, *req.RoleID); err != nil {
+				if err == sql.ErrNoRows {
+					writeErrorResponse(w, "Role not found", http.StatusNotFound, r)
+					return
+				}
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+		}
+		if req.RoleID != nil || existing.RoleID != nil {
+			if !checkAssignRoles(db, w, r, &orgID) {
+				return
+			}
+		}
+		if req.RoleID != nil {
+			missing, err := missingRolePermissions(db, r, role.ID, &orgID)
+			if err != nil {
+				writeErrorResponse(w, "Failed to compare permissions: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if len(missing) > 0 {
+				writeErrorResponse(w, "Cannot grant a role with permissions you do not hold: "+strings.Join(missing, ", "), http.StatusForbidden, r)
+				return
+			}
+		}
+		if existing.RoleID != nil {
+			missing, err := missingRolePermissions(db, r, *existing.RoleID, &orgID)
+			if err != nil {
+				writeErrorResponse(w, "Failed to compare permissions: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if len(missing) > 0 {
+				writeErrorResponse(w, "Cannot revoke a role with permissions you do not hold: "+strings.Join(missing, ", "), http.StatusForbidden, r)
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := lockedSoDViolations(tx, &req.UserID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to check separation of duties: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		membershipID := existing.ID
+		if isMember {
+			if _, err := tx.Exec(`UPDATE "user_organizations" SET role_id = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`,
+				req.RoleID, existing.ID); err != nil {
+				writeErrorResponse(w, "Failed to update membership: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if _, err := tx.Exec(`DELETE FROM "user_roles" WHERE membership_id = $1`, existing.ID); err != nil {
+				writeErrorResponse(w, "Failed to revoke previous role: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+		} else {
+			membershipID = uuid.New()
+			res, err := tx.Exec(`INSERT INTO "user_organizations" (id, user_id, org_id, role_id, invited_by, created_at, updated_at)
+				VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+				ON CONFLICT (user_id, org_id) DO NOTHING`,
+				membershipID, req.UserID, orgID, req.RoleID, actor.ID)
+			if err != nil {
+				writeErrorResponse(w, "Failed to add member: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				writeErrorResponse(w, "User is already a member of this organization", http.StatusConflict, r)
+				return
+			}
+		}
+		if req.RoleID != nil {
+			inserted, err := insertRoleAssignment(tx, req.UserID, role.ID, models.RoleScopeOrg, &orgID, nil, nil, &membershipID)
+			if err != nil {
+				writeErrorResponse(w, "Failed to grant role: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if !inserted {
+				writeErrorResponse(w, "User already has this role in this organization", http.StatusConflict, r)
+				return
+			}
+		}
+		if !checkSeparationOfDuties(tx, w, r, &req.UserID, before) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		member, err := scanOrganizationMember(db.QueryRow(`SELECT `+organizationMemberColumns+` `+organizationMemberJoins+`
+			WHERE uo.id = $1`, membershipID))
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		status := http.StatusCreated
+		action := "ORG_MEMBER_ADDED"
+		details := map[string]interface{}{
+			"org_id":  orgID,
+			"user_id": req.UserID,
+			"role_id": req.RoleID,
+		}
+		if isMember {
+			status = http.StatusOK
+			action = "ORG_MEMBER_ROLE_CHANGED"
+			details["previous_role_id"] = existing.RoleID
+		}
+		setAuditHeaders(w, r, action, details)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(member)
+	}
+}
+
+// RemoveOrganizationMember removes a user from an organization together with
+// the roles they hold in it, which requires assign_roles in the organization
+// and every permission of those roles when there are any. Service accounts
+// cannot leave the organization that owns them.
+func RemoveOrganizationMember(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		orgID, err := uuid.Parse(vars["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid organization ID format", http.StatusBadRequest, r)
+			return
+		}
+		userID, err := uuid.Parse(vars["userId"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid user ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		var roleID *uuid.UUID
+		var ownedAccount bool
+		var heldRoleIDs []uuid.UUID
+		err = db.QueryRow(`SELECT uo.role_id,
+				EXISTS (SELECT 1 FROM "service_accounts" sa WHERE sa.user_id = uo.user_id AND sa.org_id = uo.org_id),
+				ARRAY(SELECT DISTINCT ur.role_id FROM "user_roles" ur WHERE ur.user_id = uo.user_id AND ur.org_id = uo.org_id)
+			FROM "user_organizations" uo WHERE uo.user_id = $1 AND uo.org_id = $2`,
+			userID, orgID).Scan(&roleID, &ownedAccount, pq.Array(&heldRoleIDs))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "User is not a member of this organization", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if ownedAccount {
+			writeErrorResponse(w, "A service account cannot leave the organization that owns it", http.StatusConflict, r)
+			return
+		}
+		if len(heldRoleIDs) > 0 && !checkAssignRoles(db, w, r, &orgID) {
+			return
+		}
+		for _, heldRoleID := range heldRoleIDs {
+			missing, err := missingRolePermissions(db, r, heldRoleID, &orgID)
+			if err != nil {
+				writeErrorResponse(w, "Failed to compare permissions: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if len(missing) > 0 {
+				writeErrorResponse(w, "Cannot revoke a role with permissions you do not hold: "+strings.Join(missing, ", "), http.StatusForbidden, r)
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer tx.Rollback()
+
+		res, err := tx.Exec(`DELETE FROM "user_roles" WHERE user_id = $1 AND org_id = $2`, userID, orgID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to revoke roles: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		revoked, _ := res.RowsAffected()
+		if _, err := tx.Exec(`DELETE FROM "user_organizations" WHERE user_id = $1 AND org_id = $2`, userID, orgID); err != nil {
+			writeErrorResponse(w, "Failed to remove member: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "ORG_MEMBER_REMOVED", map[string]interface{}{
+			"org_id":        orgID,
+			"user_id":       userID,
+			"role_id":       roleID,
+			"roles_revoked": revoked,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":       "Member removed successfully",
+			"org_id":        orgID,
+			"user_id":       userID,
+			"roles_revoked": revoked,
+		})
+	}
+}
+
+// GetUserOrganizations lists the organizations a user is a member of. Users see
+// all of their own memberships; for other users only the organizations where
+// the caller holds manage_own_organization are listed.
+func GetUserOrganizations(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid user ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		exists, err := userExists(db, userID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "User not found", http.StatusNotFound, r)
+			return
+		}
+
+		memberships, err := queryOrganizationMembers(db, "uo.user_id = $1", userID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		if actor, _ := middleware.GetUserFromContext(r.Context()); actor == nil || actor.ID != userID {
+			visible := []models.OrganizationMember{}
+			for _, m := range memberships {
+				allowed, err := middleware.CheckPermission(db, r, "manage_own_organization", &m.OrgID)
+				if err != nil {
+					writeErrorResponse(w, "Error checking permissions", http.StatusInternalServerError, r)
+					return
+				}
+				if allowed {
+					visible = append(visible, m)
+				}
+			}
+			memberships = visible
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(memberships)
+	}
+}
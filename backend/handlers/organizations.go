@@ -21,6 +21,7 @@ type CreateOrganizationRequest struct {
 	Domain      string `json:"domain,omitempty"`
 	ManagedBy   string `json:"managed_by,omitempty"` // user id
 	ParentOrgID string `json:"parent_org_id,omitempty"`
+	RequireMFA  bool   `json:"require_mfa,omitempty"`
 }
 
 // UpdateOrganizationRequest represents payload to update an organization
@@ -30,12 +31,13 @@ type UpdateOrganizationRequest struct {
 	Domain      string `json:"domain,omitempty"`
 	ManagedBy   string `json:"managed_by,omitempty"`
 	ParentOrgID string `json:"parent_org_id,omitempty"`
+	RequireMFA  *bool  `json:"require_mfa,omitempty"`
 }
 
 // GetOrganizations returns all organizations
 func GetOrganizations(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT id, name, description, domain, managed_by, created_at, updated_at, parent_org_id FROM \"organizations\" ORDER BY name")
+		rows, err := db.Query("SELECT id, name, description, domain, managed_by, created_at, updated_at, parent_org_id, require_mfa FROM \"organizations\" ORDER BY name")
 		if err != nil {
 			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
 			return
@@ -47,7 +49,7 @@ func GetOrganizations(db *sql.DB) http.HandlerFunc {
 			var o models.Organization
 			var managedBy sql.NullString
 			var parentOrg sql.NullString
-			if err := rows.Scan(&o.ID, &o.Name, &o.Description, &o.Domain, &managedBy, &o.CreatedAt, &o.UpdatedAt, &parentOrg); err != nil {
+			if err := rows.Scan(&o.ID, &o.Name, &o.Description, &o.Domain, &managedBy, &o.CreatedAt, &o.UpdatedAt, &parentOrg, &o.RequireMFA); err != nil {
 				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
 				return
 			}
@@ -82,8 +84,8 @@ func GetOrganization(db *sql.DB) http.HandlerFunc {
 		var o models.Organization
 		var managedBy sql.NullString
 		var parentOrg sql.NullString
-		err = db.QueryRow("SELECT id, name, description, domain, managed_by, created_at, updated_at, parent_org_id FROM \"organizations\" WHERE id = $1",
-			orgID).Scan(&o.ID, &o.Name, &o.Description, &o.Domain, &managedBy, &o.CreatedAt, &o.UpdatedAt, &parentOrg)
+		err = db.QueryRow("SELECT id, name, description, domain, managed_by, created_at, updated_at, parent_org_id, require_mfa FROM \"organizations\" WHERE id = $1",
+			orgID).Scan(&o.ID, &o.Name, &o.Description, &o.Domain, &managedBy, &o.CreatedAt, &o.UpdatedAt, &parentOrg, &o.RequireMFA)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -144,16 +146,16 @@ func CreateOrganization(db *sql.DB) http.HandlerFunc {
 			}
 		}
 
-		_, err := db.Exec("INSERT INTO \"organizations\" (id, name, description, domain, managed_by, created_at, updated_at, parent_org_id) VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, $6)",
-			orgID, strings.TrimSpace(req.Name), strings.TrimSpace(req.Description), strings.TrimSpace(req.Domain), managedBy, parentOrg)
+		_, err := db.Exec("INSERT INTO \"organizations\" (id, name, description, domain, managed_by, created_at, updated_at, parent_org_id, require_mfa) VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, $6, $7)",
+			orgID, strings.TrimSpace(req.Name), strings.TrimSpace(req.Description), strings.TrimSpace(req.Domain), managedBy, parentOrg, req.RequireMFA)
 		if err != nil {
 			writeErrorResponse(w, "Failed to create organization: "+err.Error(), http.StatusInternalServerError, r)
 			return
 		}
 
 		var o models.Organization
-		err = db.QueryRow("SELECT id, name, description, domain, managed_by, created_at, updated_at, parent_org_id FROM \"organizations\" WHERE id = $1",
-			orgID).Scan(&o.ID, &o.Name, &o.Description, &o.Domain, &managedBy, &o.CreatedAt, &o.UpdatedAt, &parentOrg)
+		err = db.QueryRow("SELECT id, name, description, domain, managed_by, created_at, updated_at, parent_org_id, require_mfa FROM \"organizations\" WHERE id = $1",
+			orgID).Scan(&o.ID, &o.Name, &o.Description, &o.Domain, &managedBy, &o.CreatedAt, &o.UpdatedAt, &parentOrg, &o.RequireMFA)
 		if err != nil {
 			writeErrorResponse(w, "Failed to retrieve created organization: "+err.Error(), http.StatusInternalServerError, r)
 			return
@@ -193,7 +195,8 @@ func CreateOrganization(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// UpdateOrganization updates an existing organization
+// UpdateOrganization updates an existing organization. It is authorized within
+// the organization; a new parent_org_id also requires manage_own_organization there.
 func UpdateOrganization(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -215,8 +218,8 @@ func UpdateOrganization(db *sql.DB) http.HandlerFunc {
 		var existing models.Organization
 		var mby sql.NullString
 		var porg sql.NullString
-		err = db.QueryRow("SELECT id, name, description, domain, managed_by, created_at, updated_at FROM \"organizations\" WHERE id = $1",
-			orgID).Scan(&existing.ID, &existing.Name, &existing.Description, &existing.Domain, &mby, &existing.CreatedAt, &existing.UpdatedAt)
+		err = db.QueryRow("SELECT id, name, description, domain, managed_by, created_at, updated_at, require_mfa FROM \"organizations\" WHERE id = $1",
+			orgID).Scan(&existing.ID, &existing.Name, &existing.Description, &existing.Domain, &mby, &existing.CreatedAt, &existing.UpdatedAt, &existing.RequireMFA)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				writeErrorResponse(w, "Organization not found", http.StatusNotFound, r)
@@ -257,6 +260,16 @@ func UpdateOrganization(db *sql.DB) http.HandlerFunc {
 		}
 		if req.ParentOrgID != "" {
 			if id, err := uuid.Parse(req.ParentOrgID); err == nil {
+				// Moving the organization must not escape into a tree the caller does not manage
+				allowed, err := middleware.CheckPermission(db, r, "manage_own_organization", &id)
+				if err != nil {
+					writeErrorResponse(w, "Error checking permissions", http.StatusInternalServerError, r)
+					return
+				}
+				if !allowed {
+					writeErrorResponse(w, "Moving an organization requires manage_own_organization in the new parent organization", http.StatusForbidden, r)
+					return
+				}
 				setParts = append(setParts, "parent_org_id = $"+strconv.Itoa(argCnt))
 				args = append(args, id)
 				argCnt++
@@ -265,6 +278,11 @@ func UpdateOrganization(db *sql.DB) http.HandlerFunc {
 				return
 			}
 		}
+		if req.RequireMFA != nil {
+			setParts = append(setParts, "require_mfa = $"+strconv.Itoa(argCnt))
+			args = append(args, *req.RequireMFA)
+			argCnt++
+		}
 
 		if len(setParts) == 0 {
 			writeErrorResponse(w, "No fields to update", http.StatusBadRequest, r)
@@ -283,8 +301,8 @@ func UpdateOrganization(db *sql.DB) http.HandlerFunc {
 		}
 
 		var updated models.Organization
-		err = db.QueryRow("SELECT id, name, description, domain, managed_by, created_at, updated_at, parent_org_id FROM \"organizations\" WHERE id = $1",
-			orgID).Scan(&updated.ID, &updated.Name, &updated.Description, &updated.Domain, &mby, &updated.CreatedAt, &updated.UpdatedAt, &porg)
+		err = db.QueryRow("SELECT id, name, description, domain, managed_by, created_at, updated_at, parent_org_id, require_mfa FROM \"organizations\" WHERE id = $1",
+			orgID).Scan(&updated.ID, &updated.Name, &updated.Description, &updated.Domain, &mby, &updated.CreatedAt, &updated.UpdatedAt, &porg, &updated.RequireMFA)
 		if err != nil {
 			writeErrorResponse(w, "Failed to retrieve updated organization: "+err.Error(), http.StatusInternalServerError, r)
 			return
@@ -355,7 +373,7 @@ func DeleteOrganization(db *sql.DB) http.HandlerFunc {
 			return
 		}
 		if memberCount > 0 {
-			writeErrorResponse(w, "Cannot delete organization that has user memberships", http.StatusConflict, r)
+			writeErrorResponse(w, "Cannot delete organization that has user memberships; remove its members first", http.StatusConflict, r)
 			return
 		}
 
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pillow/auth"
+	"pillow/middleware"
+	"pillow/models"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// maxPasswordAgeDays bounds max_age_days to something an administrator could mean
+const maxPasswordAgeDays = 3650
+
+// ChangePasswordRequest represents the request payload for changing one's own password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// writeValidationFailed rejects a request with structured field errors, in the
+// same format as middleware.ValidateBody
+func writeValidationFailed(w http.ResponseWriter, violations []auth.PolicyViolation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "validation_failed",
+		"details": violations,
+	})
+}
+
+// checkNewPassword validates a new password against the effective policy of
+// userID (nil for a new account, which only gets the global policy) and, for
+// existing users, against their password history. Violations are reported
+// under field. It returns false when the request was rejected.
+func checkNewPassword(db *sql.DB, w http.ResponseWriter, r *http.Request, userID *uuid.UUID, field, password, username, email string) bool {
+	policy, err := auth.EffectivePasswordPolicy(db, userID)
+	if err != nil {
+		writeErrorResponse(w, "Failed to load password policy: "+err.Error(), http.StatusInternalServerError, r)
+		return false
+	}
+
+	violations := auth.ValidatePassword(policy, password, username, email)
+	if userID != nil && len(violations) == 0 {
+		reused, err := auth.PasswordReused(db, *userID, password, policy.HistorySize)
+		if err != nil {
+			writeErrorResponse(w, "Failed to check password history: "+err.Error(), http.StatusInternalServerError, r)
+			return false
+		}
+		if reused {
+			violations = append(violations, auth.PolicyViolation{
+				Tag:    "history",
+				Param:  strconv.Itoa(policy.HistorySize),
+				Reason: fmt.Sprintf("Password must differ from the last %d passwords", policy.HistorySize),
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		for i := range violations {
+			violations[i].Field = field
+		}
+		writeValidationFailed(w, violations)
+		return false
+	}
+	return true
+}
+
+// validatePasswordPolicy checks that a submitted policy is within sane bounds
+func validatePasswordPolicy(p *models.PasswordPolicy) string {
+	if p.MinLength < 1 || p.MinLength > auth.MaxPasswordBytes {
+		return fmt.Sprintf("min_length must be between 1 and %d", auth.MaxPasswordBytes)
+	}
+	if p.HistorySize < 0 || p.HistorySize > auth.MaxPasswordHistory {
+		return fmt.Sprintf("history_size must be between 0 and %d", auth.MaxPasswordHistory)
+	}
+	if p.MaxAgeDays < 0 || p.MaxAgeDays > maxPasswordAgeDays {
+		return fmt.Sprintf("max_age_days must be between 0 and %d", maxPasswordAgeDays)
+	}
+
+	words := []string{}
+	for _, word := range p.BannedWords {
+		if word = strings.TrimSpace(word); word != "" {
+			words = append(words, word)
+		}
+	}
+	p.BannedWords = words
+	return ""
+}
+
+// organizationExists reports whether an organization with id exists
+func organizationExists(db *sql.DB, id uuid.UUID) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "organizations" WHERE id = $1)`, id).Scan(&exists)
+	return exists, err
+}
+
+// GetPasswordPolicy returns the global password policy, or the built-in default
+// when none has been configured. It is public so sign-up forms can show the rules.
+func GetPasswordPolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy, err := auth.LoadPasswordPolicy(db, nil)
+		if err == sql.ErrNoRows {
+			policy, err = auth.DefaultPasswordPolicy(), nil
+		}
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policy)
+	}
+}
+
+// UpdatePasswordPolicy replaces the global password policy
+func UpdatePasswordPolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var policy models.PasswordPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+		policy.OrgID = nil
+		if msg := validatePasswordPolicy(&policy); msg != "" {
+			writeErrorResponse(w, msg, http.StatusBadRequest, r)
+			return
+		}
+
+		saved, err := auth.SavePasswordPolicy(db, policy)
+		if err != nil {
+			writeErrorResponse(w, "Failed to save password policy: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "PASSWORD_POLICY_UPDATED", map[string]interface{}{
+			"scope":  "global",
+			"policy": saved,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+	}
+}
+
+// GetOrganizationPasswordPolicy returns the password policy of an organization
+func GetOrganizationPasswordPolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid organization ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		policy, err := auth.LoadPasswordPolicy(db, &orgID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Organization has no password policy", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policy)
+	}
+}
+
+// UpdateOrganizationPasswordPolicy creates or replaces the password policy of an
+// organization. It tightens the global policy for the organization's members.
+func UpdateOrganizationPasswordPolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid organization ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		var policy models.PasswordPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+		policy.OrgID = &orgID
+		if msg := validatePasswordPolicy(&policy); msg != "" {
+			writeErrorResponse(w, msg, http.StatusBadRequest, r)
+			return
+		}
+
+		exists, err := organizationExists(db, orgID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "Organization not found", http.StatusNotFound, r)
+			return
+		}
+
+		saved, err := auth.SavePasswordPolicy(db, policy)
+		if err != nil {
+			writeErrorResponse(w, "Failed to save password policy: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "PASSWORD_POLICY_UPDATED", map[string]interface{}{
+			"scope":  "organization",
+			"org_id": orgID,
+			"policy": saved,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+	}
+}
+
+// DeleteOrganizationPasswordPolicy removes the password policy of an
+// organization, leaving its members with the global policy
+func DeleteOrganizationPasswordPolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid organization ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		res, err := db.Exec(`DELETE FROM "password_policies" WHERE org_id = $1`, orgID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to delete password policy: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeErrorResponse(w, "Organization has no password policy", http.StatusNotFound, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "PASSWORD_POLICY_DELETED", map[string]interface{}{
+			"scope":  "organization",
+			"org_id": orgID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Password policy deleted",
+		})
+	}
+}
+
+// ChangePassword sets a new password for the current user after checking the
+// current one. It is also how a session restricted by an expired password is
+// lifted. Wrong current passwords count towards the login lockout.
+func ChangePassword(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var req ChangePasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+		if req.CurrentPassword == "" || req.NewPassword == "" {
+			writeErrorResponse(w, "Current and new password are required", http.StatusBadRequest, r)
+			return
+		}
+
+		var currentHash string
+		if err := db.QueryRow(`SELECT password_hash FROM "users" WHERE id = $1`, user.ID).Scan(&currentHash); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if currentHash == "" {
+			writeErrorResponse(w, "This account signs in through an identity provider and has no password", http.StatusBadRequest, r)
+			return
+		}
+
+		if !checkLoginThrottle(db, w, r, &user.ID) {
+			return
+		}
+		if !auth.CheckPasswordHash(req.CurrentPassword, currentHash) {
+			recordLoginFailure(db, r, &user.ID, user.Username, "invalid_current_password")
+			writeErrorResponse(w, "Current password is incorrect", http.StatusBadRequest, r)
+			return
+		}
+
+		if !checkNewPassword(db, w, r, &user.ID, "new_password", req.NewPassword, user.Username, user.Email) {
+			return
+		}
+
+		hashedPassword, err := auth.HashPassword(req.NewPassword)
+		if err != nil {
+			writeErrorResponse(w, "Failed to hash password", http.StatusInternalServerError, r)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := auth.UpdatePassword(tx, user.ID, hashedPassword); err != nil {
+			writeErrorResponse(w, "Failed to update password: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "PASSWORD_CHANGED", map[string]interface{}{
+			"user_id": user.ID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Password changed",
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"pillow/audit"
+	"pillow/auth"
+	"pillow/config"
+	"pillow/mail"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ForgotPasswordRequest represents the forgot password request payload
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest represents the reset password request payload
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ForgotPassword emails a single-use password reset link to the account owner.
+// The response is identical whether or not the email matches an account so the
+// endpoint cannot be used to enumerate users.
+func ForgotPassword(db *sql.DB, mailer mail.Mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ForgotPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+
+		email := strings.TrimSpace(req.Email)
+		if email == "" {
+			writeErrorResponse(w, "Email is required", http.StatusBadRequest, r)
+			return
+		}
+
+		response := map[string]interface{}{
+			"message": "If an account with that email exists, a password reset link has been sent",
+		}
+
+		var userID uuid.UUID
+		var username string
+		err := db.QueryRow("SELECT id, username FROM \"users\" WHERE email = $1 AND is_active = true AND principal_type = 'user'",
+			email).Scan(&userID, &username)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		token, err := auth.GenerateOpaqueToken()
+		if err != nil {
+			writeErrorResponse(w, "Failed to generate reset token", http.StatusInternalServerError, r)
+			return
+		}
+
+		ttl := config.Duration("PASSWORD_RESET_TTL", time.Hour)
+
+		// Only the most recent link is usable
+		_, err = db.Exec("UPDATE \"password_reset_tokens\" SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL", userID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to create reset token: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		_, err = db.Exec("INSERT INTO \"password_reset_tokens\" (id, user_id, token_hash, expires_at, requested_ip, created_at) VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)",
+			uuid.New(), userID, auth.HashToken(token), time.Now().Add(ttl), r.RemoteAddr)
+		if err != nil {
+			writeErrorResponse(w, "Failed to create reset token: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		link := frontendURL() + "/reset-password?token=" + url.QueryEscape(token)
+		msg := mail.Message{
+			To:      email,
+			Subject: "Reset your Pillow password",
+			Body: fmt.Sprintf("Hi %s,\n\nWe received a request to reset your password. Use the link below to choose a new one:\n\n%s\n\nThis link expires in %s and can only be used once. If you did not request a reset, you can ignore this email.\n",
+				username, link, ttl),
+		}
+		if err := mailer.Send(msg); err != nil {
+			log.Printf("mail: failed to send password reset email to user %s: %v\n", userID, err)
+		}
+
+		audit.Record(db, "PASSWORD_RESET_REQUESTED", &userID, map[string]interface{}{
+			"ip_address": r.RemoteAddr,
+			"user_agent": r.UserAgent(),
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// ResetPassword sets a new password using a reset token. The token is consumed,
+// and every existing session of the user is revoked.
+func ResetPassword(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ResetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+
+		if req.Token == "" {
+			writeErrorResponse(w, "Reset token is required", http.StatusBadRequest, r)
+			return
+		}
+		if req.NewPassword == "" {
+			writeErrorResponse(w, "New password is required", http.StatusBadRequest, r)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer tx.Rollback()
+
+		var tokenID, userID uuid.UUID
+		var expiresAt time.Time
+		var usedAt *time.Time
+		err = tx.QueryRow("SELECT id, user_id, expires_at, used_at FROM \"password_reset_tokens\" WHERE token_hash = $1 FOR UPDATE",
+			auth.HashToken(req.Token)).Scan(&tokenID, &userID, &expiresAt, &usedAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Invalid or expired reset token", http.StatusBadRequest, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		if usedAt != nil || time.Now().After(expiresAt) {
+			writeErrorResponse(w, "Invalid or expired reset token", http.StatusBadRequest, r)
+			return
+		}
+
+		// A rejected password leaves the token unused so the user can try another one
+		var username, email string
+		if err := tx.QueryRow("SELECT username, email FROM \"users\" WHERE id = $1", userID).Scan(&username, &email); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !checkNewPassword(db, w, r, &userID, "new_password", req.NewPassword, username, email) {
+			return
+		}
+
+		hashedPassword, err := auth.HashPassword(req.NewPassword)
+		if err != nil {
+			writeErrorResponse(w, "Failed to hash password", http.StatusInternalServerError, r)
+			return
+		}
+
+		if _, err := tx.Exec("UPDATE \"password_reset_tokens\" SET used_at = CURRENT_TIMESTAMP WHERE id = $1", tokenID); err != nil {
+			writeErrorResponse(w, "Failed to consume reset token: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if err := auth.UpdatePassword(tx, userID, hashedPassword); err != nil {
+			writeErrorResponse(w, "Failed to update password: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		// Anyone holding an old session must log in again with the new password
+		if err := auth.RevokeAllUserTokens(db, userID); err != nil {
+			log.Printf("auth: failed to revoke sessions after password reset for user %s: %v\n", userID, err)
+		}
+
+		audit.Record(db, "PASSWORD_RESET", &userID, map[string]interface{}{
+			"reset_token_id": tokenID,
+			"ip_address":     r.RemoteAddr,
+			"user_agent":     r.UserAgent(),
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Password has been reset",
+		})
+	}
+}
@@ -26,6 +26,15 @@ type UpdatePermissionRequest struct {
 	ScopeLevel  string `json:"scope_level,omitempty"`
 }
 
+// validScopeLevel reports whether level is a known permission scope level
+func validScopeLevel(level string) bool {
+	switch level {
+	case models.PermissionScopeSystem, models.PermissionScopeOrg, models.PermissionScopeUser:
+		return true
+	}
+	return false
+}
+
 // GetPermissions retrieves all permissions
 func GetPermissions(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -99,7 +108,11 @@ func CreatePermission(db *sql.DB) http.HandlerFunc {
 		// Set default scope level if not provided
 		scopeLevel := strings.TrimSpace(req.ScopeLevel)
 		if scopeLevel == "" {
-			scopeLevel = "user"
+			scopeLevel = models.PermissionScopeUser
+		}
+		if !validScopeLevel(scopeLevel) {
+			writeErrorResponse(w, "scope_level must be system, organization or user", http.StatusBadRequest, r)
+			return
 		}
 
 		// Check if permission name already exists
@@ -225,6 +238,10 @@ func UpdatePermission(db *sql.DB) http.HandlerFunc {
 		}
 
 		if req.ScopeLevel != "" {
+			if !validScopeLevel(strings.TrimSpace(req.ScopeLevel)) {
+				writeErrorResponse(w, "scope_level must be system, organization or user", http.StatusBadRequest, r)
+				return
+			}
 			setParts = append(setParts, "scope_level = $"+string(rune('0'+argCount)))
 			args = append(args, strings.TrimSpace(req.ScopeLevel))
 			argCount++
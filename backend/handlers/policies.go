@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pillow/middleware"
+	"pillow/models"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// PolicyRequest represents the request payload for creating or replacing a policy
+type PolicyRequest struct {
+	Name        string                   `json:"name"`
+	Description string                   `json:"description,omitempty"`
+	Effect      string                   `json:"effect"`
+	Permission  string                   `json:"permission"`
+	OrgID       *uuid.UUID               `json:"org_id,omitempty"`
+	Conditions  []models.PolicyCondition `json:"conditions"`
+	Timezone    string                   `json:"timezone,omitempty"`
+	IsActive    *bool                    `json:"is_active,omitempty"`
+}
+
+// decodePolicyRequest decodes and validates a policy payload, writing an error
+// response and returning false when it is not acceptable
+func decodePolicyRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) (PolicyRequest, bool) {
+	var req PolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+		return req, false
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+	req.Permission = strings.TrimSpace(req.Permission)
+	if req.Name == "" {
+		writeErrorResponse(w, "Policy name is required", http.StatusBadRequest, r)
+		return req, false
+	}
+	if req.Effect != models.PolicyEffectAllow && req.Effect != models.PolicyEffectDeny {
+		writeErrorResponse(w, "effect must be allow or deny", http.StatusBadRequest, r)
+		return req, false
+	}
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(req.Timezone); err != nil {
+		writeErrorResponse(w, "Unknown timezone: "+req.Timezone, http.StatusBadRequest, r)
+		return req, false
+	}
+	if req.Conditions == nil {
+		req.Conditions = []models.PolicyCondition{}
+	}
+	for i, c := range req.Conditions {
+		if msg := middleware.ValidatePolicyCondition(c); msg != "" {
+			writeErrorResponse(w, fmt.Sprintf("conditions[%d]: %s", i, msg), http.StatusBadRequest, r)
+			return req, false
+		}
+	}
+	// An allow policy without conditions would simply grant the permission to
+	// everyone; that is what roles are for
+	if req.Effect == models.PolicyEffectAllow && len(req.Conditions) == 0 {
+		writeErrorResponse(w, "Allow policies need at least one condition", http.StatusBadRequest, r)
+		return req, false
+	}
+
+	if req.Permission == "" {
+		writeErrorResponse(w, "Permission is required", http.StatusBadRequest, r)
+		return req, false
+	}
+	if req.Permission != models.PolicyAnyPermission {
+		var scopeLevel string
+		err := db.QueryRow(`SELECT COALESCE(scope_level, '') FROM "permissions" WHERE name = $1`, req.Permission).Scan(&scopeLevel)
+		if err == sql.ErrNoRows {
+			writeErrorResponse(w, "Permission not found", http.StatusBadRequest, r)
+			return req, false
+		}
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return req, false
+		}
+		// Applies to "*" as well, where it is enforced when policies are evaluated
+		if req.Effect == models.PolicyEffectAllow && scopeLevel == models.PermissionScopeSystem {
+			writeErrorResponse(w, "Allow policies cannot grant system-level permissions", http.StatusBadRequest, r)
+			return req, false
+		}
+	}
+	if req.OrgID != nil {
+		exists, err := organizationExists(db, *req.OrgID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return req, false
+		}
+		if !exists {
+			writeErrorResponse(w, "Organization not found", http.StatusBadRequest, r)
+			return req, false
+		}
+	}
+	return req, true
+}
+
+// policyFromRequest parses the id route variable and loads the policy, writing
+// an error response and returning false when that fails
+func policyFromRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) (models.Policy, bool) {
+	policyID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		writeErrorResponse(w, "Invalid policy ID format", http.StatusBadRequest, r)
+		return models.Policy{}, false
+	}
+	policy, err := middleware.ScanPolicy(db.QueryRow(`SELECT `+middleware.PolicyColumns+` FROM "policies" WHERE id = $1`, policyID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeErrorResponse(w, "Policy not found", http.StatusNotFound, r)
+			return policy, false
+		}
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+		return policy, false
+	}
+	return policy, true
+}
+
+// policyNameTaken reports whether another policy than exceptID is named name
+func policyNameTaken(db *sql.DB, name string, exceptID uuid.UUID) (bool, error) {
+	var taken bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "policies" WHERE name = $1 AND id <> $2)`, name, exceptID).Scan(&taken)
+	return taken, err
+}
+
+// GetPolicies lists all access policies
+func GetPolicies(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policies, err := middleware.LoadPolicies(db, false)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policies)
+	}
+}
+
+// GetPolicy retrieves a single access policy
+func GetPolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := policyFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policy)
+	}
+}
+
+// CreatePolicy creates an attribute-based access policy. It takes effect on
+// every replica as soon as it is committed.
+func CreatePolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodePolicyRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		taken, err := policyNameTaken(db, req.Name, uuid.Nil)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if taken {
+			writeErrorResponse(w, "Policy with this name already exists", http.StatusConflict, r)
+			return
+		}
+
+		isActive := true
+		if req.IsActive != nil {
+			isActive = *req.IsActive
+		}
+		conditions, _ := json.Marshal(req.Conditions)
+		policy, err := middleware.ScanPolicy(db.QueryRow(`INSERT INTO "policies" (id, name, description, effect, permission,
+				org_id, conditions, timezone, is_active, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			RETURNING `+middleware.PolicyColumns,
+			uuid.New(), req.Name, req.Description, req.Effect, req.Permission, req.OrgID, conditions, req.Timezone, isActive))
+		if err != nil {
+			writeErrorResponse(w, "Failed to create policy: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "POLICY_CREATED", map[string]interface{}{
+			"policy_after": policy,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Policy created successfully",
+			"policy":  policy,
+		})
+	}
+}
+
+// UpdatePolicy replaces an access policy
+func UpdatePolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		before, ok := policyFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		req, ok := decodePolicyRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		taken, err := policyNameTaken(db, req.Name, before.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if taken {
+			writeErrorResponse(w, "Policy with this name already exists", http.StatusConflict, r)
+			return
+		}
+
+		isActive := before.IsActive
+		if req.IsActive != nil {
+			isActive = *req.IsActive
+		}
+		conditions, _ := json.Marshal(req.Conditions)
+		policy, err := middleware.ScanPolicy(db.QueryRow(`UPDATE "policies" SET name = $2, description = $3, effect = $4,
+				permission = $5, org_id = $6, conditions = $7, timezone = $8, is_active = $9, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+			RETURNING `+middleware.PolicyColumns,
+			before.ID, req.Name, req.Description, req.Effect, req.Permission, req.OrgID, conditions, req.Timezone, isActive))
+		if err != nil {
+			writeErrorResponse(w, "Failed to update policy: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "POLICY_UPDATED", map[string]interface{}{
+			"policy_before": before,
+			"policy_after":  policy,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Policy updated successfully",
+			"policy":  policy,
+		})
+	}
+}
+
+// DeletePolicy deletes an access policy
+func DeletePolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := policyFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		if _, err := db.Exec(`DELETE FROM "policies" WHERE id = $1`, policy.ID); err != nil {
+			writeErrorResponse(w, "Failed to delete policy: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "POLICY_DELETED", map[string]interface{}{
+			"policy_before": policy,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Policy deleted successfully",
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"pillow/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// AddRoleParentRequest represents the request payload for making a role inherit from another
+type AddRoleParentRequest struct {
+	ParentRoleID uuid.UUID `json:"parent_role_id"`
+}
+
+// loadRole loads a role by ID; it returns sql.ErrNoRows when there is none
+func loadRole(db *sql.DB, roleID uuid.UUID) (models.Role, error) {
+	var role models.Role
+	err := db.QueryRow("SELECT id, name, description, owner_id, created_at, updated_at FROM \"roles\" WHERE id = $1",
+		roleID).Scan(&role.ID, &role.Name, &role.Description, &role.OwnerID, &role.CreatedAt, &role.UpdatedAt)
+	return role, err
+}
+
+// roleFromRequest parses the roleId route variable and loads the role, writing
+// an error response and returning false when that fails
+func roleFromRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) (models.Role, bool) {
+	roleID, err := uuid.Parse(mux.Vars(r)["roleId"])
+	if err != nil {
+		writeErrorResponse(w, "Invalid role ID format", http.StatusBadRequest, r)
+		return models.Role{}, false
+	}
+	role, err := loadRole(db, roleID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeErrorResponse(w, "Role not found", http.StatusNotFound, r)
+			return role, false
+		}
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+		return role, false
+	}
+	return role, true
+}
+
+// queryRelatedRoles runs a query returning role columns followed by a depth
+func queryRelatedRoles(db *sql.DB, query string, args ...interface{}) ([]models.RelatedRole, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []models.RelatedRole{}
+	for rows.Next() {
+		var role models.RelatedRole
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.UpdatedAt, &role.Depth); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// GetRoleParents lists the roles a role directly inherits from
+func GetRoleParents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := roleFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		parents, err := queryRelatedRoles(db, `SELECT r.id, r.name, r.description, r.created_at, r.updated_at, 1
+			FROM "roles" r INNER JOIN "role_parents" rp ON rp.parent_role_id = r.id
+			WHERE rp.role_id = $1 ORDER BY r.name`, role.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"role":    role,
+			"parents": parents,
+		})
+	}
+}
+
+// AddRoleParent makes a role inherit from a parent role. The edit is rejected
+// when the parent already inherits from the role, which would close a cycle.
+func AddRoleParent(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := roleFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		var req AddRoleParentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+
+		parent, err := loadRole(db, req.ParentRoleID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Parent role not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer tx.Rollback()
+
+		// Serialize hierarchy edits so two concurrent edits cannot close a cycle together
+		if _, err := tx.Exec(`LOCK TABLE "role_parents" IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		var cycle bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM "role_ancestry" WHERE role_id = $1 AND ancestor_id = $2)`,
+			parent.ID, role.ID).Scan(&cycle); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if cycle {
+			writeErrorResponse(w, "Role hierarchy cannot contain cycles: "+parent.Name+" already inherits from "+role.Name, http.StatusConflict, r)
+			return
+		}
+
+		before, err := lockedSoDViolations(tx, nil)
+		if err != nil {
+			writeErrorResponse(w, "Failed to check separation of duties: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		res, err := tx.Exec(`INSERT INTO "role_parents" (role_id, parent_role_id, created_at)
+			VALUES ($1, $2, CURRENT_TIMESTAMP) ON CONFLICT DO NOTHING`, role.ID, parent.ID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to add parent role: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeErrorResponse(w, "Role already inherits from this parent", http.StatusConflict, r)
+			return
+		}
+		if !checkSeparationOfDuties(tx, w, r, nil, before) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "ROLE_PARENT_ADDED", map[string]interface{}{
+			"role_id":        role.ID,
+			"parent_role_id": parent.ID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":        "Parent role added successfully",
+			"role_id":        role.ID,
+			"parent_role_id": parent.ID,
+		})
+	}
+}
+
+// RemoveRoleParent stops a role from inheriting from a parent role
+func RemoveRoleParent(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := roleFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		parentID, err := uuid.Parse(mux.Vars(r)["parentId"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid parent role ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		res, err := db.Exec(`DELETE FROM "role_parents" WHERE role_id = $1 AND parent_role_id = $2`, role.ID, parentID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to remove parent role: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeErrorResponse(w, "Role does not inherit from this parent", http.StatusNotFound, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "ROLE_PARENT_REMOVED", map[string]interface{}{
+			"role_id":        role.ID,
+			"parent_role_id": parentID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":        "Parent role removed successfully",
+			"role_id":        role.ID,
+			"parent_role_id": parentID,
+		})
+	}
+}
+
+// GetRoleAncestors lists every role a role inherits from, directly or through
+// other roles, with the shortest distance to each
+func GetRoleAncestors(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := roleFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		ancestors, err := queryRelatedRoles(db, `SELECT r.id, r.name, r.description, r.created_at, r.updated_at, MIN(ra.depth)
+			FROM "role_ancestry" ra INNER JOIN "roles" r ON r.id = ra.ancestor_id
+			WHERE ra.role_id = $1 AND ra.depth > 0
+			GROUP BY r.id ORDER BY MIN(ra.depth), r.name`, role.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"role":      role,
+			"ancestors": ancestors,
+		})
+	}
+}
+
+// GetRoleDescendants lists every role that inherits from a role, directly or
+// through other roles, with the shortest distance to each
+func GetRoleDescendants(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := roleFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		descendants, err := queryRelatedRoles(db, `SELECT r.id, r.name, r.description, r.created_at, r.updated_at, MIN(ra.depth)
+			FROM "role_ancestry" ra INNER JOIN "roles" r ON r.id = ra.role_id
+			WHERE ra.ancestor_id = $1 AND ra.depth > 0
+			GROUP BY r.id ORDER BY MIN(ra.depth), r.name`, role.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"role":        role,
+			"descendants": descendants,
+		})
+	}
+}
+
+// GetRoleEffectivePermissions returns the fully resolved permission set of a
+// role: its own permissions and those of all its ancestors
+func GetRoleEffectivePermissions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := roleFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Query(`SELECT p.id, p.name, p.description, p.scope_level, p.created_at, p.updated_at,
+				array_agg(DISTINCT rp.role_id)
+			FROM "permissions" p
+			INNER JOIN "role_permissions" rp ON p.id = rp.permission_id
+			INNER JOIN "role_ancestry" ra ON rp.role_id = ra.ancestor_id
+			WHERE ra.role_id = $1
+			GROUP BY p.id ORDER BY p.name`, role.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer rows.Close()
+
+		permissions := []models.ResolvedPermission{}
+		for rows.Next() {
+			var permission models.ResolvedPermission
+			var grantedBy []string
+			if err := rows.Scan(&permission.ID, &permission.Name, &permission.Description, &permission.ScopeLevel,
+				&permission.CreatedAt, &permission.UpdatedAt, pq.Array(&grantedBy)); err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			for _, id := range grantedBy {
+				if roleID, err := uuid.Parse(id); err == nil {
+					permission.GrantedBy = append(permission.GrantedBy, roleID)
+				}
+			}
+			permissions = append(permissions, permission)
+		}
+		if err := rows.Err(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"role":        role,
+			"permissions": permissions,
+		})
+	}
+}
@@ -130,14 +130,45 @@ func AssignPermissionToRole(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Create the assignment
-		_, err = db.Exec("INSERT INTO \"role_permissions\" (role_id, permission_id, created_at, updated_at) VALUES ($1, $2, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
+		var denied bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "role_denied_permissions" WHERE role_id = $1 AND permission_id = $2)`,
+			roleID, req.PermissionID).Scan(&denied); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if denied {
+			writeErrorResponse(w, "The role denies this permission; remove the deny first", http.StatusConflict, r)
+			return
+		}
+
+		// Create the assignment, unless it leaves a user holding permissions a
+		// separation-of-duties constraint keeps apart
+		tx, err := db.Begin()
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := lockedSoDViolations(tx, nil)
+		if err != nil {
+			writeErrorResponse(w, "Failed to check separation of duties: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		_, err = tx.Exec("INSERT INTO \"role_permissions\" (role_id, permission_id, created_at, updated_at) VALUES ($1, $2, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
 			roleID, req.PermissionID)
 
 		if err != nil {
 			writeErrorResponse(w, "Failed to assign permission to role: "+err.Error(), http.StatusInternalServerError, r)
 			return
 		}
+		if !checkSeparationOfDuties(tx, w, r, nil, before) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
@@ -259,3 +290,147 @@ func GetPermissionRoles(db *sql.DB) http.HandlerFunc {
 		json.NewEncoder(w).Encode(response)
 	}
 }
+
+// GetRoleDeniedPermissions lists the permissions a role explicitly denies
+func GetRoleDeniedPermissions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := roleFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT p.id, p.name, p.description, p.scope_level, p.created_at, p.updated_at
+			FROM "permissions" p
+			INNER JOIN "role_denied_permissions" rd ON p.id = rd.permission_id
+			WHERE rd.role_id = $1
+			ORDER BY p.name
+		`, role.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer rows.Close()
+
+		permissions := []models.Permission{}
+		for rows.Next() {
+			var permission models.Permission
+			if err := rows.Scan(&permission.ID, &permission.Name, &permission.Description, &permission.ScopeLevel, &permission.CreatedAt, &permission.UpdatedAt); err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			permissions = append(permissions, permission)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(models.RoleWithPermissions{
+			Role:        role,
+			Permissions: permissions,
+		})
+	}
+}
+
+// DenyPermissionForRole makes a role explicitly deny a permission. Users
+// holding the role, or a role inheriting from it, lose the permission in the
+// scope of that assignment whatever other roles or policies grant. A role
+// cannot deny a permission it grants directly.
+func DenyPermissionForRole(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := roleFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		var req AssignPermissionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+
+		var permission models.Permission
+		err := db.QueryRow("SELECT id, name FROM \"permissions\" WHERE id = $1", req.PermissionID).Scan(&permission.ID, &permission.Name)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Permission not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		var granted bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "role_permissions" WHERE role_id = $1 AND permission_id = $2)`,
+			role.ID, permission.ID).Scan(&granted); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if granted {
+			writeErrorResponse(w, "The role grants this permission; remove it from the role first", http.StatusConflict, r)
+			return
+		}
+
+		res, err := db.Exec(`INSERT INTO "role_denied_permissions" (role_id, permission_id, created_at)
+			VALUES ($1, $2, CURRENT_TIMESTAMP) ON CONFLICT DO NOTHING`, role.ID, permission.ID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to deny permission: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeErrorResponse(w, "The role already denies this permission", http.StatusConflict, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "ROLE_PERMISSION_DENIED", map[string]interface{}{
+			"role_id":         role.ID,
+			"role_name":       role.Name,
+			"permission_id":   permission.ID,
+			"permission_name": permission.Name,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":       "Permission denied for role successfully",
+			"role_id":       role.ID,
+			"permission_id": permission.ID,
+		})
+	}
+}
+
+// RemoveRoleDeniedPermission lifts an explicit deny of a role
+func RemoveRoleDeniedPermission(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := roleFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		permissionID, err := uuid.Parse(mux.Vars(r)["permissionId"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid permission ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		res, err := db.Exec(`DELETE FROM "role_denied_permissions" WHERE role_id = $1 AND permission_id = $2`, role.ID, permissionID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to remove denied permission: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeErrorResponse(w, "The role does not deny this permission", http.StatusNotFound, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "ROLE_PERMISSION_DENY_REMOVED", map[string]interface{}{
+			"role_id":       role.ID,
+			"role_name":     role.Name,
+			"permission_id": permissionID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":       "Denied permission removed from role successfully",
+			"role_id":       role.ID,
+			"permission_id": permissionID,
+		})
+	}
+}
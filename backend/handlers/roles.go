@@ -14,20 +14,41 @@ import (
 
 // CreateRoleRequest represents the request payload for creating a role
 type CreateRoleRequest struct {
-	Name        string `json:"name"`
-	Description string `json:"description,omitempty"`
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	OwnerID     *uuid.UUID `json:"owner_id,omitempty"`
 }
 
-// UpdateRoleRequest represents the request payload for updating a role
+// UpdateRoleRequest represents the request payload for updating a role. An
+// all-zero owner_id removes the owner.
 type UpdateRoleRequest struct {
-	Name        string `json:"name,omitempty"`
-	Description string `json:"description,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	Description string     `json:"description,omitempty"`
+	OwnerID     *uuid.UUID `json:"owner_id,omitempty"`
+}
+
+// checkRoleOwner writes a 400 unless ownerID is unset, all-zero or an existing
+// user
+func checkRoleOwner(db *sql.DB, w http.ResponseWriter, r *http.Request, ownerID *uuid.UUID) bool {
+	if ownerID == nil || *ownerID == uuid.Nil {
+		return true
+	}
+	exists, err := userExists(db, *ownerID)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+		return false
+	}
+	if !exists {
+		writeErrorResponse(w, "Owner user not found", http.StatusBadRequest, r)
+		return false
+	}
+	return true
 }
 
 // GetRoles retrieves all roles
 func GetRoles(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT id, name, description, created_at, updated_at FROM \"roles\" ORDER BY name")
+		rows, err := db.Query("SELECT id, name, description, owner_id, created_at, updated_at FROM \"roles\" ORDER BY name")
 		if err != nil {
 			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
 			return
@@ -37,7 +58,7 @@ func GetRoles(db *sql.DB) http.HandlerFunc {
 		var roles []models.Role
 		for rows.Next() {
 			var role models.Role
-			err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.UpdatedAt)
+			err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.OwnerID, &role.CreatedAt, &role.UpdatedAt)
 			if err != nil {
 				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
 				return
@@ -63,8 +84,8 @@ func GetRole(db *sql.DB) http.HandlerFunc {
 		}
 
 		var role models.Role
-		err = db.QueryRow("SELECT id, name, description, created_at, updated_at FROM \"roles\" WHERE id = $1",
-			roleID).Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.UpdatedAt)
+		err = db.QueryRow("SELECT id, name, description, owner_id, created_at, updated_at FROM \"roles\" WHERE id = $1",
+			roleID).Scan(&role.ID, &role.Name, &role.Description, &role.OwnerID, &role.CreatedAt, &role.UpdatedAt)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -93,6 +114,12 @@ func CreateRole(db *sql.DB) http.HandlerFunc {
 			writeErrorResponse(w, "Role name is required", http.StatusBadRequest, r)
 			return
 		}
+		if req.OwnerID != nil && *req.OwnerID == uuid.Nil {
+			req.OwnerID = nil
+		}
+		if !checkRoleOwner(db, w, r, req.OwnerID) {
+			return
+		}
 
 		// Check if role name already exists
 		var existingID uuid.UUID
@@ -107,8 +134,8 @@ func CreateRole(db *sql.DB) http.HandlerFunc {
 
 		// Create new role
 		roleID := uuid.New()
-		_, err = db.Exec("INSERT INTO \"roles\" (id, name, description, created_at, updated_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
-			roleID, strings.TrimSpace(req.Name), strings.TrimSpace(req.Description))
+		_, err = db.Exec("INSERT INTO \"roles\" (id, name, description, owner_id, created_at, updated_at) VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
+			roleID, strings.TrimSpace(req.Name), strings.TrimSpace(req.Description), req.OwnerID)
 
 		if err != nil {
 			writeErrorResponse(w, "Failed to create role: "+err.Error(), http.StatusInternalServerError, r)
@@ -117,8 +144,8 @@ func CreateRole(db *sql.DB) http.HandlerFunc {
 
 		// Get the created role
 		var role models.Role
-		err = db.QueryRow("SELECT id, name, description, created_at, updated_at FROM \"roles\" WHERE id = $1",
-			roleID).Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.UpdatedAt)
+		err = db.QueryRow("SELECT id, name, description, owner_id, created_at, updated_at FROM \"roles\" WHERE id = $1",
+			roleID).Scan(&role.ID, &role.Name, &role.Description, &role.OwnerID, &role.CreatedAt, &role.UpdatedAt)
 
 		if err != nil {
 			writeErrorResponse(w, "Failed to retrieve created role: "+err.Error(), http.StatusInternalServerError, r)
@@ -173,8 +200,8 @@ func UpdateRole(db *sql.DB) http.HandlerFunc {
 
 		// Check if role exists
 		var existingRole models.Role
-		err = db.QueryRow("SELECT id, name, description FROM \"roles\" WHERE id = $1",
-			roleID).Scan(&existingRole.ID, &existingRole.Name, &existingRole.Description)
+		err = db.QueryRow("SELECT id, name, description, owner_id FROM \"roles\" WHERE id = $1",
+			roleID).Scan(&existingRole.ID, &existingRole.Name, &existingRole.Description, &existingRole.OwnerID)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -216,6 +243,19 @@ func UpdateRole(db *sql.DB) http.HandlerFunc {
 			argCount++
 		}
 
+		if req.OwnerID != nil {
+			if !checkRoleOwner(db, w, r, req.OwnerID) {
+				return
+			}
+			setParts = append(setParts, "owner_id = $"+string(rune('0'+argCount)))
+			if *req.OwnerID == uuid.Nil {
+				args = append(args, nil)
+			} else {
+				args = append(args, *req.OwnerID)
+			}
+			argCount++
+		}
+
 		if len(setParts) == 0 {
 			writeErrorResponse(w, "No fields to update", http.StatusBadRequest, r)
 			return
@@ -233,8 +273,8 @@ func UpdateRole(db *sql.DB) http.HandlerFunc {
 
 		// Get updated role
 		var updatedRole models.Role
-		err = db.QueryRow("SELECT id, name, description, created_at, updated_at FROM \"roles\" WHERE id = $1",
-			roleID).Scan(&updatedRole.ID, &updatedRole.Name, &updatedRole.Description, &updatedRole.CreatedAt, &updatedRole.UpdatedAt)
+		err = db.QueryRow("SELECT id, name, description, owner_id, created_at, updated_at FROM \"roles\" WHERE id = $1",
+			roleID).Scan(&updatedRole.ID, &updatedRole.Name, &updatedRole.Description, &updatedRole.OwnerID, &updatedRole.CreatedAt, &updatedRole.UpdatedAt)
 
 		if err != nil {
 			writeErrorResponse(w, "Failed to retrieve updated role: "+err.Error(), http.StatusInternalServerError, r)
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"pillow/models"
+)
+
+// GetRoutes lists every registered route with its method and what authorizes
+// a request to it
+func GetRoutes(catalog interface{ Describe() []models.RouteInfo }) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(catalog.Describe())
+	}
+}
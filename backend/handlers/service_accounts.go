@@ -0,0 +1,478 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"pillow/audit"
+	"pillow/auth"
+	"pillow/middleware"
+	"pillow/models"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// serviceAccountNamePattern restricts service account names, which double as
+// their username, to something safe to show in logs and tokens
+var serviceAccountNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{2,49}$`)
+
+// serviceAccountEmailDomain is used for the placeholder address of service
+// accounts; ".invalid" can never receive mail (RFC 2606)
+const serviceAccountEmailDomain = "service-accounts.invalid"
+
+// CreateServiceAccountRequest represents the request payload for creating a service account
+type CreateServiceAccountRequest struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	OrgID       uuid.UUID   `json:"org_id"`
+	RoleIDs     []uuid.UUID `json:"role_ids,omitempty"`
+}
+
+// UpdateServiceAccountRequest represents the request payload for updating a service account
+type UpdateServiceAccountRequest struct {
+	Description *string `json:"description,omitempty"`
+	IsActive    *bool   `json:"is_active,omitempty"`
+}
+
+// ServiceAccountCredentials is returned when a service account is created or its
+// secret rotated. The secret is only ever returned here.
+type ServiceAccountCredentials struct {
+	ServiceAccount models.ServiceAccount `json:"service_account"`
+	ClientID       string                `json:"client_id"`
+	ClientSecret   string                `json:"client_secret"`
+}
+
+const serviceAccountColumns = `sa.user_id, u.username, COALESCE(sa.description, ''), sa.org_id, u.is_active, sa.secret_hash,
+	sa.created_by, sa.last_token_at, sa.created_at, sa.updated_at`
+
+const serviceAccountFrom = `FROM "service_accounts" sa INNER JOIN "users" u ON u.id = sa.user_id`
+
+// scanServiceAccount scans a row selected with serviceAccountColumns
+func scanServiceAccount(row interface{ Scan(...interface{}) error }) (models.ServiceAccount, error) {
+	var sa models.ServiceAccount
+	err := row.Scan(&sa.ID, &sa.Name, &sa.Description, &sa.OrgID, &sa.IsActive, &sa.SecretHash,
+		&sa.CreatedBy, &sa.LastTokenAt, &sa.CreatedAt, &sa.UpdatedAt)
+	return sa, err
+}
+
+// loadServiceAccount loads a service account by ID
+func loadServiceAccount(db *sql.DB, id uuid.UUID) (models.ServiceAccount, error) {
+	return scanServiceAccount(db.QueryRow(`SELECT `+serviceAccountColumns+` `+serviceAccountFrom+` WHERE sa.user_id = $1`, id))
+}
+
+// exchangeClientCredentials implements the client_credentials grant for service
+// accounts: the service account ID is the client_id
+func exchangeClientCredentials(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	id, secret := clientCredentials(r)
+	accountID, err := uuid.Parse(id)
+	if err != nil || secret == "" {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	account, err := loadServiceAccount(db, accountID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load service account %s: %v\n", accountID, err)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(account.SecretHash)) != 1 || !account.IsActive {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	accessToken, err := auth.GenerateServiceAccountToken(account.ID, account.Name)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue token")
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE "service_accounts" SET last_token_at = CURRENT_TIMESTAMP WHERE user_id = $1`, account.ID); err != nil {
+		log.Printf("Failed to update last_token_at of service account %s: %v\n", account.ID, err)
+	}
+
+	audit.Record(db, "SERVICE_ACCOUNT_TOKEN_ISSUED", &account.ID, map[string]interface{}{
+		"actor_type": models.PrincipalTypeServiceAccount,
+		"org_id":     account.OrgID,
+		"ip_address": middleware.ClientIP(r),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(auth.AccessTokenTTL().Seconds()),
+	})
+}
+
+// GetServiceAccounts lists service accounts, optionally filtered by ?org_id=
+func GetServiceAccounts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := `SELECT ` + serviceAccountColumns + ` ` + serviceAccountFrom
+		var args []interface{}
+		if v := r.URL.Query().Get("org_id"); v != "" {
+			orgID, err := uuid.Parse(v)
+			if err != nil {
+				writeErrorResponse(w, "Invalid organization ID format", http.StatusBadRequest, r)
+				return
+			}
+			query += ` WHERE sa.org_id = $1`
+			args = append(args, orgID)
+		}
+		query += ` ORDER BY u.username`
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer rows.Close()
+
+		accounts := []models.ServiceAccount{}
+		for rows.Next() {
+			account, err := scanServiceAccount(rows)
+			if err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			accounts = append(accounts, account)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(accounts)
+	}
+}
+
+// GetServiceAccount retrieves a single service account
+func GetServiceAccount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid service account ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		account, err := loadServiceAccount(db, accountID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Service account not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(account)
+	}
+}
+
+// CreateServiceAccount creates a service account in an organization and returns
+// its client credentials. Roles given in role_ids are assigned within the
+// account's organization like GrantUserRole assigns them: it requires
+// assign_roles there and every permission of the roles.
+func CreateServiceAccount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		var req CreateServiceAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+
+		req.Name = strings.ToLower(strings.TrimSpace(req.Name))
+		if !serviceAccountNamePattern.MatchString(req.Name) {
+			writeErrorResponse(w, "Name must be 3-50 characters of a-z, 0-9, '.', '_' or '-'", http.StatusBadRequest, r)
+			return
+		}
+		if req.OrgID == uuid.Nil {
+			writeErrorResponse(w, "org_id is required", http.StatusBadRequest, r)
+			return
+		}
+
+		exists, err := organizationExists(db, req.OrgID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "Organization not found", http.StatusNotFound, r)
+			return
+		}
+
+		if len(req.RoleIDs) > 0 && !checkAssignRoles(db, w, r, &req.OrgID) {
+			return
+		}
+		roleIDs := make([]uuid.UUID, 0, len(req.RoleIDs))
+		requested := make(map[uuid.UUID]bool, len(req.RoleIDs))
+		for _, roleID := range req.RoleIDs {
+			if requested[roleID] {
+				continue
+			}
+			requested[roleID] = true
+			if _, err := loadRole(db, roleID); err != nil {
+				if err == sql.ErrNoRows {
+					writeErrorResponse(w, "Role not found: "+roleID.String(), http.StatusBadRequest, r)
+					return
+				}
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			missing, err := missingRolePermissions(db, r, roleID, &req.OrgID)
+			if err != nil {
+				writeErrorResponse(w, "Failed to compare permissions: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if len(missing) > 0 {
+				writeErrorResponse(w, "Cannot grant a role with permissions you do not hold: "+strings.Join(missing, ", "), http.StatusForbidden, r)
+				return
+			}
+			roleIDs = append(roleIDs, roleID)
+		}
+
+		secret, err := auth.GenerateOpaqueToken()
+		if err != nil {
+			writeErrorResponse(w, "Failed to generate client secret", http.StatusInternalServerError, r)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer tx.Rollback()
+
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM "users" WHERE username = $1)`, req.Name).Scan(&taken); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if taken {
+			writeErrorResponse(w, "A user or service account with this name already exists", http.StatusConflict, r)
+			return
+		}
+
+		// Service accounts have no password and nothing to verify; the placeholder
+		// email keeps them out of every email based flow
+		accountID := uuid.New()
+		if _, err := tx.Exec(`INSERT INTO "users" (id, username, password_hash, email, is_active, status, principal_type, created_at, updated_at)
+			VALUES ($1, $2, '', $3, true, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+			accountID, req.Name, req.Name+"@"+serviceAccountEmailDomain, models.UserStatusActive, models.PrincipalTypeServiceAccount); err != nil {
+			writeErrorResponse(w, "Failed to create service account: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if _, err := tx.Exec(`INSERT INTO "service_accounts" (user_id, org_id, description, secret_hash, created_by, created_at, updated_at)
+			VALUES ($1, $2, NULLIF($3, ''), $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+			accountID, req.OrgID, strings.TrimSpace(req.Description), auth.HashToken(secret), actor.ID); err != nil {
+			writeErrorResponse(w, "Failed to create service account: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if _, err := tx.Exec(`INSERT INTO "user_organizations" (id, user_id, org_id, invited_by, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+			uuid.New(), accountID, req.OrgID, actor.ID); err != nil {
+			writeErrorResponse(w, "Failed to add service account to organization: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if err := lockSeparationOfDuties(tx, &accountID); err != nil {
+			writeErrorResponse(w, "Failed to check separation of duties: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		for _, roleID := range roleIDs {
+			if _, err := insertRoleAssignment(tx, accountID, roleID, models.RoleScopeOrg, &req.OrgID, nil, nil, nil); err != nil {
+				writeErrorResponse(w, "Failed to assign role: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+		}
+		if !checkSeparationOfDuties(tx, w, r, &accountID, nil) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		account, err := loadServiceAccount(db, accountID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "SERVICE_ACCOUNT_CREATED", map[string]interface{}{
+			"service_account_id": account.ID,
+			"name":               account.Name,
+			"org_id":             account.OrgID,
+			"role_ids":           roleIDs,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ServiceAccountCredentials{
+			ServiceAccount: account,
+			ClientID:       account.ID.String(),
+			ClientSecret:   secret,
+		})
+	}
+}
+
+// UpdateServiceAccount changes the description of a service account or
+// (de)activates it. Deactivating also invalidates every token already issued.
+func UpdateServiceAccount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid service account ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		var req UpdateServiceAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+
+		before, err := loadServiceAccount(db, accountID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Service account not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		if req.Description != nil {
+			if _, err := db.Exec(`UPDATE "service_accounts" SET description = NULLIF($1, ''), updated_at = CURRENT_TIMESTAMP WHERE user_id = $2`,
+				strings.TrimSpace(*req.Description), accountID); err != nil {
+				writeErrorResponse(w, "Failed to update service account: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+		}
+		if req.IsActive != nil && *req.IsActive != before.IsActive {
+			if _, err := db.Exec(`UPDATE "users" SET is_active = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, *req.IsActive, accountID); err != nil {
+				writeErrorResponse(w, "Failed to update service account: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if !*req.IsActive {
+				if err := auth.RevokeAllUserTokens(db, accountID); err != nil {
+					log.Printf("auth: failed to revoke tokens of service account %s: %v\n", accountID, err)
+				}
+			}
+		}
+
+		account, err := loadServiceAccount(db, accountID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "SERVICE_ACCOUNT_UPDATED", map[string]interface{}{
+			"service_account_id": account.ID,
+			"before":             before,
+			"after":              account,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(account)
+	}
+}
+
+// RotateServiceAccountSecret replaces the client secret of a service account.
+// Tokens issued with the old secret stay valid until they expire.
+func RotateServiceAccountSecret(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid service account ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		secret, err := auth.GenerateOpaqueToken()
+		if err != nil {
+			writeErrorResponse(w, "Failed to generate client secret", http.StatusInternalServerError, r)
+			return
+		}
+
+		res, err := db.Exec(`UPDATE "service_accounts" SET secret_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE user_id = $2`,
+			auth.HashToken(secret), accountID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to rotate secret: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeErrorResponse(w, "Service account not found", http.StatusNotFound, r)
+			return
+		}
+
+		account, err := loadServiceAccount(db, accountID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "SERVICE_ACCOUNT_SECRET_ROTATED", map[string]interface{}{
+			"service_account_id": account.ID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ServiceAccountCredentials{
+			ServiceAccount: account,
+			ClientID:       account.ID.String(),
+			ClientSecret:   secret,
+		})
+	}
+}
+
+// DeleteServiceAccount deactivates a service account and revokes its tokens.
+// Like users, the row is kept so audit entries still resolve to it.
+func DeleteServiceAccount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid service account ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		account, err := loadServiceAccount(db, accountID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Service account not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		if _, err := db.Exec(`UPDATE "users" SET is_active = false, updated_at = CURRENT_TIMESTAMP WHERE id = $1`, accountID); err != nil {
+			writeErrorResponse(w, "Failed to delete service account: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if err := auth.RevokeAllUserTokens(db, accountID); err != nil {
+			log.Printf("auth: failed to revoke tokens of service account %s: %v\n", accountID, err)
+		}
+
+		setAuditHeaders(w, r, "SERVICE_ACCOUNT_DELETED", map[string]interface{}{
+			"service_account_id": account.ID,
+			"name":               account.Name,
+			"org_id":             account.OrgID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Service account deleted",
+		})
+	}
+}
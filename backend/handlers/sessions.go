@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"pillow/audit"
+	"pillow/auth"
+	"pillow/middleware"
+	"pillow/models"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// RefreshTokenRequest represents the token refresh request payload
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken rotates a refresh token and issues a new access token.
+// Each refresh token can be used exactly once; replaying an old one revokes
+// the whole session family.
+func RefreshToken(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RefreshTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest, r)
+			return
+		}
+
+		if req.RefreshToken == "" {
+			writeErrorResponse(w, "Refresh token required", http.StatusBadRequest, r)
+			return
+		}
+
+		session, refreshToken, err := auth.RotateSession(db, req.RefreshToken, r.UserAgent(), middleware.ClientIP(r))
+		if err != nil {
+			switch err {
+			case auth.ErrRefreshTokenReused:
+				audit.Record(db, "REFRESH_TOKEN_REUSED", &session.UserID, map[string]interface{}{
+					"family_id":  session.FamilyID,
+					"session_id": session.ID,
+					"ip_address": middleware.ClientIP(r),
+					"user_agent": r.UserAgent(),
+				})
+				writeErrorResponse(w, "Invalid refresh token", http.StatusUnauthorized, r)
+			case auth.ErrInvalidRefreshToken, auth.ErrRefreshTokenExpired:
+				writeErrorResponse(w, "Invalid or expired refresh token", http.StatusUnauthorized, r)
+			default:
+				writeErrorResponse(w, "Failed to refresh session", http.StatusInternalServerError, r)
+			}
+			return
+		}
+
+		// Make sure the user still exists and is active before issuing new tokens
+		var user models.User
+		err = db.QueryRow("SELECT id, username, email, is_active, created_at, updated_at FROM \"users\" WHERE id = $1",
+			session.UserID).Scan(&user.ID, &user.Username, &user.Email, &user.IsActive, &user.CreatedAt, &user.UpdatedAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "User not found", http.StatusUnauthorized, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		if !user.IsActive {
+			auth.RevokeSessionFamily(db, session.FamilyID)
+			writeErrorResponse(w, "Account is deactivated", http.StatusUnauthorized, r)
+			return
+		}
+
+		token, err := auth.GenerateJWT(user.ID, user.Username, session.FamilyID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to generate token", http.StatusInternalServerError, r)
+			return
+		}
+
+		response := LoginResponse{
+			Token:        token,
+			RefreshToken: refreshToken,
+			TokenType:    "Bearer",
+			ExpiresIn:    int64(auth.AccessTokenTTL().Seconds()),
+			User:         user,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Logout revokes the access token used for the request and the refresh token
+// session it belongs to. Impersonation tokens have no session; revoking the
+// token ends the impersonation.
+func Logout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.GetUserFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "User not found in context", http.StatusUnauthorized, r)
+			return
+		}
+		if _, ok := middleware.GetAPIKeyFromContext(r.Context()); ok {
+			writeErrorResponse(w, "API keys cannot log out; revoke the key instead", http.StatusForbidden, r)
+			return
+		}
+		claims, ok := middleware.GetClaimsFromContext(r.Context())
+		if !ok {
+			writeErrorResponse(w, "Token claims not found in context", http.StatusUnauthorized, r)
+			return
+		}
+
+		if claims.ID != "" {
+			expiresAt := time.Now().Add(auth.AccessTokenTTL())
+			if claims.ExpiresAt != nil {
+				expiresAt = claims.ExpiresAt.Time
+			}
+			if err := auth.RevokeToken(db, claims.ID, user.ID, expiresAt); err != nil {
+				writeErrorResponse(w, "Failed to revoke token: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+		}
+
+		if claims.SessionID != nil {
+			if err := auth.RevokeSessionFamily(db, *claims.SessionID); err != nil {
+				writeErrorResponse(w, "Failed to revoke session: "+err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+		}
+
+		details := map[string]interface{}{
+			"jti":        claims.ID,
+			"session_id": claims.SessionID,
+			"action": map[string]interface{}{
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"actor_id":   user.ID.String(),
+				"ip_address": middleware.ClientIP(r),
+			},
+		}
+		detBytes, _ := json.Marshal(details)
+		w.Header().Set("X-Audit-Action", "USER_LOGGED_OUT")
+		w.Header().Set("X-Audit-Details", string(detBytes))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Logged out successfully",
+		})
+	}
+}
+
+// RevokeUserTokens invalidates every access token and refresh token session of a user
+func RevokeUserTokens(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		idStr := vars["id"]
+
+		userID, err := uuid.Parse(idStr)
+		if err != nil {
+			writeErrorResponse(w, "Invalid user ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		var user models.User
+		err = db.QueryRow("SELECT id, username, email FROM \"users\" WHERE id = $1",
+			userID).Scan(&user.ID, &user.Username, &user.Email)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "User not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		if err := auth.RevokeAllUserTokens(db, userID); err != nil {
+			writeErrorResponse(w, "Failed to revoke tokens: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		actionObj := map[string]interface{}{
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"actor_id":   nil,
+			"ip_address": middleware.ClientIP(r),
+		}
+		if actor, ok := middleware.GetUserFromContext(r.Context()); ok && actor != nil {
+			actionObj["actor_id"] = actor.ID.String()
+		}
+		details := map[string]interface{}{
+			"target_user": map[string]interface{}{
+				"id":       user.ID,
+				"username": user.Username,
+				"email":    user.Email,
+			},
+			"action": actionObj,
+		}
+		detBytes, _ := json.Marshal(details)
+		w.Header().Set("X-Audit-Action", "USER_TOKENS_REVOKED")
+		w.Header().Set("X-Audit-Details", string(detBytes))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "All tokens revoked for user",
+			"user_id": userID,
+		})
+	}
+}
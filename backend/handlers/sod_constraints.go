@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"pillow/models"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// SoDConstraintRequest represents the request payload for creating or
+// replacing a separation-of-duties constraint
+type SoDConstraintRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+const sodConstraintColumns = `id, name, COALESCE(description, ''), permissions, created_at, updated_at`
+
+// scanSoDConstraint scans a row selected with sodConstraintColumns
+func scanSoDConstraint(row interface{ Scan(...interface{}) error }) (models.SoDConstraint, error) {
+	var c models.SoDConstraint
+	err := row.Scan(&c.ID, &c.Name, &c.Description, pq.Array(&c.Permissions), &c.CreatedAt, &c.UpdatedAt)
+	return c, err
+}
+
+// sodViolations lists the users holding more than one permission of a
+// constraint through role assignments that have not expired, including
+// assignments that only start later. Explicit denies do not count. A non-nil
+// userID restricts the result to that user. q can be a transaction, to check a
+// change before it is committed.
+func sodViolations(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, userID *uuid.UUID) ([]models.SoDViolation, error) {
+	rows, err := q.Query(`WITH held AS (
+			SELECT DISTINCT ur.user_id, p.name
+			FROM "user_roles" ur
+			INNER JOIN "role_ancestry" ra ON ra.role_id = ur.role_id
+			INNER JOIN "role_permissions" rp ON rp.role_id = ra.ancestor_id
+			INNER JOIN "permissions" p ON p.id = rp.permission_id
+			WHERE (ur.valid_until IS NULL OR ur.valid_until > NOW())
+			AND ($1::uuid IS NULL OR ur.user_id = $1)
+		)
+		SELECT c.id, c.name, h.user_id, u.username, array_agg(h.name ORDER BY h.name)
+		FROM "sod_constraints" c
+		INNER JOIN held h ON h.name = ANY(c.permissions)
+		INNER JOIN "users" u ON u.id = h.user_id
+		GROUP BY c.id, c.name, h.user_id, u.username
+		HAVING COUNT(*) > 1
+		ORDER BY c.name, u.username`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	violations := []models.SoDViolation{}
+	for rows.Next() {
+		var v models.SoDViolation
+		if err := rows.Scan(&v.ConstraintID, &v.ConstraintName, &v.UserID, &v.Username, pq.Array(&v.Permissions)); err != nil {
+			return nil, err
+		}
+		violations = append(violations, v)
+	}
+	return violations, rows.Err()
+}
+
+// sodViolationKey identifies a violation together with the permissions involved
+func sodViolationKey(v models.SoDViolation) string {
+	return v.ConstraintID.String() + "/" + v.UserID.String() + "/" + strings.Join(v.Permissions, ",")
+}
+
+// sodLockID is the Postgres advisory lock serializing the changes checked for
+// separation-of-duties violations. Changes to what roles grant take it
+// exclusively; changes to a user's roles share it and lock the user's row, so
+// two concurrent changes cannot each pass the check and together violate a
+// constraint.
+const sodLockID = 7_146_530_002
+
+// lockedSoDViolations takes the locks for a change to userID's roles, or to
+// what roles grant when userID is nil, and returns the violations before the
+// change, for checkSeparationOfDuties
+func lockedSoDViolations(tx *sql.Tx, userID *uuid.UUID) ([]models.SoDViolation, error) {
+	if err := lockSeparationOfDuties(tx, userID); err != nil {
+		return nil, err
+	}
+	return sodViolations(tx, userID)
+}
+
+// lockSeparationOfDuties takes the locks of lockedSoDViolations
+func lockSeparationOfDuties(tx *sql.Tx, userID *uuid.UUID) error {
+	if userID == nil {
+		_, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, sodLockID)
+		return err
+	}
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock_shared($1)`, sodLockID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`SELECT id FROM "users" WHERE id = $1 FOR UPDATE`, *userID)
+	return err
+}
+
+// checkSeparationOfDuties writes a 409 naming the violations and returns false
+// when a change made in tx introduces a separation-of-duties violation, i.e.
+// one not in before, the violations read in tx ahead of the change. Violations
+// that existed before, e.g. when a constraint was added, do not block
+// unrelated changes. userID restricts the check to the user whose roles
+// changed; nil checks every user, for changes to what roles grant.
+func checkSeparationOfDuties(tx *sql.Tx, w http.ResponseWriter, r *http.Request, userID *uuid.UUID, before []models.SoDViolation) bool {
+	after, err := sodViolations(tx, userID)
+	if err != nil {
+		writeErrorResponse(w, "Failed to check separation of duties: "+err.Error(), http.StatusInternalServerError, r)
+		return false
+	}
+
+	existing := make(map[string]bool, len(before))
+	for _, v := range before {
+		existing[sodViolationKey(v)] = true
+	}
+	msgs := []string{}
+	for _, v := range after {
+		if !existing[sodViolationKey(v)] {
+			msgs = append(msgs, v.Username+" would hold "+strings.Join(v.Permissions, " and ")+" ("+v.ConstraintName+")")
+		}
+	}
+	if len(msgs) == 0 {
+		return true
+	}
+	writeErrorResponse(w, "Separation of duties violation: "+strings.Join(msgs, "; "), http.StatusConflict, r)
+	return false
+}
+
+// decodeSoDConstraintRequest decodes and validates a constraint payload,
+// writing an error response and returning false when it is not acceptable
+func decodeSoDConstraintRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) (SoDConstraintRequest, bool) {
+	var req SoDConstraintRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+		return req, false
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+	if req.Name == "" {
+		writeErrorResponse(w, "Constraint name is required", http.StatusBadRequest, r)
+		return req, false
+	}
+
+	seen := map[string]bool{}
+	permissions := []string{}
+	for _, p := range req.Permissions {
+		p = strings.TrimSpace(p)
+		if p != "" && !seen[p] {
+			seen[p] = true
+			permissions = append(permissions, p)
+		}
+	}
+	if len(permissions) < 2 {
+		writeErrorResponse(w, "At least two distinct permissions are required", http.StatusBadRequest, r)
+		return req, false
+	}
+	sort.Strings(permissions)
+	req.Permissions = permissions
+
+	var known int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM "permissions" WHERE name = ANY($1)`, pq.Array(permissions)).Scan(&known); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+		return req, false
+	}
+	if known != len(permissions) {
+		writeErrorResponse(w, "Permission not found", http.StatusBadRequest, r)
+		return req, false
+	}
+	return req, true
+}
+
+// sodConstraintFromRequest parses the id route variable and loads the
+// constraint, writing an error response and returning false when that fails
+func sodConstraintFromRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) (models.SoDConstraint, bool) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		writeErrorResponse(w, "Invalid constraint ID format", http.StatusBadRequest, r)
+		return models.SoDConstraint{}, false
+	}
+	c, err := scanSoDConstraint(db.QueryRow(`SELECT `+sodConstraintColumns+` FROM "sod_constraints" WHERE id = $1`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeErrorResponse(w, "Constraint not found", http.StatusNotFound, r)
+			return c, false
+		}
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+		return c, false
+	}
+	return c, true
+}
+
+// sodConstraintNameTaken reports whether another constraint than exceptID is
+// named name
+func sodConstraintNameTaken(db *sql.DB, name string, exceptID uuid.UUID) (bool, error) {
+	var taken bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "sod_constraints" WHERE name = $1 AND id <> $2)`, name, exceptID).Scan(&taken)
+	return taken, err
+}
+
+// GetSoDConstraints lists all separation-of-duties constraints
+func GetSoDConstraints(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`SELECT ` + sodConstraintColumns + ` FROM "sod_constraints" ORDER BY name`)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer rows.Close()
+
+		constraints := []models.SoDConstraint{}
+		for rows.Next() {
+			c, err := scanSoDConstraint(rows)
+			if err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			constraints = append(constraints, c)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(constraints)
+	}
+}
+
+// GetSoDConstraint retrieves a single separation-of-duties constraint
+func GetSoDConstraint(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := sodConstraintFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// CreateSoDConstraint creates a separation-of-duties constraint. Existing
+// violations do not prevent it; they show up in GetSoDViolations and block
+// further changes that keep them.
+func CreateSoDConstraint(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeSoDConstraintRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		taken, err := sodConstraintNameTaken(db, req.Name, uuid.Nil)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if taken {
+			writeErrorResponse(w, "Constraint with this name already exists", http.StatusConflict, r)
+			return
+		}
+
+		c, err := scanSoDConstraint(db.QueryRow(`INSERT INTO "sod_constraints" (id, name, description, permissions, created_at, updated_at)
+			VALUES ($1, $2, NULLIF($3, ''), $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			RETURNING `+sodConstraintColumns,
+			uuid.New(), req.Name, req.Description, pq.Array(req.Permissions)))
+		if err != nil {
+			writeErrorResponse(w, "Failed to create constraint: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "SOD_CONSTRAINT_CREATED", map[string]interface{}{
+			"constraint_after": c,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":    "Constraint created successfully",
+			"constraint": c,
+		})
+	}
+}
+
+// UpdateSoDConstraint replaces a separation-of-duties constraint
+func UpdateSoDConstraint(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		before, ok := sodConstraintFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		req, ok := decodeSoDConstraintRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		taken, err := sodConstraintNameTaken(db, req.Name, before.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if taken {
+			writeErrorResponse(w, "Constraint with this name already exists", http.StatusConflict, r)
+			return
+		}
+
+		after, err := scanSoDConstraint(db.QueryRow(`UPDATE "sod_constraints"
+			SET name = $2, description = NULLIF($3, ''), permissions = $4, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 RETURNING `+sodConstraintColumns,
+			before.ID, req.Name, req.Description, pq.Array(req.Permissions)))
+		if err != nil {
+			writeErrorResponse(w, "Failed to update constraint: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "SOD_CONSTRAINT_UPDATED", map[string]interface{}{
+			"constraint_before": before,
+			"constraint_after":  after,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":    "Constraint updated successfully",
+			"constraint": after,
+		})
+	}
+}
+
+// DeleteSoDConstraint deletes a separation-of-duties constraint
+func DeleteSoDConstraint(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := sodConstraintFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		if _, err := db.Exec(`DELETE FROM "sod_constraints" WHERE id = $1`, c.ID); err != nil {
+			writeErrorResponse(w, "Failed to delete constraint: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "SOD_CONSTRAINT_DELETED", map[string]interface{}{
+			"constraint_before": c,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Constraint deleted successfully",
+			"id":      c.ID,
+		})
+	}
+}
+
+// GetSoDViolations reports every user currently violating a separation-of-duties
+// constraint, with the conflicting permissions they hold
+func GetSoDViolations(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		violations, err := sodViolations(db, nil)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(violations)
+	}
+}
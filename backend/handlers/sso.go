@@ -0,0 +1,420 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"pillow/audit"
+	"pillow/auth"
+	"pillow/config"
+	"pillow/models"
+	"pillow/sso"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// ssoStateCookie binds a federated login to the browser that started it
+	ssoStateCookie = "pillow_sso_state"
+	// ssoDefaultReturnTo is where the frontend lands after SSO without a return_to
+	ssoDefaultReturnTo = "/dashboard"
+)
+
+var (
+	errSSONoAccount         = errors.New("no pillow account is linked to this identity")
+	errSSOEmailNotVerified  = errors.New("the identity provider did not return a verified email address")
+	errSSOAccountUnverified = errors.New("verify your pillow account's email address before signing in with SSO")
+	errSSOUsernameExhausted = errors.New("could not allocate a username")
+)
+
+var ssoUsernameInvalidChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// SSOProviderResponse describes a provider users can sign in with
+type SSOProviderResponse struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	LoginURL string `json:"login_url"`
+}
+
+// SSOTokenRequest represents the request payload for redeeming a federated login code
+type SSOTokenRequest struct {
+	Code string `json:"code"`
+}
+
+// ssoRedirectURI is the callback URL registered at the upstream provider
+func ssoRedirectURI(provider *sso.Provider) string {
+	return auth.OIDCIssuer() + "/api/sso/" + provider.ID + "/callback"
+}
+
+// safeReturnTo only accepts local paths so the login flow can't be used as an open redirect
+func safeReturnTo(v string) string {
+	if !strings.HasPrefix(v, "/") || strings.HasPrefix(v, "//") || strings.Contains(v, "\\") {
+		return ssoDefaultReturnTo
+	}
+	return v
+}
+
+// redirectSSOError sends the user back to the frontend login page with an error
+func redirectSSOError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, frontendURL()+"/login?sso_error="+url.QueryEscape(message), http.StatusFound)
+}
+
+// GetSSOProviders lists the configured upstream identity providers
+func GetSSOProviders(registry *sso.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		providers := []SSOProviderResponse{}
+		for _, p := range registry.List() {
+			providers = append(providers, SSOProviderResponse{
+				ID:       p.ID,
+				Name:     p.Name,
+				LoginURL: "/api/sso/" + p.ID + "/login",
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(providers)
+	}
+}
+
+// SSOLogin starts a federated login by redirecting to the upstream provider.
+// State, nonce and PKCE verifier are kept server side; the state is also set
+// as a cookie so the callback only completes in the browser that started it.
+func SSOLogin(db *sql.DB, registry *sso.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := registry.Get(mux.Vars(r)["provider"])
+		if !ok {
+			writeErrorResponse(w, "Unknown identity provider", http.StatusNotFound, r)
+			return
+		}
+
+		var secrets [3]string
+		for i := range secrets {
+			v, err := auth.GenerateOpaqueToken()
+			if err != nil {
+				writeErrorResponse(w, "Failed to start login", http.StatusInternalServerError, r)
+				return
+			}
+			secrets[i] = v
+		}
+		state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+
+		ttl := config.Duration("SSO_LOGIN_TTL", 10*time.Minute)
+		_, err := db.Exec(`INSERT INTO "sso_logins" (id, provider, state_hash, nonce, code_verifier, return_to, expires_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP)`,
+			uuid.New(), provider.ID, auth.HashToken(state), nonce, verifier, safeReturnTo(r.URL.Query().Get("return_to")), time.Now().Add(ttl))
+		if err != nil {
+			writeErrorResponse(w, "Failed to start login", http.StatusInternalServerError, r)
+			return
+		}
+
+		location, err := provider.AuthCodeURL(r.Context(), ssoRedirectURI(provider), state, nonce, auth.PKCEChallenge(verifier))
+		if err != nil {
+			log.Printf("sso: provider %s unavailable: %v\n", provider.ID, err)
+			writeErrorResponse(w, "Identity provider unavailable", http.StatusBadGateway, r)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     ssoStateCookie,
+			Value:    state,
+			Path:     "/api/sso/",
+			MaxAge:   int(ttl.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, location, http.StatusFound)
+	}
+}
+
+// SSOCallback handles the redirect back from the upstream provider. It verifies
+// the ID token, resolves the pillow user and sends the browser to the frontend
+// with a short-lived login code that SSOToken exchanges for pillow tokens.
+func SSOCallback(db *sql.DB, registry *sso.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := registry.Get(mux.Vars(r)["provider"])
+		if !ok {
+			writeErrorResponse(w, "Unknown identity provider", http.StatusNotFound, r)
+			return
+		}
+
+		q := r.URL.Query()
+		http.SetCookie(w, &http.Cookie{Name: ssoStateCookie, Value: "", Path: "/api/sso/", MaxAge: -1, HttpOnly: true})
+
+		if e := q.Get("error"); e != "" {
+			redirectSSOError(w, r, "Sign-in was cancelled or denied by the identity provider")
+			return
+		}
+
+		state := q.Get("state")
+		cookie, err := r.Cookie(ssoStateCookie)
+		if state == "" || err != nil || cookie.Value != state {
+			redirectSSOError(w, r, "Login session expired, please try again")
+			return
+		}
+
+		// Consume the state so the callback can only complete once
+		var loginID uuid.UUID
+		var nonce, verifier, returnTo string
+		var expiresAt time.Time
+		err = db.QueryRow(`UPDATE "sso_logins" SET state_hash = NULL
+			WHERE state_hash = $1 AND provider = $2
+			RETURNING id, nonce, code_verifier, return_to, expires_at`,
+			auth.HashToken(state), provider.ID).Scan(&loginID, &nonce, &verifier, &returnTo, &expiresAt)
+		if err != nil || time.Now().After(expiresAt) {
+			redirectSSOError(w, r, "Login session expired, please try again")
+			return
+		}
+
+		identity, err := provider.Exchange(r.Context(), q.Get("code"), ssoRedirectURI(provider), verifier, nonce)
+		if err != nil {
+			log.Printf("sso: login through %s failed: %v\n", provider.ID, err)
+			redirectSSOError(w, r, "Sign-in with the identity provider failed")
+			return
+		}
+
+		user, err := resolveFederatedUser(db, r, provider, identity)
+		if err != nil {
+			switch err {
+			case errSSONoAccount, errSSOEmailNotVerified, errSSOAccountUnverified:
+				redirectSSOError(w, r, err.Error())
+			default:
+				log.Printf("sso: failed to resolve user for %s: %v\n", provider.ID, err)
+				redirectSSOError(w, r, "Sign-in failed")
+			}
+			return
+		}
+		if !user.IsActive {
+			redirectSSOError(w, r, "Account is deactivated")
+			return
+		}
+
+		loginCode, err := auth.GenerateOpaqueToken()
+		if err != nil {
+			redirectSSOError(w, r, "Sign-in failed")
+			return
+		}
+		_, err = db.Exec(`UPDATE "sso_logins" SET user_id = $1, login_code_hash = $2, expires_at = $3 WHERE id = $4`,
+			user.ID, auth.HashToken(loginCode), time.Now().Add(time.Minute), loginID)
+		if err != nil {
+			redirectSSOError(w, r, "Sign-in failed")
+			return
+		}
+
+		http.Redirect(w, r, frontendURL()+"/sso/callback?code="+url.QueryEscape(loginCode)+"&return_to="+url.QueryEscape(returnTo), http.StatusFound)
+	}
+}
+
+// SSOToken exchanges the login code from SSOCallback for pillow tokens. The
+// response has the same shape as /api/login, including the MFA challenge for
+// users who enabled MFA.
+func SSOToken(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SSOTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+			writeErrorResponse(w, "Login code is required", http.StatusBadRequest, r)
+			return
+		}
+
+		var userID uuid.UUID
+		var provider string
+		err := db.QueryRow(`UPDATE "sso_logins" SET login_code_hash = NULL, completed_at = CURRENT_TIMESTAMP
+			WHERE login_code_hash = $1 AND expires_at > $2
+			RETURNING user_id, provider`, auth.HashToken(req.Code), time.Now()).Scan(&userID, &provider)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Invalid or expired login code", http.StatusUnauthorized, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		var user models.User
+		err = db.QueryRow(`SELECT id, username, email, is_active, status, created_at, updated_at FROM "users" WHERE id = $1`, userID).
+			Scan(&user.ID, &user.Username, &user.Email, &user.IsActive, &user.Status, &user.CreatedAt, &user.UpdatedAt)
+		if err != nil {
+			writeErrorResponse(w, "Invalid or expired login code", http.StatusUnauthorized, r)
+			return
+		}
+		if !user.IsActive {
+			writeErrorResponse(w, "Account is deactivated", http.StatusUnauthorized, r)
+			return
+		}
+
+		audit.Record(db, "SSO_LOGIN", &user.ID, map[string]interface{}{
+			"provider":   provider,
+			"ip_address": r.RemoteAddr,
+			"user_agent": r.UserAgent(),
+		})
+
+		completeLogin(db, w, r, user)
+	}
+}
+
+// resolveFederatedUser finds the pillow user for a verified upstream identity.
+// Known identities map straight to their user. Otherwise the identity is linked
+// to the user with the same verified email, or, if the provider allows it, a new
+// user is provisioned.
+func resolveFederatedUser(db *sql.DB, r *http.Request, provider *sso.Provider, identity *sso.Identity) (models.User, error) {
+	var user models.User
+	err := db.QueryRow(`UPDATE "user_identities" i SET last_login_at = CURRENT_TIMESTAMP
+		FROM "users" u WHERE u.id = i.user_id AND i.provider = $1 AND i.subject = $2
+		RETURNING u.id, u.username, u.email, u.is_active, u.status`, provider.ID, identity.Subject).
+		Scan(&user.ID, &user.Username, &user.Email, &user.IsActive, &user.Status)
+	if err == nil {
+		return user, nil
+	}
+	if err != sql.ErrNoRows {
+		return user, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return user, errSSOEmailNotVerified
+	}
+
+	err = db.QueryRow(`SELECT id, username, email, is_active, status FROM "users" WHERE LOWER(email) = $1`, identity.Email).
+		Scan(&user.ID, &user.Username, &user.Email, &user.IsActive, &user.Status)
+	if err == nil {
+		// Only link to accounts that proved ownership of the address themselves,
+		// otherwise a pending registration could capture someone else's SSO login
+		if user.Status == models.UserStatusPendingVerification {
+			return user, errSSOAccountUnverified
+		}
+		if err := linkIdentity(db, user.ID, provider.ID, identity); err != nil {
+			return user, err
+		}
+		audit.Record(db, "SSO_IDENTITY_LINKED", &user.ID, map[string]interface{}{
+			"provider":   provider.ID,
+			"subject":    identity.Subject,
+			"ip_address": r.RemoteAddr,
+		})
+		return user, nil
+	}
+	if err != sql.ErrNoRows {
+		return user, err
+	}
+
+	if !provider.AutoProvision {
+		return user, errSSONoAccount
+	}
+	return provisionFederatedUser(db, r, provider, identity)
+}
+
+// linkIdentity records that identity belongs to userID
+func linkIdentity(db interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, userID uuid.UUID, provider string, identity *sso.Identity) error {
+	_, err := db.Exec(`INSERT INTO "user_identities" (id, user_id, provider, subject, email, created_at, last_login_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+		uuid.New(), userID, provider, identity.Subject, identity.Email)
+	return err
+}
+
+// provisionFederatedUser creates an active, password-less account for a new
+// federated user and, when enabled for the provider, adds it to the
+// organization whose domain matches the email domain
+func provisionFederatedUser(db *sql.DB, r *http.Request, provider *sso.Provider, identity *sso.Identity) (models.User, error) {
+	user := models.User{
+		ID:       uuid.New(),
+		Email:    identity.Email,
+		IsActive: true,
+		Status:   models.UserStatusActive,
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	user.Username, err = allocateUsername(tx, identity)
+	if err != nil {
+		return user, err
+	}
+
+	// An empty password hash never matches, so the account can only sign in through SSO
+	// until the user sets a password via the reset flow
+	_, err = tx.Exec(`INSERT INTO "users" (id, username, password_hash, email, is_active, status, email_verified_at, created_at, updated_at)
+		VALUES ($1, $2, '', $3, true, $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+		user.ID, user.Username, user.Email, user.Status)
+	if err != nil {
+		return user, err
+	}
+	if err := linkIdentity(tx, user.ID, provider.ID, identity); err != nil {
+		return user, err
+	}
+
+	var orgID *uuid.UUID
+	if provider.ProvisionOrgByDomain {
+		domain := identity.Email[strings.LastIndex(identity.Email, "@")+1:]
+		var id uuid.UUID
+		err := tx.QueryRow(`SELECT id FROM "organizations" WHERE LOWER(domain) = $1 ORDER BY created_at LIMIT 1`, domain).Scan(&id)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO "user_organizations" (id, user_id, org_id, created_at, updated_at)
+				VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`, uuid.New(), user.ID, id)
+			if err != nil {
+				return user, err
+			}
+			orgID = &id
+		} else if err != sql.ErrNoRows {
+			return user, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return user, err
+	}
+
+	audit.Record(db, "SSO_USER_PROVISIONED", &user.ID, map[string]interface{}{
+		"provider":   provider.ID,
+		"subject":    identity.Subject,
+		"username":   user.Username,
+		"org_id":     orgID,
+		"ip_address": r.RemoteAddr,
+	})
+	return user, nil
+}
+
+// allocateUsername derives a free username from the identity's preferred
+// username or email local part, adding a numeric suffix on collision
+func allocateUsername(tx *sql.Tx, identity *sso.Identity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base = identity.Email[:strings.LastIndex(identity.Email, "@")]
+	}
+	base = strings.Trim(ssoUsernameInvalidChars.ReplaceAllString(strings.ToLower(base), ""), ".-_")
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 40 {
+		base = base[:40]
+	}
+
+	candidate := base
+	for attempt := 0; attempt < 10; attempt++ {
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM "users" WHERE username = $1)`, candidate).Scan(&taken); err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s%04d", base, n.Int64())
+	}
+	return "", errSSOUsernameExhausted
+}
@@ -0,0 +1,456 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"pillow/middleware"
+	"pillow/models"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// GrantRoleRequest represents the request payload for granting a role to a user.
+// Scope defaults to "organization" when OrgID is set and "system" otherwise. The
+// assignment only applies between ValidFrom and ValidUntil when they are set.
+type GrantRoleRequest struct {
+	RoleID     uuid.UUID  `json:"role_id"`
+	Scope      string     `json:"scope,omitempty"`
+	OrgID      *uuid.UUID `json:"org_id,omitempty"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+}
+
+// resolveRoleScope applies the default scope of an assignment and checks that
+// it agrees with orgID. It returns an error message when it does not.
+func resolveRoleScope(scope string, orgID *uuid.UUID) (string, string) {
+	scope = strings.TrimSpace(scope)
+	switch {
+	case scope == "" && orgID != nil:
+		scope = models.RoleScopeOrg
+	case scope == "":
+		scope = models.RoleScopeSystem
+	}
+	switch scope {
+	case models.RoleScopeSystem:
+		if orgID != nil {
+			return scope, "System-scope assignments cannot have an org_id"
+		}
+	case models.RoleScopeOrg:
+		if orgID == nil {
+			return scope, "Organization-scope assignments require org_id"
+		}
+	default:
+		return scope, "scope must be system or organization"
+	}
+	return scope, ""
+}
+
+// insertRoleAssignment assigns a role unless the user already has it in that
+// scope, which is reported as false. Expired assignments the sweeper has not
+// removed yet do not count. membershipID is the organization membership the
+// assignment belongs to, if any.
+func insertRoleAssignment(db interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, userID, roleID uuid.UUID, scope string, orgID *uuid.UUID, validFrom, validUntil *time.Time, membershipID *uuid.UUID) (bool, error) {
+	res, err := db.Exec(`INSERT INTO "user_roles" (user_id, role_id, scope, org_id, valid_from, valid_until, membership_id, created_at, updated_at)
+		SELECT $1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+		WHERE NOT EXISTS (SELECT 1 FROM "user_roles" WHERE user_id = $1 AND role_id = $2 AND org_id IS NOT DISTINCT FROM $4
+			AND (valid_until IS NULL OR valid_until > NOW()))`,
+		userID, roleID, scope, orgID, validFrom, validUntil, membershipID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// userExists reports whether a user with id exists
+func userExists(db *sql.DB, id uuid.UUID) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "users" WHERE id = $1)`, id).Scan(&exists)
+	return exists, err
+}
+
+// checkAssignRoles writes a 403 unless the caller holds assign_roles in the
+// scope of an assignment: globally for system assignments, in the organization
+// (or a parent) otherwise
+func checkAssignRoles(db *sql.DB, w http.ResponseWriter, r *http.Request, orgID *uuid.UUID) bool {
+	allowed, err := middleware.CheckPermission(db, r, "assign_roles", orgID)
+	if err != nil {
+		writeErrorResponse(w, "Error checking permissions", http.StatusInternalServerError, r)
+		return false
+	}
+	if !allowed {
+		writeErrorResponse(w, "Insufficient permissions", http.StatusForbidden, r)
+		return false
+	}
+	return true
+}
+
+// missingRolePermissions returns the permissions of roleID, including inherited
+// ones, that the caller does not hold in the scope of the assignment. Nobody can
+// hand out more than they have.
+func missingRolePermissions(db *sql.DB, r *http.Request, roleID uuid.UUID, orgID *uuid.UUID) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT p.name FROM "permissions" p
+		INNER JOIN "role_permissions" rp ON p.id = rp.permission_id
+		INNER JOIN "role_ancestry" ra ON rp.role_id = ra.ancestor_id
+		WHERE ra.role_id = $1 ORDER BY p.name`, roleID)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	for _, name := range names {
+		held, err := middleware.CheckPermission(db, r, name, orgID)
+		if err != nil {
+			return nil, err
+		}
+		if !held {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+// GetUserRoleAssignments lists the roles assigned to a user with their scope.
+// Users may list their own roles; other users' roles require view_roles.
+func GetUserRoleAssignments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid user ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		if actor, _ := middleware.GetUserFromContext(r.Context()); actor == nil || actor.ID != userID {
+			allowed, err := middleware.CheckPermission(db, r, "view_roles", nil)
+			if err != nil {
+				writeErrorResponse(w, "Error checking permissions", http.StatusInternalServerError, r)
+				return
+			}
+			if !allowed {
+				writeErrorResponse(w, "Insufficient permissions", http.StatusForbidden, r)
+				return
+			}
+		}
+
+		exists, err := userExists(db, userID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "User not found", http.StatusNotFound, r)
+			return
+		}
+
+		rows, err := db.Query(`SELECT r.id, r.name, COALESCE(r.description, ''), r.created_at, r.updated_at,
+				ur.scope, ur.org_id, ur.valid_from, ur.valid_until, COALESCE(ur.created_at, CURRENT_TIMESTAMP)
+			FROM "user_roles" ur INNER JOIN "roles" r ON r.id = ur.role_id
+			WHERE ur.user_id = $1 ORDER BY r.name, ur.org_id NULLS FIRST`, userID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer rows.Close()
+
+		assignments := []models.RoleAssignment{}
+		for rows.Next() {
+			a := models.RoleAssignment{UserID: userID}
+			if err := rows.Scan(&a.Role.ID, &a.Role.Name, &a.Role.Description, &a.Role.CreatedAt, &a.Role.UpdatedAt,
+				&a.Scope, &a.OrgID, &a.ValidFrom, &a.ValidUntil, &a.CreatedAt); err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			assignments = append(assignments, a)
+		}
+		if err := rows.Err(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"user_id": userID,
+			"roles":   assignments,
+		})
+	}
+}
+
+// GrantUserRole assigns a role to a user, system-wide or within an
+// organization, optionally only for a time window. It requires assign_roles in
+// that scope, and the caller must hold every permission the role (with its
+// parents) grants there.
+func GrantUserRole(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid user ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		var req GrantRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
+			return
+		}
+		if req.RoleID == uuid.Nil {
+			writeErrorResponse(w, "role_id is required", http.StatusBadRequest, r)
+			return
+		}
+
+		scope, msg := resolveRoleScope(req.Scope, req.OrgID)
+		if msg != "" {
+			writeErrorResponse(w, msg, http.StatusBadRequest, r)
+			return
+		}
+		if req.ValidUntil != nil {
+			if !req.ValidUntil.After(time.Now()) {
+				writeErrorResponse(w, "valid_until must be in the future", http.StatusBadRequest, r)
+				return
+			}
+			if req.ValidFrom != nil && !req.ValidUntil.After(*req.ValidFrom) {
+				writeErrorResponse(w, "valid_until must be after valid_from", http.StatusBadRequest, r)
+				return
+			}
+		}
+
+		if !checkAssignRoles(db, w, r, req.OrgID) {
+			return
+		}
+
+		exists, err := userExists(db, userID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !exists {
+			writeErrorResponse(w, "User not found", http.StatusNotFound, r)
+			return
+		}
+
+		role, err := loadRole(db, req.RoleID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeErrorResponse(w, "Role not found", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		if req.OrgID != nil {
+			exists, err := organizationExists(db, *req.OrgID)
+			if err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			if !exists {
+				writeErrorResponse(w, "Organization not found", http.StatusNotFound, r)
+				return
+			}
+		}
+
+		missing, err := missingRolePermissions(db, r, role.ID, req.OrgID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to compare permissions: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if len(missing) > 0 {
+			writeErrorResponse(w, "Cannot grant a role with permissions you do not hold: "+strings.Join(missing, ", "), http.StatusForbidden, r)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer tx.Rollback()
+
+		before, err := lockedSoDViolations(tx, &userID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to check separation of duties: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		inserted, err := insertRoleAssignment(tx, userID, role.ID, scope, req.OrgID, req.ValidFrom, req.ValidUntil, nil)
+		if err != nil {
+			writeErrorResponse(w, "Failed to grant role: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if !inserted {
+			writeErrorResponse(w, "User already has this role in this scope", http.StatusConflict, r)
+			return
+		}
+		if !checkSeparationOfDuties(tx, w, r, &userID, before) {
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "ROLE_GRANTED", map[string]interface{}{
+			"user_id":     userID,
+			"role_id":     role.ID,
+			"role_name":   role.Name,
+			"scope":       scope,
+			"org_id":      req.OrgID,
+			"valid_from":  req.ValidFrom,
+			"valid_until": req.ValidUntil,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":     "Role granted successfully",
+			"user_id":     userID,
+			"role_id":     role.ID,
+			"scope":       scope,
+			"org_id":      req.OrgID,
+			"valid_from":  req.ValidFrom,
+			"valid_until": req.ValidUntil,
+		})
+	}
+}
+
+// RevokeUserRole removes a role assignment from a user. The org_id query
+// parameter selects an organization-scope assignment; without it the
+// system-scope assignment is revoked. It requires assign_roles in that scope,
+// and as for granting, every permission the role grants there. A member's role
+// in an organization is changed through the membership instead, which is
+// answered with a 409.
+func RevokeUserRole(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID, err := uuid.Parse(vars["id"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid user ID format", http.StatusBadRequest, r)
+			return
+		}
+		roleID, err := uuid.Parse(vars["roleId"])
+		if err != nil {
+			writeErrorResponse(w, "Invalid role ID format", http.StatusBadRequest, r)
+			return
+		}
+
+		var orgID *uuid.UUID
+		if v := r.URL.Query().Get("org_id"); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil {
+				writeErrorResponse(w, "Invalid org_id format", http.StatusBadRequest, r)
+				return
+			}
+			orgID = &id
+		}
+
+		if !checkAssignRoles(db, w, r, orgID) {
+			return
+		}
+
+		missing, err := missingRolePermissions(db, r, roleID, orgID)
+		if err != nil {
+			writeErrorResponse(w, "Failed to compare permissions: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		if len(missing) > 0 {
+			writeErrorResponse(w, "Cannot revoke a role with permissions you do not hold: "+strings.Join(missing, ", "), http.StatusForbidden, r)
+			return
+		}
+
+		var scope string
+		err = db.QueryRow(`DELETE FROM "user_roles" WHERE user_id = $1 AND role_id = $2 AND org_id IS NOT DISTINCT FROM $3
+			AND membership_id IS NULL RETURNING scope`, userID, roleID, orgID).Scan(&scope)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				var membershipRole bool
+				if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "user_roles" WHERE user_id = $1 AND role_id = $2
+					AND org_id IS NOT DISTINCT FROM $3 AND membership_id IS NOT NULL)`, userID, roleID, orgID).Scan(&membershipRole); err != nil {
+					writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+					return
+				}
+				if membershipRole {
+					writeErrorResponse(w, "The role is the user's membership role in the organization; change it through /api/organizations/{id}/members", http.StatusConflict, r)
+					return
+				}
+				writeErrorResponse(w, "User does not have this role in this scope", http.StatusNotFound, r)
+				return
+			}
+			writeErrorResponse(w, "Failed to revoke role: "+err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		setAuditHeaders(w, r, "ROLE_REVOKED", map[string]interface{}{
+			"user_id": userID,
+			"role_id": roleID,
+			"scope":   scope,
+			"org_id":  orgID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Role revoked successfully",
+			"user_id": userID,
+			"role_id": roleID,
+			"org_id":  orgID,
+		})
+	}
+}
+
+// GetRoleUsers lists the users a role is assigned to, with the scope of each
+// assignment. Only direct assignments are listed, not users of inheriting roles.
+func GetRoleUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := roleFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Query(`SELECT u.id, u.username, u.email, ur.scope, ur.org_id, ur.valid_from, ur.valid_until,
+				COALESCE(ur.created_at, CURRENT_TIMESTAMP)
+			FROM "user_roles" ur INNER JOIN "users" u ON u.id = ur.user_id
+			WHERE ur.role_id = $1 ORDER BY u.username, ur.org_id NULLS FIRST`, role.ID)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+		defer rows.Close()
+
+		members := []models.RoleMember{}
+		for rows.Next() {
+			var m models.RoleMember
+			if err := rows.Scan(&m.UserID, &m.Username, &m.Email, &m.Scope, &m.OrgID, &m.ValidFrom, &m.ValidUntil, &m.CreatedAt); err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+				return
+			}
+			members = append(members, m)
+		}
+		if err := rows.Err(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"role":  role,
+			"users": members,
+		})
+	}
+}
@@ -3,8 +3,10 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"log"
 	"net/http"
 	"pillow/auth"
+	"pillow/mail"
 	"pillow/middleware"
 	"pillow/models"
 	"strconv"
@@ -17,7 +19,7 @@ import (
 
 func GetUsers(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT id, username, email, is_active, created_at, updated_at FROM \"users\" WHERE is_active = true")
+		rows, err := db.Query("SELECT id, username, email, is_active, created_at, updated_at FROM \"users\" WHERE is_active = true AND principal_type = 'user'")
 		if err != nil {
 			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
 			return
@@ -41,57 +43,77 @@ func GetUsers(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func CreateUser(db *sql.DB) http.HandlerFunc {
+// CreateUser registers a new account in the pending_verification state and emails
+// a verification link to the given address
+func CreateUser(db *sql.DB, mailer mail.Mailer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var user models.User
-		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		var req CreateUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeErrorResponse(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest, r)
 			return
 		}
+		if req.Password == "" {
+			req.Password = req.PasswordHash
+		}
 
-		// Debug: Log received data
-		// fmt.Printf("Received user data: Username=%s, Email=%s, PasswordHash=%s\n", user.Username, user.Email, user.PasswordHash)
-
-		if user.Username == "" {
+		if req.Username == "" {
 			writeErrorResponse(w, "Username is required", http.StatusBadRequest, r)
 			return
 		}
-		if user.Email == "" {
+		if req.Email == "" {
 			writeErrorResponse(w, "Email is required", http.StatusBadRequest, r)
 			return
 		}
-		if user.PasswordHash == "" {
-			writeErrorResponse(w, "Password is required", http.StatusBadRequest, r)
+		if !checkNewPassword(db, w, r, nil, "password", req.Password, req.Username, req.Email) {
 			return
 		}
 
 		// Hash the password using bcrypt
-		hashedPassword, err := auth.HashPassword(user.PasswordHash)
+		hashedPassword, err := auth.HashPassword(req.Password)
 		if err != nil {
 			writeErrorResponse(w, "Failed to hash password", http.StatusInternalServerError, r)
 			return
 		}
 
+		user := models.User{
+			Username: req.Username,
+			Email:    req.Email,
+		}
+
 		// Generate UUID for new user
 		user.ID = uuid.New()
 
-		// Set user as active by default
+		// New accounts stay pending until the email address is verified
 		user.IsActive = true
+		user.Status = models.UserStatusPendingVerification
 
-		err = db.QueryRow("INSERT INTO \"users\" (id, username, password_hash, email, is_active, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP) RETURNING id",
-			user.ID, user.Username, hashedPassword, user.Email, user.IsActive).Scan(&user.ID)
+		err = db.QueryRow("INSERT INTO \"users\" (id, username, password_hash, email, is_active, status, password_changed_at, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP) RETURNING id",
+			user.ID, user.Username, hashedPassword, user.Email, user.IsActive, user.Status).Scan(&user.ID)
 		if err != nil {
 			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
 			return
 		}
 
+		if err := sendVerificationEmail(db, mailer, user.ID, user.Username, user.Email); err != nil {
+			log.Printf("mail: failed to send verification email to user %s: %v\n", user.ID, err)
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]interface{}{"message": "User created", "user": user})
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "User created. Check your email to verify your account.", "user": user})
 
 	}
 }
 
+// CreateUserRequest represents the registration payload
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Deprecated: older clients send the plaintext password as password_hash
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
 // LoginRequest represents the login request payload
 type LoginRequest struct {
 	Identifier string `json:"identifier"` // Can be username or email
@@ -100,8 +122,11 @@ type LoginRequest struct {
 
 // LoginResponse represents the login response
 type LoginResponse struct {
-	Token string      `json:"token"`
-	User  models.User `json:"user"`
+	Token        string      `json:"token"`
+	RefreshToken string      `json:"refresh_token"`
+	TokenType    string      `json:"token_type"`
+	ExpiresIn    int64       `json:"expires_in"` // access token lifetime in seconds
+	User         models.User `json:"user"`
 }
 
 // UpdateUserRequest represents the update user request payload
@@ -126,18 +151,27 @@ func Login(db *sql.DB) http.HandlerFunc {
 
 		// Get user from database - check both username and email
 		var user models.User
-		err := db.QueryRow("SELECT id, username, password_hash, email, is_active, created_at, updated_at FROM \"users\" WHERE username = $1 OR email = $1",
-			loginReq.Identifier).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Email, &user.IsActive, &user.CreatedAt, &user.UpdatedAt)
+		err := db.QueryRow("SELECT id, username, password_hash, email, is_active, status, created_at, updated_at FROM \"users\" WHERE username = $1 OR email = $1",
+			loginReq.Identifier).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Email, &user.IsActive, &user.Status, &user.CreatedAt, &user.UpdatedAt)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
-				writeErrorResponse(w, "Invalid credentials", http.StatusUnauthorized, r)
+				// Unknown identifiers still count against the client IP
+				if checkLoginThrottle(db, w, r, nil) {
+					recordLoginFailure(db, r, nil, loginReq.Identifier, "unknown_user")
+					writeErrorResponse(w, "Invalid credentials", http.StatusUnauthorized, r)
+				}
 				return
 			}
 			writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
 			return
 		}
 
+		// Refuse attempts while the account or IP is delayed or locked, before the password is checked
+		if !checkLoginThrottle(db, w, r, &user.ID) {
+			return
+		}
+
 		// Check if user is active
 		if !user.IsActive {
 			writeErrorResponse(w, "Account is deactivated", http.StatusUnauthorized, r)
@@ -146,28 +180,90 @@ func Login(db *sql.DB) http.HandlerFunc {
 
 		// Verify password
 		if !auth.CheckPasswordHash(loginReq.Password, user.PasswordHash) {
+			recordLoginFailure(db, r, &user.ID, loginReq.Identifier, "invalid_password")
 			writeErrorResponse(w, "Invalid credentials", http.StatusUnauthorized, r)
 			return
 		}
 
-		// Generate JWT token
-		token, err := auth.GenerateJWT(user.ID, user.Username)
-		if err != nil {
-			writeErrorResponse(w, "Failed to generate token", http.StatusInternalServerError, r)
+		// The plaintext is only available now, so this is where old hashes get upgraded
+		if auth.PasswordNeedsRehash(user.PasswordHash) {
+			upgradePasswordHash(db, user.ID, loginReq.Password, user.PasswordHash)
+		}
+
+		// Only reveal the verification state once the password has been proven
+		if user.Status == models.UserStatusPendingVerification {
+			writeErrorResponse(w, "Email address not verified", http.StatusForbidden, r)
 			return
 		}
 
-		// Clear password hash from response
-		user.PasswordHash = ""
+		completeLogin(db, w, r, user)
+	}
+}
+
+// upgradePasswordHash re-hashes a verified password with the current algorithm
+// and parameters. It is not a password change: the password age and history are
+// left alone. The update only applies if the hash was not changed concurrently.
+// Failures are logged; the login goes ahead with the old hash.
+func upgradePasswordHash(db *sql.DB, userID uuid.UUID, password, oldHash string) {
+	newHash, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("auth: failed to re-hash password of user %s: %v\n", userID, err)
+		return
+	}
+	if _, err := db.Exec("UPDATE \"users\" SET password_hash = $1 WHERE id = $2 AND password_hash = $3", newHash, userID, oldHash); err != nil {
+		log.Printf("auth: failed to store re-hashed password of user %s: %v\n", userID, err)
+	}
+}
 
-		response := LoginResponse{
-			Token: token,
-			User:  user,
-		}
+// completeLogin finishes a login once the user's primary credential has been
+// verified. Users with MFA enabled get a challenge instead of tokens and finish
+// via /api/login/mfa.
+func completeLogin(db *sql.DB, w http.ResponseWriter, r *http.Request, user models.User) {
+	var mfaEnabled bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM \"user_mfa\" WHERE user_id = $1 AND enabled)", user.ID).Scan(&mfaEnabled)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError, r)
+		return
+	}
+	if mfaEnabled {
+		writeMFAChallenge(w, r, user)
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+	writeLoginResponse(db, w, r, user)
+}
+
+// writeLoginResponse starts a new session family for user and writes the
+// access/refresh token pair
+func writeLoginResponse(db *sql.DB, w http.ResponseWriter, r *http.Request, user models.User) {
+	// Only a completed login (including MFA) clears the account's failure counter
+	auth.ResetLoginFailures(db, user.ID)
+
+	session, refreshToken, err := auth.CreateSession(db, user.ID, r.UserAgent(), middleware.ClientIP(r))
+	if err != nil {
+		writeErrorResponse(w, "Failed to create session", http.StatusInternalServerError, r)
+		return
+	}
+
+	token, err := auth.GenerateJWT(user.ID, user.Username, session.FamilyID)
+	if err != nil {
+		writeErrorResponse(w, "Failed to generate token", http.StatusInternalServerError, r)
+		return
 	}
+
+	// Clear password hash from response
+	user.PasswordHash = ""
+
+	response := LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(auth.AccessTokenTTL().Seconds()),
+		User:         user,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // GetUser retrieves a single user by ID
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"pillow/auth"
+)
+
+// GetJWKS publishes the public keys used to sign pillow's tokens so other
+// services can verify them without sharing a secret. Both the current and the
+// previous key are listed, so tokens issued just before a rotation still verify.
+func GetJWKS() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(auth.PublicJWKS())
+	}
+}
+
+// OpenIDConfiguration is the OpenID Connect discovery document
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// GetOpenIDConfiguration serves the discovery document at /.well-known/openid-configuration.
+// There is none while the provider is disabled (see auth.OIDCProviderEnabled).
+func GetOpenIDConfiguration() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.OIDCProviderEnabled() {
+			writeErrorResponse(w, errOIDCProviderDisabled, http.StatusNotFound, r)
+			return
+		}
+
+		issuer := auth.OIDCIssuer()
+		config := OpenIDConfiguration{
+			Issuer:                            issuer,
+			AuthorizationEndpoint:             issuer + "/authorize",
+			TokenEndpoint:                     issuer + "/token",
+			UserInfoEndpoint:                  issuer + "/userinfo",
+			JWKSURI:                           issuer + "/.well-known/jwks.json",
+			ScopesSupported:                   auth.SupportedScopes,
+			ResponseTypesSupported:            []string{"code"},
+			GrantTypesSupported:               []string{"authorization_code", "client_credentials"},
+			SubjectTypesSupported:             []string{"public"},
+			IDTokenSigningAlgValuesSupported:  []string{auth.SigningAlgorithm()},
+			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+			CodeChallengeMethodsSupported:     []string{"S256"},
+			ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "nonce", "azp",
+				"preferred_username", "email", "email_verified", "roles", "organizations"},
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(config)
+	}
+}
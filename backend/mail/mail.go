@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// Mailer delivers email messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// NewFromEnv builds a Mailer from environment variables.
+//
+//	MAIL_DRIVER=smtp   uses SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD
+//	MAIL_DRIVER=outbox writes messages to MAIL_OUTBOX_DIR (default ./outbox)
+//
+// MAIL_FROM sets the sender address for both drivers. The outbox driver is the
+// default so local development and tests never send real email.
+func NewFromEnv() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@pillow.local"
+	}
+
+	switch strings.ToLower(os.Getenv("MAIL_DRIVER")) {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	case "", "outbox":
+		dir := os.Getenv("MAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = "./outbox"
+		}
+		return NewOutboxMailer(dir, from)
+	default:
+		log.Printf("WARNING: unknown MAIL_DRIVER %q; falling back to outbox\n", os.Getenv("MAIL_DRIVER"))
+		return NewOutboxMailer("./outbox", from)
+	}
+}
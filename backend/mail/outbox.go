@@ -0,0 +1,57 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OutboxMailer writes every message to a directory as an .eml file instead of
+// sending it, and keeps a copy in memory. It is meant for development and tests.
+type OutboxMailer struct {
+	Dir  string
+	From string
+
+	mu   sync.Mutex
+	sent []Message
+}
+
+// NewOutboxMailer creates an OutboxMailer writing to dir. An empty dir keeps
+// messages in memory only.
+func NewOutboxMailer(dir, from string) *OutboxMailer {
+	return &OutboxMailer{Dir: dir, From: from}
+}
+
+// Send records msg in memory and, if Dir is set, writes it to disk
+func (m *OutboxMailer) Send(msg Message) error {
+	if msg.SentAt.IsZero() {
+		msg.SentAt = time.Now()
+	}
+
+	m.mu.Lock()
+	m.sent = append(m.sent, msg)
+	m.mu.Unlock()
+
+	if m.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return fmt.Errorf("mail: failed to create outbox dir: %w", err)
+	}
+
+	name := fmt.Sprintf("%s_%s.eml", msg.SentAt.Format("20060102T150405"), uuid.New().String())
+	return os.WriteFile(filepath.Join(m.Dir, name), formatMessage(m.From, msg), 0o644)
+}
+
+// Messages returns a copy of every message sent through this mailer
+func (m *OutboxMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Message, len(m.sent))
+	copy(out, m.sent)
+	return out
+}
@@ -5,7 +5,9 @@ import (
 	"net/http"
 	"os"
 	"pillow/audit"
+	"pillow/auth"
 	"pillow/database"
+	"pillow/middleware"
 	"pillow/routes"
 
 	"github.com/joho/godotenv"
@@ -54,6 +56,23 @@ func main() {
 	audit.StartAuditQueue(db.DB, 100)
 	defer audit.StopAuditQueue()
 
+	// Load (and if due, rotate) the asymmetric JWT signing keys. No-op with HS256.
+	if err := auth.StartKeyManager(db.DB); err != nil {
+		log.Fatalf("Failed to initialize JWT signing keys: %v", err)
+	}
+	defer auth.StopKeyManager()
+
+	// Listen for permission changes so cached authorization decisions are dropped
+	// on every replica. Without the listener entries still expire after PERMISSION_CACHE_TTL.
+	if err := middleware.StartPermissionCache(dbURL); err != nil {
+		log.Printf("Warning: permission cache invalidation unavailable: %v", err)
+	}
+	defer middleware.StopPermissionCache()
+
+	// Remove time-bound role assignments once they expire
+	middleware.StartRoleExpirySweeper(db.DB)
+	defer middleware.StopRoleExpirySweeper()
+
 	r := routes.SetupRoutes(db, logger, isLoggingEnabled)
 
 	log.Printf("Backend running on :%s", serverPort)
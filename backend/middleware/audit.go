@@ -58,7 +58,8 @@ func WithAuditAction(ctx context.Context, actionName string, details interface{}
 }
 
 // AuditMiddlewareMux returns a mux-compatible middleware that records requests.
-// It writes a row into "audit_log" for mutating methods (POST, PUT, DELETE).
+// It writes a row into "audit_log" for mutating methods (POST, PUT, DELETE), and
+// for every request made with an impersonation token.
 // For safety it reads a copy of the request body (if present) but never modifies it.
 func AuditMiddlewareMux(db *sql.DB) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -96,15 +97,23 @@ func AuditMiddlewareMux(db *sql.DB) func(next http.Handler) http.Handler {
 
 			// try to get user from context if available so handlers can see it
 			var actorID *uuid.UUID
+			var impersonatorID *uuid.UUID
+			var actorType string
 			if user, ok := GetUserFromContext(r.Context()); ok && user != nil {
 				actorID = &user.ID
+				actorType = user.PrincipalType
+				impersonatorID = user.ImpersonatorID
 			}
 			// attach action_info to context for handlers that still want metadata
 			actionInfo := map[string]interface{}{
-				"method": r.Method,
-				"path":   r.URL.Path,
-				"actor":  actorID,
-				"ip":     r.RemoteAddr,
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"actor":      actorID,
+				"actor_type": actorType,
+				"ip":         r.RemoteAddr,
+			}
+			if impersonatorID != nil {
+				actionInfo["impersonator_id"] = impersonatorID
 			}
 			ctx := context.WithValue(r.Context(), contextKey("audit_action_info"), actionInfo)
 			r = r.WithContext(ctx)
@@ -125,8 +134,9 @@ func AuditMiddlewareMux(db *sql.DB) func(next http.Handler) http.Handler {
 			// Use wrapper for header checks below
 			w = wrapper
 
-			// Only log mutating methods to reduce noise
-			if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete {
+			// Only log mutating methods to reduce noise. Everything done while
+			// impersonating someone is logged, reads included.
+			if impersonatorID != nil || r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete {
 				// Debug: log detected actor id (helps verify actor propagated)
 				if actorID != nil {
 					log.Printf("audit-debug: detected actor id=%s for %s %s\n", actorID.String(), r.Method, r.URL.Path)
@@ -181,17 +191,18 @@ func AuditMiddlewareMux(db *sql.DB) func(next http.Handler) http.Handler {
 				enqueued := false
 				if audit.Q != nil {
 					ev := audit.AuditEvent{
-						ID:        uuid.New(),
-						UserID:    actorID,
-						Action:    actionStr,
-						Details:   json.RawMessage(detailsBytes),
-						Timestamp: time.Now(),
+						ID:             uuid.New(),
+						UserID:         actorID,
+						ImpersonatorID: impersonatorID,
+						Action:         actionStr,
+						Details:        json.RawMessage(detailsBytes),
+						Timestamp:      time.Now(),
 					}
 					enqueued = audit.Q.Enqueue(ev)
 				}
 				if !enqueued {
-					_, _ = db.Exec(`INSERT INTO "audit_log" (id, user_id, action, details, timestamp) VALUES ($1, $2, $3, $4, $5)`,
-						uuid.New(), actorID, actionStr, string(detailsBytes), time.Now())
+					_, _ = db.Exec(`INSERT INTO "audit_log" (id, user_id, impersonator_id, action, details, timestamp) VALUES ($1, $2, $3, $4, $5, $6)`,
+						uuid.New(), actorID, impersonatorID, actionStr, string(detailsBytes), time.Now())
 				}
 
 				_ = start // placeholder in case we want duration later
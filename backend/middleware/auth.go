@@ -3,23 +3,301 @@ package middleware
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"log"
 	"net/http"
 	"pillow/auth"
 	"pillow/models"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 // Context keys
 type contextKey string
 
 const (
-	UserContextKey contextKey = "user"
+	UserContextKey   contextKey = "user"
+	ClaimsContextKey contextKey = "claims"
+	APIKeyContextKey contextKey = "api_key"
+	OrgContextKey    contextKey = "org_id"
 )
 
+var (
+	errTokenUserNotFound  = errors.New("user not found")
+	errTokenUserInactive  = errors.New("account is deactivated")
+	errTokenRevoked       = errors.New("token has been revoked")
+	errEmailNotVerified   = errors.New("email address not verified")
+	errAPIKeyInvalid      = errors.New("invalid API key")
+	errImpersonationEnded = errors.New("impersonation is no longer allowed")
+)
+
+// ImpersonatePermission allows signing in as another user (see handlers.ImpersonateUser)
+const ImpersonatePermission = "impersonate_users"
+
+// apiKeyTouchInterval limits how often last_used_at is written for a busy API key
+const apiKeyTouchInterval = time.Minute
+
+// Session restrictions. A restricted user is authenticated but may only call the
+// routes needed to lift the restriction.
+const (
+	restrictionMFAEnrollment  = "mfa_enrollment_required"
+	restrictionPasswordChange = "password_change_required"
+)
+
+// restrictedPaths lists the route prefixes a restricted session may still use
+var restrictedPaths = map[string][]string{
+	restrictionMFAEnrollment:  {"/api/mfa", "/api/logout", "/api/users/profile"},
+	restrictionPasswordChange: {"/api/users/profile", "/api/logout", "/api/password-policy"},
+}
+
+// restrictedPathAllowed reports whether path may be called under restriction
+func restrictedPathAllowed(restriction, path string) bool {
+	for _, prefix := range restrictedPaths[restriction] {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRestrictionError rejects a request made by a restricted session
+func writeRestrictionError(w http.ResponseWriter, restriction string) {
+	switch restriction {
+	case restrictionMFAEnrollment:
+		http.Error(w, "Your organization requires multi-factor authentication; enroll via /api/mfa/totp/enroll", http.StatusForbidden)
+	case restrictionPasswordChange:
+		http.Error(w, "Your password has expired; change it via /api/users/profile/password", http.StatusForbidden)
+	default:
+		http.Error(w, "Access restricted", http.StatusForbidden)
+	}
+}
+
+// cachedTokenUser is what authenticating a request needs to know about the
+// user besides the token itself: the account, its "revoke all tokens" cutoff and
+// whether its session is restricted. It is kept in the permission cache, so
+// only the jti denylist is looked up on every request.
+type cachedTokenUser struct {
+	found                  bool
+	user                   models.User
+	tokensValidAfter       *time.Time
+	mfaEnrollmentRequired  bool
+	passwordChangeRequired bool
+	loadedAt               time.Time
+	// changesAt is when the password expires, when that is still ahead
+	changesAt time.Time
+}
+
+// fresh reports whether the entry can still be used
+func (e *cachedTokenUser) fresh(ttl time.Duration) bool {
+	return time.Since(e.loadedAt) < ttl && (e.changesAt.IsZero() || time.Now().Before(e.changesAt))
+}
+
+// restriction picks the restriction applied to the user's requests. An expired
+// password is dealt with first; MFA enrollment follows on the next request.
+// Service accounts have neither, so they are never restricted.
+func (e *cachedTokenUser) restriction() string {
+	switch {
+	case e.user.PrincipalType == models.PrincipalTypeServiceAccount:
+		return ""
+	case e.passwordChangeRequired:
+		return restrictionPasswordChange
+	case e.mfaEnrollmentRequired:
+		return restrictionMFAEnrollment
+	}
+	return ""
+}
+
+// loadTokenUserState reads a user and works out whether their session is
+// restricted, e.g. because one of the user's organizations requires MFA and the
+// user has not enrolled yet, or because the password is older than the maximum
+// age of an applicable password policy. Accounts without a password (federated
+// only) never have to change it. Unknown users are returned as not found.
+func loadTokenUserState(db *sql.DB, userID uuid.UUID) (*cachedTokenUser, error) {
+	entry := &cachedTokenUser{loadedAt: time.Now()}
+
+	var passwordExpiresIn sql.NullFloat64
+	err := db.QueryRow(`SELECT u.id, u.username, u.email, u.is_active, u.status, u.principal_type, u.created_at,
+			u.tokens_valid_after::timestamptz,
+			EXISTS (SELECT 1 FROM "user_organizations" uo
+				INNER JOIN "organizations" o ON o.id = uo.org_id
+				WHERE uo.user_id = u.id AND o.require_mfa)
+			AND NOT EXISTS (SELECT 1 FROM "user_mfa" m WHERE m.user_id = u.id AND m.enabled),
+			CASE WHEN u.password_hash <> '' THEN EXTRACT(EPOCH FROM (
+				SELECT MIN(COALESCE(u.password_changed_at, u.created_at) + make_interval(days => pp.max_age_days))
+				FROM "password_policies" pp
+				WHERE pp.max_age_days > 0
+				AND (pp.org_id IS NULL OR pp.org_id IN (SELECT org_id FROM "user_organizations" WHERE user_id = u.id))
+			) - NOW()) END
+		FROM "users" u WHERE u.id = $1`, userID).Scan(
+		&entry.user.ID, &entry.user.Username, &entry.user.Email, &entry.user.IsActive, &entry.user.Status, &entry.user.PrincipalType, &entry.user.CreatedAt,
+		&entry.tokensValidAfter, &entry.mfaEnrollmentRequired, &passwordExpiresIn)
+	if err == sql.ErrNoRows {
+		return entry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry.found = true
+
+	// Passwords expiring later do not cause a notification, so the entry must
+	// not outlive the password
+	if passwordExpiresIn.Valid {
+		if passwordExpiresIn.Float64 <= 0 {
+			entry.passwordChangeRequired = true
+		} else {
+			entry.changesAt = entry.loadedAt.Add(time.Duration(passwordExpiresIn.Float64 * float64(time.Second)))
+		}
+	}
+	return entry, nil
+}
+
+// checkTokenUser checks that the user a credential belongs to still exists, is
+// active and verified, and returns them with their session restriction
+func checkTokenUser(db *sql.DB, userID uuid.UUID) (*cachedTokenUser, error) {
+	entry, err := permissions.tokenUser(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.found {
+		return nil, errTokenUserNotFound
+	}
+	if !entry.user.IsActive {
+		return nil, errTokenUserInactive
+	}
+	if entry.user.Status == models.UserStatusPendingVerification {
+		return nil, errEmailNotVerified
+	}
+	return entry, nil
+}
+
+// loadTokenUser loads the user a token was issued to and checks that the account is
+// still active and that the token has not been revoked, either individually (jti
+// denylist) or through a "revoke all tokens" cutoff on the user. The user, the
+// cutoff and the session restriction come from the permission cache, which is
+// invalidated whenever one of them changes; only the denylist is read on every
+// request.
+func loadTokenUser(db *sql.DB, r *http.Request, claims *auth.Claims) (models.User, string, error) {
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+
+	var revoked bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "revoked_tokens" WHERE jti = $1)`, claims.ID).Scan(&revoked); err != nil {
+		return models.User{}, "", err
+	}
+	if revoked {
+		return models.User{}, "", errTokenRevoked
+	}
+
+	entry, err := checkTokenUser(db, claims.UserID)
+	if err != nil {
+		return models.User{}, "", err
+	}
+	if entry.tokensValidAfter != nil && entry.tokensValidAfter.After(issuedAt) {
+		return models.User{}, "", errTokenRevoked
+	}
+	user := entry.user
+	restriction := entry.restriction()
+
+	if claims.Actor != nil {
+		if err := checkImpersonator(db, r, claims.Actor.Subject); err != nil {
+			return user, "", err
+		}
+		impersonatorID := claims.Actor.Subject
+		user.ImpersonatorID = &impersonatorID
+		// The impersonator cannot lift restrictions of the target (the
+		// credential routes are closed to them), so none are applied.
+		restriction = ""
+	}
+
+	return user, restriction, nil
+}
+
+// checkImpersonator verifies on every request made with an impersonation token
+// that the impersonator is still active and still allowed to impersonate, so
+// deactivating an administrator or taking the permission away ends their
+// impersonation sessions immediately. Roles and policies denying the
+// permission end them as well.
+func checkImpersonator(db *sql.DB, r *http.Request, impersonatorID uuid.UUID) error {
+	allowed, err := authorize(db, r, impersonatorID, ImpersonatePermission, nil)
+	if err == nil && !allowed {
+		return errImpersonationEnded
+	}
+	return err
+}
+
+// loadAPIKeyUser resolves a personal access token to its owner. The key must be
+// neither revoked nor expired, must not predate a "revoke all tokens" cutoff on
+// the owner, and the owner must still be active and verified. The owner's
+// session restrictions apply to the key as well: a key created before the
+// password expired or before MFA became mandatory must not get around them.
+func loadAPIKeyUser(db *sql.DB, key string) (models.User, *models.APIKey, string, error) {
+	apiKey := &models.APIKey{}
+
+	err := db.QueryRow(`SELECT id, user_id, name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at::timestamptz
+		FROM "api_keys" WHERE key_hash = $1`, auth.HashToken(key)).Scan(
+		&apiKey.ID, &apiKey.UserID, &apiKey.Name, &apiKey.Prefix, pq.Array(&apiKey.Scopes), &apiKey.ExpiresAt, &apiKey.LastUsedAt, &apiKey.RevokedAt, &apiKey.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.User{}, nil, "", errAPIKeyInvalid
+		}
+		return models.User{}, nil, "", err
+	}
+	if apiKey.RevokedAt != nil || time.Now().After(apiKey.ExpiresAt) {
+		return models.User{}, nil, "", errAPIKeyInvalid
+	}
+
+	entry, err := checkTokenUser(db, apiKey.UserID)
+	if err != nil {
+		return models.User{}, nil, "", err
+	}
+	if entry.tokensValidAfter != nil && entry.tokensValidAfter.After(apiKey.CreatedAt) {
+		return models.User{}, nil, "", errAPIKeyInvalid
+	}
+
+	if apiKey.LastUsedAt == nil || time.Since(*apiKey.LastUsedAt) > apiKeyTouchInterval {
+		if _, err := db.Exec(`UPDATE "api_keys" SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1`, apiKey.ID); err != nil {
+			log.Printf("auth: failed to update last_used_at of API key %s: %v\n", apiKey.ID, err)
+		}
+	}
+
+	return entry.user, apiKey, entry.restriction(), nil
+}
+
+// writeTokenUserError maps loadTokenUser errors to HTTP responses
+func writeTokenUserError(w http.ResponseWriter, err error) {
+	switch err {
+	case errTokenUserNotFound:
+		http.Error(w, "User not found", http.StatusUnauthorized)
+	case errTokenUserInactive:
+		http.Error(w, "Account is deactivated", http.StatusUnauthorized)
+	case errTokenRevoked:
+		http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+	case errEmailNotVerified:
+		http.Error(w, "Email address not verified", http.StatusForbidden)
+	case errAPIKeyInvalid:
+		http.Error(w, "Invalid, expired or revoked API key", http.StatusUnauthorized)
+	case errImpersonationEnded:
+		http.Error(w, "Impersonation is no longer allowed", http.StatusUnauthorized)
+	default:
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+}
+
 // AuthMiddleware validates JWT tokens and adds user info to request context
 func AuthMiddleware(db *sql.DB) func(http.HandlerFunc) http.HandlerFunc {
+	return ClientAuthMiddleware(db, "")
+}
+
+// ClientAuthMiddleware is AuthMiddleware that also accepts access tokens issued
+// to OAuth clients, provided the user granted the client scope. With an empty
+// scope only pillow's own access tokens are accepted.
+func ClientAuthMiddleware(db *sql.DB, scope string) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
@@ -35,32 +313,32 @@ func AuthMiddleware(db *sql.DB) func(http.HandlerFunc) http.HandlerFunc {
 			}
 
 			claims, err := auth.ValidateJWT(tokenString)
+			if err != nil && scope != "" {
+				claims, err = auth.ValidateClientAccessToken(tokenString)
+				if err == nil && !auth.HasScope(claims.Scope, scope) {
+					http.Error(w, "Token was not granted the "+scope+" scope", http.StatusForbidden)
+					return
+				}
+			}
 			if err != nil {
 				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 				return
 			}
 
-			// Get user from database to ensure they still exist and are active
-			var user models.User
-			err = db.QueryRow("SELECT id, username, email, is_active, created_at FROM \"users\" WHERE id = $1",
-				claims.UserID).Scan(&user.ID, &user.Username, &user.Email, &user.IsActive, &user.CreatedAt)
-
+			// Get user from database to ensure they still exist, are active and the token is not revoked
+			user, restriction, err := loadTokenUser(db, r, claims)
 			if err != nil {
-				if err == sql.ErrNoRows {
-					http.Error(w, "User not found", http.StatusUnauthorized)
-					return
-				}
-				http.Error(w, "Database error", http.StatusInternalServerError)
+				writeTokenUserError(w, err)
 				return
 			}
-
-			if !user.IsActive {
-				http.Error(w, "Account is deactivated", http.StatusUnauthorized)
+			if restriction != "" && !restrictedPathAllowed(restriction, r.URL.Path) {
+				writeRestrictionError(w, restriction)
 				return
 			}
 
-			// Add user to request context
+			// Add user and token claims to request context
 			ctx := context.WithValue(r.Context(), UserContextKey, user)
+			ctx = context.WithValue(ctx, ClaimsContextKey, claims)
 			r = r.WithContext(ctx)
 
 			next.ServeHTTP(w, r)
@@ -68,7 +346,9 @@ func AuthMiddleware(db *sql.DB) func(http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// GetUserFromContext retrieves the user from request context
+// GetUserFromContext retrieves the user from request context. For requests made
+// with an impersonation token this is the impersonated user, and
+// ImpersonatorID holds the administrator acting as them.
 func GetUserFromContext(ctx context.Context) (*models.User, bool) {
 	user, ok := ctx.Value(UserContextKey).(models.User)
 	if !ok {
@@ -77,6 +357,25 @@ func GetUserFromContext(ctx context.Context) (*models.User, bool) {
 	return &user, true
 }
 
+// GetClaimsFromContext retrieves the validated token claims from request context
+func GetClaimsFromContext(ctx context.Context) (*auth.Claims, bool) {
+	claims, ok := ctx.Value(ClaimsContextKey).(*auth.Claims)
+	if !ok {
+		return nil, false
+	}
+	return claims, true
+}
+
+// GetAPIKeyFromContext retrieves the API key a request was authenticated with.
+// It reports false for requests authenticated with an access token.
+func GetAPIKeyFromContext(ctx context.Context) (*models.APIKey, bool) {
+	apiKey, ok := ctx.Value(APIKeyContextKey).(*models.APIKey)
+	if !ok {
+		return nil, false
+	}
+	return apiKey, true
+}
+
 // OptionalAuthMiddleware allows requests without authentication but adds user info if token is provided
 func OptionalAuthMiddleware(db *sql.DB) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
@@ -88,13 +387,11 @@ func OptionalAuthMiddleware(db *sql.DB) func(http.HandlerFunc) http.HandlerFunc
 					claims, err := auth.ValidateJWT(tokenString)
 					if err == nil {
 						// Get user from database
-						var user models.User
-						err = db.QueryRow("SELECT id, username, email, is_active, created_at FROM \"users\" WHERE id = $1",
-							claims.UserID).Scan(&user.ID, &user.Username, &user.Email, &user.IsActive, &user.CreatedAt)
-
-						if err == nil && user.IsActive {
-							// Add user to request context
+						user, restriction, err := loadTokenUser(db, r, claims)
+						if err == nil && restriction == "" {
+							// Add user and token claims to request context
 							ctx := context.WithValue(r.Context(), UserContextKey, user)
+							ctx = context.WithValue(ctx, ClaimsContextKey, claims)
 							r = r.WithContext(ctx)
 						}
 					}
@@ -122,36 +419,80 @@ func AuthMiddlewareMux(db *sql.DB) mux.MiddlewareFunc {
 				return
 			}
 
+			// Personal access tokens are the second credential type next to access tokens
+			if auth.IsAPIKey(tokenString) {
+				user, apiKey, restriction, err := loadAPIKeyUser(db, tokenString)
+				if err != nil {
+					writeTokenUserError(w, err)
+					return
+				}
+				if restriction != "" && !restrictedPathAllowed(restriction, r.URL.Path) {
+					writeRestrictionError(w, restriction)
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), UserContextKey, user)
+				ctx = context.WithValue(ctx, APIKeyContextKey, apiKey)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
 			claims, err := auth.ValidateJWT(tokenString)
 			if err != nil {
 				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 				return
 			}
 
-			// Get user from database to ensure they still exist and are active
-			var user models.User
-			err = db.QueryRow("SELECT id, username, email, is_active, created_at FROM \"users\" WHERE id = $1",
-				claims.UserID).Scan(&user.ID, &user.Username, &user.Email, &user.IsActive, &user.CreatedAt)
-
+			// Get user from database to ensure they still exist, are active and the token is not revoked
+			user, restriction, err := loadTokenUser(db, r, claims)
 			if err != nil {
-				if err == sql.ErrNoRows {
-					http.Error(w, "User not found", http.StatusUnauthorized)
-					return
-				}
-				http.Error(w, "Database error", http.StatusInternalServerError)
+				writeTokenUserError(w, err)
 				return
 			}
-
-			if !user.IsActive {
-				http.Error(w, "Account is deactivated", http.StatusUnauthorized)
+			if restriction != "" && !restrictedPathAllowed(restriction, r.URL.Path) {
+				writeRestrictionError(w, restriction)
 				return
 			}
 
-			// Add user to request context
+			// Add user and token claims to request context
 			ctx := context.WithValue(r.Context(), UserContextKey, user)
+			ctx = context.WithValue(ctx, ClaimsContextKey, claims)
 			r = r.WithContext(ctx)
 
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// RequireSessionMux rejects requests that do not come from a signed-in person:
+// requests authenticated with an API key or a token issued to an OAuth client,
+// requests made by service accounts and requests made while impersonating
+// someone. It guards the routes that manage credentials and sessions, so a
+// (possibly narrowly scoped) key can never be used to create other keys, change
+// the password or MFA, and an impersonator cannot take over the impersonated
+// account.
+func RequireSessionMux() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := GetAPIKeyFromContext(r.Context()); ok {
+				http.Error(w, "This endpoint cannot be used with an API key", http.StatusForbidden)
+				return
+			}
+			if user, ok := GetUserFromContext(r.Context()); ok {
+				if user.PrincipalType == models.PrincipalTypeServiceAccount {
+					http.Error(w, "This endpoint cannot be used by a service account", http.StatusForbidden)
+					return
+				}
+				if user.ImpersonatorID != nil {
+					http.Error(w, "This endpoint cannot be used while impersonating a user", http.StatusForbidden)
+					return
+				}
+			}
+			if claims, ok := GetClaimsFromContext(r.Context()); ok && claims.IssuedToClient() {
+				http.Error(w, "This endpoint cannot be used with a token issued to an OAuth client", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
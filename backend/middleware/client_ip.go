@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// trustedProxies are the networks allowed to report the client address through
+// X-Forwarded-For (TRUSTED_PROXIES, comma separated IPs or CIDRs). The Next.js
+// frontend proxies logins, so it must be listed for per-IP limits to work.
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+// parseTrustedProxies parses a comma separated list of IPs and CIDRs
+func parseTrustedProxies(v string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, n)
+		} else {
+			log.Printf("WARNING: ignoring invalid TRUSTED_PROXIES entry %q\n", entry)
+		}
+	}
+	return nets
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted proxy network
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made the request. When the
+// request comes from a trusted proxy, the last X-Forwarded-For hop (the one that
+// proxy appended) is the client; earlier hops are client controlled and ignored.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	if hop := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); hop != nil {
+		return hop.String()
+	}
+	return host
+}
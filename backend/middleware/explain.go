@@ -0,0 +1,250 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pillow/models"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EffectivePermissions lists the permissions a user holds through their roles,
+// including inherited ones, with every role and scope granting each, and every
+// role and scope explicitly denying it. A non-empty permissionName restricts
+// the result to that permission.
+func EffectivePermissions(db *sql.DB, userID uuid.UUID, permissionName string) ([]models.EffectivePermission, error) {
+	rows, err := db.Query(`SELECT DISTINCT p.id, p.name, COALESCE(p.description, ''), COALESCE(p.scope_level, ''),
+			p.created_at, p.updated_at, gr.id, gr.name, ar.id, ar.name, ur.scope, ur.org_id, g.denied
+		FROM "permissions" p
+		INNER JOIN (
+			SELECT role_id, permission_id, false AS denied FROM "role_permissions"
+			UNION ALL
+			SELECT role_id, permission_id, true FROM "role_denied_permissions"
+		) g ON p.id = g.permission_id
+		INNER JOIN "roles" gr ON gr.id = g.role_id
+		INNER JOIN "role_ancestry" ra ON g.role_id = ra.ancestor_id
+		INNER JOIN "active_user_roles" ur ON ra.role_id = ur.role_id
+		INNER JOIN "roles" ar ON ar.id = ur.role_id
+		WHERE ur.user_id = $1 AND ($2 = '' OR p.name = $2)
+		ORDER BY p.name, g.denied, ur.org_id NULLS FIRST, ar.name, gr.name`, userID, permissionName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	effective := []models.EffectivePermission{}
+	for rows.Next() {
+		var p models.Permission
+		var g models.PermissionGrant
+		var denied bool
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.ScopeLevel, &p.CreatedAt, &p.UpdatedAt,
+			&g.RoleID, &g.RoleName, &g.AssignedRoleID, &g.AssignedRoleName, &g.Scope, &g.OrgID, &denied); err != nil {
+			return nil, err
+		}
+		if n := len(effective); n == 0 || effective[n-1].ID != p.ID {
+			effective = append(effective, models.EffectivePermission{Permission: p, GrantedBy: []models.PermissionGrant{}})
+		}
+		last := &effective[len(effective)-1]
+		if denied {
+			last.DeniedBy = append(last.DeniedBy, g)
+		} else {
+			last.GrantedBy = append(last.GrantedBy, g)
+		}
+	}
+	return effective, rows.Err()
+}
+
+// Explain evaluates whether a user may use permissionName, globally when orgID
+// is nil or within the organization otherwise, the same way the permission
+// middleware does, and records every step. Request context and resource
+// attributes are taken from r, so policies are evaluated as if the user had
+// made that request.
+func Explain(db *sql.DB, r *http.Request, userID uuid.UUID, permissionName string, orgID *uuid.UUID) (models.AuthzExplanation, error) {
+	e := models.AuthzExplanation{UserID: userID, Permission: permissionName, OrgID: orgID, Steps: []models.AuthzStep{}}
+
+	entry, err := permissions.user(db, userID)
+	if err != nil {
+		return e, err
+	}
+	if !entry.isActive {
+		e.DecidedBy = "account"
+		e.Steps = append(e.Steps, models.AuthzStep{Step: "account", Result: models.AuthzStepFail,
+			Detail: "the account is deactivated or does not exist; it has no permissions"})
+		return e, nil
+	}
+	e.Steps = append(e.Steps, models.AuthzStep{Step: "account", Result: models.AuthzStepPass, Detail: "the account is active"})
+
+	var scopeLevel string
+	err = db.QueryRow(`SELECT COALESCE(scope_level, '') FROM "permissions" WHERE name = $1`, permissionName).Scan(&scopeLevel)
+	switch {
+	case err == sql.ErrNoRows:
+		e.Steps = append(e.Steps, models.AuthzStep{Step: "permission", Result: models.AuthzStepFail,
+			Detail: "no such permission; only allow policies can grant it"})
+	case err != nil:
+		return e, err
+	default:
+		e.Steps = append(e.Steps, models.AuthzStep{Step: "permission", Result: models.AuthzStepPass,
+			Detail: "scope_level " + scopeLevel})
+	}
+
+	var chain []uuid.UUID
+	if orgID != nil {
+		if chain, err = permissions.orgChain(db, *orgID); err != nil {
+			return e, err
+		}
+		step := models.AuthzStep{Step: "organization", Result: models.AuthzStepPass, OrgChain: chain,
+			Detail: "grants in the organization and its parents apply"}
+		if len(chain) == 0 {
+			step.Result = models.AuthzStepFail
+			step.Detail = "no such organization; only system-scope grants apply"
+		}
+		e.Steps = append(e.Steps, step)
+	}
+
+	effective, err := EffectivePermissions(db, userID, permissionName)
+	if err != nil {
+		return e, err
+	}
+	var grants, denies []models.PermissionGrant
+	if len(effective) > 0 {
+		grants, denies = effective[0].GrantedBy, effective[0].DeniedBy
+	}
+	granted := explainGrants(&e, grants, scopeLevel, chain)
+	e.Allowed = granted
+	e.DecidedBy = "roles"
+
+	if explainDenies(&e, denies, orgID != nil, chain) {
+		e.Allowed = false
+		e.DecidedBy = "deny"
+		return e, nil
+	}
+
+	policies, err := permissions.policies(db)
+	if err != nil {
+		return e, err
+	}
+	var attrs Attributes
+	decided := false
+	for _, p := range policies {
+		if !policyApplies(p, permissionName, chain) {
+			continue
+		}
+		if attrs == nil {
+			if attrs, err = RequestAttributes(db, r, userID, chain); err != nil {
+				return e, err
+			}
+		}
+
+		p := p
+		step := models.AuthzStep{Step: "policy", Policy: &p, Result: models.AuthzStepNoMatch}
+		setTimeAttributes(attrs, p.Timezone, time.Now())
+		matched := true
+		for _, c := range p.Conditions {
+			result := explainCondition(c, attrs)
+			matched = matched && result.Matched
+			step.Conditions = append(step.Conditions, result)
+		}
+		if matched {
+			step.Result = models.AuthzStepMatch
+		}
+
+		switch {
+		case decided:
+			step.Detail = "not considered: an earlier policy decided"
+		case granted && p.Effect == models.PolicyEffectAllow:
+			step.Detail = "not considered: the roles already grant the permission"
+		case !granted && p.Effect == models.PolicyEffectDeny:
+			step.Detail = "not considered: deny policies only revoke granted permissions"
+		case matched:
+			decided = true
+			e.Allowed = p.Effect == models.PolicyEffectAllow
+			e.DecidedBy = "policy:" + p.Name
+			step.Detail = "decides: " + p.Effect
+		}
+		e.Steps = append(e.Steps, step)
+	}
+	return e, nil
+}
+
+// explainGrants adds the role step to e and reports whether grants, the grants
+// of the user's roles, include one that applies in the checked scope
+func explainGrants(e *models.AuthzExplanation, grants []models.PermissionGrant, scopeLevel string, chain []uuid.UUID) bool {
+	step := models.AuthzStep{Step: "roles", Result: models.AuthzStepFail}
+	var otherOrgs, systemOnly int
+	for _, g := range grants {
+		switch {
+		case g.OrgID == nil:
+			step.Grants = append(step.Grants, g)
+		case !containsOrg(chain, *g.OrgID):
+			otherOrgs++
+		case scopeLevel == models.PermissionScopeSystem:
+			systemOnly++
+		default:
+			step.Grants = append(step.Grants, g)
+		}
+	}
+
+	switch {
+	case len(step.Grants) > 0:
+		step.Result = models.AuthzStepPass
+		step.Detail = fmt.Sprintf("granted by %d role assignment(s)", len(step.Grants))
+	case systemOnly > 0:
+		step.Detail = "only granted within the organization, but system-level permissions need a system-scope assignment"
+	case otherOrgs > 0:
+		step.Detail = fmt.Sprintf("only granted in %d other organization scope(s)", otherOrgs)
+	default:
+		step.Detail = "no role grants the permission"
+	}
+	e.Steps = append(e.Steps, step)
+	return step.Result == models.AuthzStepPass
+}
+
+// explainDenies adds a deny step to e when the user's roles explicitly deny the
+// permission anywhere and reports whether one of the denies applies in the
+// checked scope, which decides the check
+func explainDenies(e *models.AuthzExplanation, denies []models.PermissionGrant, inOrg bool, chain []uuid.UUID) bool {
+	if len(denies) == 0 {
+		return false
+	}
+	step := models.AuthzStep{Step: "deny", Result: models.AuthzStepNoMatch}
+	for _, d := range denies {
+		if d.OrgID == nil || (inOrg && containsOrg(chain, *d.OrgID)) {
+			step.Grants = append(step.Grants, d)
+		}
+	}
+	if len(step.Grants) > 0 {
+		step.Result = models.AuthzStepMatch
+		step.Detail = fmt.Sprintf("explicitly denied by %d role assignment(s); denies override grants and policies", len(step.Grants))
+	} else {
+		step.Detail = fmt.Sprintf("only denied in %d other organization scope(s)", len(denies))
+	}
+	e.Steps = append(e.Steps, step)
+	return step.Result == models.AuthzStepMatch
+}
+
+// containsOrg reports whether id is in chain
+func containsOrg(chain []uuid.UUID, id uuid.UUID) bool {
+	for _, c := range chain {
+		if c == id {
+			return true
+		}
+	}
+	return false
+}
+
+// explainCondition evaluates a condition and records the values it compared
+func explainCondition(c models.PolicyCondition, attrs Attributes) models.ConditionResult {
+	result := models.ConditionResult{PolicyCondition: c, Actual: attrs[c.Attribute], Matched: conditionMatches(c, attrs)}
+	if c.ValueFrom != "" {
+		result.Expected = attrs[c.ValueFrom]
+	} else if len(c.Value) > 0 {
+		var v interface{}
+		if json.Unmarshal(c.Value, &v) == nil {
+			result.Expected = normalizeValue(v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,423 @@
+package middleware
+
+import (
+	"database/sql"
+	"log"
+	"pillow/config"
+	"pillow/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// PermissionsChannel is the Postgres NOTIFY channel on which the database
+// announces changes to roles, permissions, role assignments, users, memberships,
+// MFA enrollment, password policies, the organization tree and policies (see
+// notify_permissions_changed in pillowdb.sql). The payload is "user:<id>" when
+// only one user is affected and "*" otherwise.
+const PermissionsChannel = "pillow_permissions"
+
+// defaultPermissionCacheTTL bounds how stale a cache entry can get when a
+// notification is missed, e.g. while the listener reconnects
+const defaultPermissionCacheTTL = time.Minute
+
+// permissionGrant is one way a user holds a permission: through a system-scope
+// assignment (orgID nil) or within an organization
+type permissionGrant struct {
+	orgID      *uuid.UUID
+	scopeLevel string
+}
+
+// cachedUserPermissions is the cached authorization state of a user. denies
+// holds the scopes of the user's assignments whose roles explicitly deny a
+// permission: nil for system-scope assignments, the organization otherwise.
+type cachedUserPermissions struct {
+	isActive bool
+	grants   map[string][]permissionGrant
+	denies   map[string][]*uuid.UUID
+	loadedAt time.Time
+	// changesAt is when the next time-bound role assignment of the user starts
+	// or ends; zero when there is none
+	changesAt time.Time
+}
+
+// fresh reports whether the entry can still be used
+func (e *cachedUserPermissions) fresh(ttl time.Duration) bool {
+	return time.Since(e.loadedAt) < ttl && (e.changesAt.IsZero() || time.Now().Before(e.changesAt))
+}
+
+// cachedOrgChain is an organization and its ancestors
+type cachedOrgChain struct {
+	ids      []uuid.UUID
+	loadedAt time.Time
+}
+
+// permissionCache caches the effective permissions and account state of users,
+// organization ancestry and the active policies in process. Entries expire after ttl and are
+// dropped on notifications on PermissionsChannel. A generation counter keeps a
+// load that raced with an invalidation from storing what it read before it.
+type permissionCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	generation uint64
+	users      map[uuid.UUID]*cachedUserPermissions
+	tokenUsers map[uuid.UUID]*cachedTokenUser
+	orgs       map[uuid.UUID]*cachedOrgChain
+
+	activePolicies   []models.Policy
+	policiesLoadedAt time.Time
+
+	listener *pq.Listener
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+var permissions = newPermissionCache()
+
+// newPermissionCache reads PERMISSION_CACHE_TTL; 0 disables caching
+func newPermissionCache() *permissionCache {
+	return &permissionCache{
+		ttl:        config.OptionalDuration("PERMISSION_CACHE_TTL", defaultPermissionCacheTTL),
+		users:      make(map[uuid.UUID]*cachedUserPermissions),
+		tokenUsers: make(map[uuid.UUID]*cachedTokenUser),
+		orgs:       make(map[uuid.UUID]*cachedOrgChain),
+	}
+}
+
+// user returns the authorization state of userID, loading it when it is not
+// cached or has expired
+func (c *permissionCache) user(db *sql.DB, userID uuid.UUID) (*cachedUserPermissions, error) {
+	c.mu.Lock()
+	if entry, ok := c.users[userID]; ok && entry.fresh(c.ttl) {
+		c.mu.Unlock()
+		return entry, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	entry, err := loadUserPermissions(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.ttl > 0 && c.generation == generation {
+		c.users[userID] = entry
+	}
+	c.mu.Unlock()
+	return entry, nil
+}
+
+// tokenUser returns the account state checked when userID authenticates,
+// loading it when it is not cached or has expired
+func (c *permissionCache) tokenUser(db *sql.DB, userID uuid.UUID) (*cachedTokenUser, error) {
+	c.mu.Lock()
+	if entry, ok := c.tokenUsers[userID]; ok && entry.fresh(c.ttl) {
+		c.mu.Unlock()
+		return entry, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	entry, err := loadTokenUserState(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.ttl > 0 && c.generation == generation {
+		c.tokenUsers[userID] = entry
+	}
+	c.mu.Unlock()
+	return entry, nil
+}
+
+// OrgChain returns an organization and its ancestors. An unknown organization
+// has an empty chain.
+func OrgChain(db *sql.DB, orgID uuid.UUID) ([]uuid.UUID, error) {
+	return permissions.orgChain(db, orgID)
+}
+
+// orgChain returns orgID and its ancestors, loading them when not cached
+func (c *permissionCache) orgChain(db *sql.DB, orgID uuid.UUID) ([]uuid.UUID, error) {
+	c.mu.Lock()
+	if entry, ok := c.orgs[orgID]; ok && time.Since(entry.loadedAt) < c.ttl {
+		c.mu.Unlock()
+		return entry.ids, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	entry, err := loadOrgChain(db, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.ttl > 0 && c.generation == generation {
+		c.orgs[orgID] = entry
+	}
+	c.mu.Unlock()
+	return entry.ids, nil
+}
+
+// policies returns the active policies, loading them when not cached
+func (c *permissionCache) policies(db *sql.DB) ([]models.Policy, error) {
+	c.mu.Lock()
+	if c.activePolicies != nil && time.Since(c.policiesLoadedAt) < c.ttl {
+		policies := c.activePolicies
+		c.mu.Unlock()
+		return policies, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	policies, err := LoadPolicies(db, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.ttl > 0 && c.generation == generation {
+		c.activePolicies = policies
+		c.policiesLoadedAt = time.Now()
+	}
+	c.mu.Unlock()
+	return policies, nil
+}
+
+// invalidate handles a PermissionsChannel payload
+func (c *permissionCache) invalidate(payload string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+
+	if id, ok := strings.CutPrefix(payload, "user:"); ok {
+		if userID, err := uuid.Parse(id); err == nil {
+			delete(c.users, userID)
+			delete(c.tokenUsers, userID)
+			return
+		}
+	}
+	c.users = make(map[uuid.UUID]*cachedUserPermissions)
+	c.tokenUsers = make(map[uuid.UUID]*cachedTokenUser)
+	c.orgs = make(map[uuid.UUID]*cachedOrgChain)
+	c.activePolicies = nil
+}
+
+// loadUserPermissions reads the active status and every permission grant and
+// explicit deny of a user, including those inherited through the role
+// hierarchy, from the role assignments that are currently valid. Unknown
+// users are returned as inactive without grants.
+func loadUserPermissions(db *sql.DB, userID uuid.UUID) (*cachedUserPermissions, error) {
+	entry := &cachedUserPermissions{
+		grants:   make(map[string][]permissionGrant),
+		denies:   make(map[string][]*uuid.UUID),
+		loadedAt: time.Now(),
+	}
+
+	err := db.QueryRow(`SELECT is_active FROM "users" WHERE id = $1`, userID).Scan(&entry.isActive)
+	if err == sql.ErrNoRows {
+		return entry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Role assignments starting or ending later do not cause a notification, so
+	// the entry must not outlive the next one
+	var changesIn sql.NullFloat64
+	err = db.QueryRow(`SELECT EXTRACT(EPOCH FROM MIN(t) - NOW()) FROM (
+			SELECT valid_from AS t FROM "user_roles" WHERE user_id = $1 AND valid_from > NOW()
+			UNION ALL
+			SELECT valid_until FROM "user_roles" WHERE user_id = $1 AND valid_until > NOW()
+		) s`, userID).Scan(&changesIn)
+	if err != nil {
+		return nil, err
+	}
+	if changesIn.Valid {
+		entry.changesAt = entry.loadedAt.Add(time.Duration(changesIn.Float64 * float64(time.Second)))
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT p.name, COALESCE(p.scope_level, ''), ur.org_id
+		FROM "permissions" p
+		INNER JOIN "role_permissions" rp ON p.id = rp.permission_id
+		INNER JOIN "role_ancestry" ra ON rp.role_id = ra.ancestor_id
+		INNER JOIN "active_user_roles" ur ON ra.role_id = ur.role_id
+		WHERE ur.user_id = $1
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		var grant permissionGrant
+		if err := rows.Scan(&name, &grant.scopeLevel, &grant.orgID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entry.grants[name] = append(entry.grants[name], grant)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT DISTINCT p.name, ur.org_id
+		FROM "permissions" p
+		INNER JOIN "role_denied_permissions" rd ON p.id = rd.permission_id
+		INNER JOIN "role_ancestry" ra ON rd.role_id = ra.ancestor_id
+		INNER JOIN "active_user_roles" ur ON ra.role_id = ur.role_id
+		WHERE ur.user_id = $1
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var orgID *uuid.UUID
+		if err := rows.Scan(&name, &orgID); err != nil {
+			return nil, err
+		}
+		entry.denies[name] = append(entry.denies[name], orgID)
+	}
+	return entry, rows.Err()
+}
+
+// loadOrgChain reads an organization and all of its ancestors. An unknown
+// organization has an empty chain.
+func loadOrgChain(db *sql.DB, orgID uuid.UUID) (*cachedOrgChain, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE org_chain AS (
+			SELECT id, parent_org_id FROM "organizations" WHERE id = $1
+			UNION
+			SELECT o.id, o.parent_org_id FROM "organizations" o
+			INNER JOIN org_chain c ON o.id = c.parent_org_id
+		)
+		SELECT id FROM org_chain
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entry := &cachedOrgChain{loadedAt: time.Now()}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		entry.ids = append(entry.ids, id)
+	}
+	return entry, rows.Err()
+}
+
+// hasGlobal reports whether the user holds permissionName through a
+// system-scope assignment
+func (e *cachedUserPermissions) hasGlobal(permissionName string) bool {
+	for _, grant := range e.grants[permissionName] {
+		if grant.orgID == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasInOrgs reports whether the user holds permissionName through an assignment
+// in one of orgIDs. Permissions with scope_level "system" never count here.
+func (e *cachedUserPermissions) hasInOrgs(permissionName string, orgIDs []uuid.UUID) bool {
+	for _, grant := range e.grants[permissionName] {
+		if grant.orgID == nil || grant.scopeLevel == models.PermissionScopeSystem {
+			continue
+		}
+		for _, id := range orgIDs {
+			if *grant.orgID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deniedIn reports whether a role of the user explicitly denies permissionName
+// through a system-scope assignment or an assignment in one of orgIDs
+func (e *cachedUserPermissions) deniedIn(permissionName string, orgIDs []uuid.UUID) bool {
+	for _, orgID := range e.denies[permissionName] {
+		if orgID == nil {
+			return true
+		}
+		for _, id := range orgIDs {
+			if *orgID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StartPermissionCache subscribes to PermissionsChannel so that changes made
+// through any replica (or directly in the database) invalidate this process's
+// cache. Without it, entries still expire after PERMISSION_CACHE_TTL.
+func StartPermissionCache(dbURL string) error {
+	if permissions.ttl == 0 {
+		return nil
+	}
+
+	c := permissions
+	c.listener = pq.NewListener(dbURL, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("permission cache: listener: %v\n", err)
+		}
+		// Notifications may have been missed while disconnected
+		if event == pq.ListenerEventReconnected {
+			c.invalidate("*")
+		}
+	})
+	if err := c.listener.Listen(PermissionsChannel); err != nil {
+		c.listener.Close()
+		c.listener = nil
+		return err
+	}
+
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.worker()
+	return nil
+}
+
+// StopPermissionCache stops listening for invalidations
+func StopPermissionCache() {
+	c := permissions
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+		c.listener.Close()
+		c.stop = nil
+	}
+}
+
+// worker applies notifications and pings the connection when idle so a dead
+// connection is noticed and re-established
+func (c *permissionCache) worker() {
+	defer close(c.done)
+	for {
+		select {
+		case <-c.stop:
+			return
+		case n := <-c.listener.Notify:
+			// A nil notification follows a reconnect; that is handled by the event callback
+			if n != nil {
+				c.invalidate(n.Extra)
+			}
+		case <-time.After(90 * time.Second):
+			go c.listener.Ping()
+		}
+	}
+}
@@ -0,0 +1,570 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"pillow/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Attributes are the facts policy conditions are evaluated against, keyed by
+// dotted names:
+//
+//	subject.id, subject.username, subject.email, subject.status, subject.principal_type,
+//	subject.roles, subject.org_ids, subject.custom.<field>
+//	resource.type, resource.id and, for users and organizations, the same
+//	attributes as the subject (users) or resource.name, resource.parent_org_id
+//	context.time, context.date, context.time_of_day, context.weekday, context.hour,
+//	context.ip, context.method, context.path, context.org_id, context.api_key,
+//	context.impersonated
+//
+// Values are strings, float64s, bools or []strings. The resource is the first
+// entity named in the route path, e.g. the user of /api/users/{id}/roles.
+type Attributes map[string]interface{}
+
+// policyOperators are the operators a condition may use
+var policyOperators = map[string]bool{
+	models.PolicyOpEquals: true, models.PolicyOpNotEquals: true, models.PolicyOpIn: true, models.PolicyOpNotIn: true,
+	models.PolicyOpContains: true, models.PolicyOpGreater: true, models.PolicyOpGreaterOrEq: true, models.PolicyOpLess: true,
+	models.PolicyOpLessOrEq: true, models.PolicyOpCIDR: true, models.PolicyOpExists: true,
+}
+
+// resourceTypes maps route collections to the resource type of their entities
+var resourceTypes = map[string]string{
+	"users":            "user",
+	"organizations":    "organization",
+	"roles":            "role",
+	"permissions":      "permission",
+	"service-accounts": "service_account",
+	"oauth":            "oauth_client",
+	"policies":         "policy",
+}
+
+// ValidatePolicyCondition checks that a condition is well formed
+func ValidatePolicyCondition(c models.PolicyCondition) string {
+	if !strings.HasPrefix(c.Attribute, "subject.") && !strings.HasPrefix(c.Attribute, "resource.") &&
+		!strings.HasPrefix(c.Attribute, "context.") {
+		return "attribute must start with subject., resource. or context."
+	}
+	if !policyOperators[c.Operator] {
+		return "unknown operator " + strconv.Quote(c.Operator)
+	}
+	if c.ValueFrom != "" && len(c.Value) > 0 {
+		return "value and value_from are mutually exclusive"
+	}
+	if c.ValueFrom == "" && len(c.Value) == 0 && c.Operator != models.PolicyOpExists {
+		return "value or value_from is required"
+	}
+	if len(c.Value) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(c.Value, &v); err != nil {
+			return "value is not valid JSON"
+		}
+		if c.Operator == models.PolicyOpCIDR {
+			for _, s := range toStrings(normalizeValue(v)) {
+				if !validCIDR(s) {
+					return "invalid CIDR " + strconv.Quote(s)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// policyApplies reports whether a policy covers a check of permissionName in
+// the organization chain orgChain (nil for global checks)
+func policyApplies(p models.Policy, permissionName string, orgChain []uuid.UUID) bool {
+	if p.Permission != permissionName && p.Permission != models.PolicyAnyPermission {
+		return false
+	}
+	return p.OrgID == nil || containsOrg(orgChain, *p.OrgID)
+}
+
+// applyPolicies combines the role-based decision for a permission with the
+// active policies that apply to it. Deny policies override any grant and allow
+// policies grant the permission when the user's roles do not; attributes are
+// only loaded when such a policy exists. Allow policies never grant
+// system-level permissions (not even through "*") and allow policies without
+// conditions are ignored.
+func applyPolicies(db *sql.DB, r *http.Request, userID uuid.UUID, permissionName string, orgID *uuid.UUID, granted bool) (bool, error) {
+	policies, err := permissions.policies(db)
+	if err != nil || len(policies) == 0 {
+		return granted, err
+	}
+
+	var chain []uuid.UUID
+	if orgID != nil {
+		if chain, err = permissions.orgChain(db, *orgID); err != nil {
+			return false, err
+		}
+	}
+
+	// Only the policies that could change the decision are evaluated
+	effect := models.PolicyEffectAllow
+	if granted {
+		effect = models.PolicyEffectDeny
+	}
+	var candidates []models.Policy
+	for _, p := range policies {
+		if p.Effect == effect && policyApplies(p, permissionName, chain) && (granted || len(p.Conditions) > 0) {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return granted, nil
+	}
+
+	if !granted {
+		// Allow policies cannot revive a deactivated account
+		entry, err := permissions.user(db, userID)
+		if err != nil || !entry.isActive {
+			return false, err
+		}
+		var scopeLevel string
+		err = db.QueryRow(`SELECT COALESCE(scope_level, '') FROM "permissions" WHERE name = $1`, permissionName).Scan(&scopeLevel)
+		if err == sql.ErrNoRows || scopeLevel == models.PermissionScopeSystem {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	attrs, err := RequestAttributes(db, r, userID, chain)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range candidates {
+		if PolicyMatches(p, attrs, time.Now()) {
+			return !granted, nil
+		}
+	}
+	return granted, nil
+}
+
+// PolicyMatches reports whether all conditions of a policy hold for attrs, with
+// the context time attributes taken at now in the policy's time zone
+func PolicyMatches(p models.Policy, attrs Attributes, now time.Time) bool {
+	setTimeAttributes(attrs, p.Timezone, now)
+	for _, c := range p.Conditions {
+		if !conditionMatches(c, attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+// setTimeAttributes sets the context time attributes to now in timezone
+func setTimeAttributes(attrs Attributes, timezone string, now time.Time) {
+	if loc, err := time.LoadLocation(timezone); err == nil {
+		now = now.In(loc)
+	} else {
+		now = now.UTC()
+	}
+	attrs["context.time"] = now.Format(time.RFC3339)
+	attrs["context.date"] = now.Format("2006-01-02")
+	attrs["context.time_of_day"] = now.Format("15:04")
+	attrs["context.weekday"] = strings.ToLower(now.Weekday().String())
+	attrs["context.hour"] = float64(now.Hour())
+}
+
+// conditionMatches evaluates one condition. A missing attribute only matches
+// "exists" with value false.
+func conditionMatches(c models.PolicyCondition, attrs Attributes) bool {
+	actual, present := attrs[c.Attribute]
+	if c.Operator == models.PolicyOpExists {
+		want := true
+		if len(c.Value) > 0 {
+			json.Unmarshal(c.Value, &want)
+		}
+		return present == want
+	}
+	if !present {
+		return false
+	}
+
+	var expected interface{}
+	if c.ValueFrom != "" {
+		var ok bool
+		if expected, ok = attrs[c.ValueFrom]; !ok {
+			return false
+		}
+	} else {
+		if err := json.Unmarshal(c.Value, &expected); err != nil {
+			return false
+		}
+		expected = normalizeValue(expected)
+	}
+
+	switch c.Operator {
+	case models.PolicyOpEquals:
+		return valuesEqual(actual, expected)
+	case models.PolicyOpNotEquals:
+		return !valuesEqual(actual, expected)
+	case models.PolicyOpIn:
+		return intersects(toStrings(actual), toStrings(expected))
+	case models.PolicyOpNotIn:
+		return !intersects(toStrings(actual), toStrings(expected))
+	case models.PolicyOpContains:
+		if s, ok := actual.(string); ok {
+			return strings.Contains(s, scalarString(expected))
+		}
+		return intersects(toStrings(actual), toStrings(expected))
+	case models.PolicyOpGreater, models.PolicyOpGreaterOrEq, models.PolicyOpLess, models.PolicyOpLessOrEq:
+		cmp, ok := compareValues(actual, expected)
+		if !ok {
+			return false
+		}
+		switch c.Operator {
+		case models.PolicyOpGreater:
+			return cmp > 0
+		case models.PolicyOpGreaterOrEq:
+			return cmp >= 0
+		case models.PolicyOpLess:
+			return cmp < 0
+		default:
+			return cmp <= 0
+		}
+	case models.PolicyOpCIDR:
+		ip := net.ParseIP(scalarString(actual))
+		if ip == nil {
+			return false
+		}
+		for _, s := range toStrings(expected) {
+			if !strings.Contains(s, "/") {
+				if other := net.ParseIP(s); other != nil && other.Equal(ip) {
+					return true
+				}
+				continue
+			}
+			if _, n, err := net.ParseCIDR(s); err == nil && n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeValue turns decoded JSON arrays into []string
+func normalizeValue(v interface{}) interface{} {
+	if list, ok := v.([]interface{}); ok {
+		values := make([]string, 0, len(list))
+		for _, item := range list {
+			values = append(values, scalarString(item))
+		}
+		return values
+	}
+	return v
+}
+
+// scalarString formats a scalar attribute value for comparison
+func scalarString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// toStrings returns the elements of a list value, or a scalar as a one-element list
+func toStrings(v interface{}) []string {
+	if list, ok := v.([]string); ok {
+		return list
+	}
+	return []string{scalarString(v)}
+}
+
+// scalarsEqual compares numerically when both values are numbers
+func scalarsEqual(a, b string) bool {
+	if x, err := strconv.ParseFloat(a, 64); err == nil {
+		if y, err := strconv.ParseFloat(b, 64); err == nil {
+			return x == y
+		}
+	}
+	return a == b
+}
+
+// valuesEqual compares two scalars, or two lists as sets
+func valuesEqual(a, b interface{}) bool {
+	listA, aIsList := a.([]string)
+	listB, bIsList := b.([]string)
+	if aIsList != bIsList {
+		return false
+	}
+	if !aIsList {
+		return scalarsEqual(scalarString(a), scalarString(b))
+	}
+	if len(listA) != len(listB) {
+		return false
+	}
+	for _, x := range listA {
+		if !intersects([]string{x}, listB) {
+			return false
+		}
+	}
+	return true
+}
+
+// intersects reports whether the lists share an element
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if scalarsEqual(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compareValues orders two scalars, numerically when both are numbers and as
+// strings otherwise, which suits times of day and ISO dates
+func compareValues(a, b interface{}) (int, bool) {
+	if _, ok := a.([]string); ok {
+		return 0, false
+	}
+	if _, ok := b.([]string); ok {
+		return 0, false
+	}
+	x, y := scalarString(a), scalarString(b)
+	if fx, err := strconv.ParseFloat(x, 64); err == nil {
+		if fy, err := strconv.ParseFloat(y, 64); err == nil {
+			switch {
+			case fx < fy:
+				return -1, true
+			case fx > fy:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return strings.Compare(x, y), true
+}
+
+// validCIDR reports whether s is an IP address or CIDR block
+func validCIDR(s string) bool {
+	if strings.Contains(s, "/") {
+		_, _, err := net.ParseCIDR(s)
+		return err == nil
+	}
+	return net.ParseIP(s) != nil
+}
+
+// RequestAttributes collects the subject, resource and request context
+// attributes of r for the authenticated user userID. orgChain is the
+// organization the check is made in followed by its ancestors, if any.
+func RequestAttributes(db *sql.DB, r *http.Request, userID uuid.UUID, orgChain []uuid.UUID) (Attributes, error) {
+	attrs := Attributes{}
+	if err := loadUserAttributes(db, attrs, "subject.", userID, orgChain); err != nil {
+		return nil, err
+	}
+	if err := loadResourceAttributes(db, attrs, r); err != nil {
+		return nil, err
+	}
+
+	attrs["context.ip"] = ClientIP(r)
+	attrs["context.method"] = r.Method
+	attrs["context.path"] = r.URL.Path
+	if len(orgChain) > 0 {
+		attrs["context.org_id"] = orgChain[0].String()
+	}
+	_, isAPIKey := GetAPIKeyFromContext(r.Context())
+	attrs["context.api_key"] = isAPIKey
+	impersonated := false
+	if user, ok := GetUserFromContext(r.Context()); ok {
+		impersonated = user.ImpersonatorID != nil
+	}
+	attrs["context.impersonated"] = impersonated
+	return attrs, nil
+}
+
+// loadUserAttributes adds the attributes of a user under prefix. Roles are those
+// assigned globally or in one of orgChain.
+func loadUserAttributes(db *sql.DB, attrs Attributes, prefix string, userID uuid.UUID, orgChain []uuid.UUID) error {
+	var username, email, status, principalType string
+	err := db.QueryRow(`SELECT username, email, COALESCE(status, ''), COALESCE(principal_type, '') FROM "users" WHERE id = $1`,
+		userID).Scan(&username, &email, &status, &principalType)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	attrs[prefix+"id"] = userID.String()
+	attrs[prefix+"username"] = username
+	attrs[prefix+"email"] = email
+	attrs[prefix+"status"] = status
+	attrs[prefix+"principal_type"] = principalType
+
+	chain := make([]string, 0, len(orgChain))
+	for _, id := range orgChain {
+		chain = append(chain, id.String())
+	}
+	roles, err := queryStrings(db, `SELECT DISTINCT r.name FROM "roles" r
+		INNER JOIN "role_ancestry" ra ON r.id = ra.ancestor_id
+		INNER JOIN "active_user_roles" ur ON ra.role_id = ur.role_id
+		WHERE ur.user_id = $1 AND (ur.org_id IS NULL OR ur.org_id = ANY($2::uuid[]))`, userID, pq.Array(chain))
+	if err != nil {
+		return err
+	}
+	attrs[prefix+"roles"] = roles
+
+	orgIDs, err := queryStrings(db, `SELECT org_id::text FROM "user_organizations" WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	attrs[prefix+"org_ids"] = orgIDs
+
+	rows, err := db.Query(`SELECT cf.name, v.value FROM "user_custom_field_values" v
+		INNER JOIN "custom_fields" cf ON cf.id = v.field_id
+		WHERE v.user_id = $1 AND cf.is_active AND v.value IS NOT NULL`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		// Multiselect values are stored as JSON arrays
+		var list []string
+		if strings.HasPrefix(value, "[") && json.Unmarshal([]byte(value), &list) == nil {
+			attrs[prefix+"custom."+name] = list
+		} else {
+			attrs[prefix+"custom."+name] = value
+		}
+	}
+	return rows.Err()
+}
+
+// loadResourceAttributes adds the attributes of the first entity named in the
+// path of the matched route
+func loadResourceAttributes(db *sql.DB, attrs Attributes, r *http.Request) error {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+
+	segments := strings.Split(strings.Trim(tmpl, "/"), "/")
+	for i := 1; i < len(segments); i++ {
+		if !strings.HasPrefix(segments[i], "{") {
+			continue
+		}
+		name := strings.SplitN(strings.Trim(segments[i], "{}"), ":", 2)[0]
+		collection := segments[i-1]
+		resourceType, ok := resourceTypes[collection]
+		if !ok {
+			resourceType = collection
+		}
+		value := mux.Vars(r)[name]
+		attrs["resource.type"] = resourceType
+		attrs["resource.id"] = value
+
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return nil
+		}
+		switch resourceType {
+		case "user":
+			return loadUserAttributes(db, attrs, "resource.", id, nil)
+		case "organization":
+			var name string
+			var parentID sql.NullString
+			err := db.QueryRow(`SELECT name, parent_org_id FROM "organizations" WHERE id = $1`, id).Scan(&name, &parentID)
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			attrs["resource.name"] = name
+			if parentID.Valid {
+				attrs["resource.parent_org_id"] = parentID.String
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// queryStrings runs a query returning a single text column
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// LoadPolicies reads policies, all of them or only the active ones
+func LoadPolicies(db *sql.DB, activeOnly bool) ([]models.Policy, error) {
+	query := `SELECT ` + PolicyColumns + ` FROM "policies"`
+	if activeOnly {
+		query += ` WHERE is_active`
+	}
+	rows, err := db.Query(query + ` ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []models.Policy{}
+	for rows.Next() {
+		p, err := ScanPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// PolicyColumns are the columns read by ScanPolicy
+const PolicyColumns = `id, name, COALESCE(description, ''), effect, permission, org_id, conditions, timezone, is_active,
+	created_at, updated_at`
+
+// ScanPolicy scans a row selected with PolicyColumns
+func ScanPolicy(row interface{ Scan(...interface{}) error }) (models.Policy, error) {
+	var p models.Policy
+	var conditions []byte
+	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.Effect, &p.Permission, &p.OrgID, &conditions, &p.Timezone,
+		&p.IsActive, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return p, err
+	}
+	p.Conditions = []models.PolicyCondition{}
+	if len(conditions) > 0 {
+		err = json.Unmarshal(conditions, &p.Conditions)
+	}
+	return p, err
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"encoding/json"
+	"pillow/models"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestConditionMatches(t *testing.T) {
+	attrs := Attributes{
+		"subject.id":                 "4f1c",
+		"subject.status":             "active",
+		"subject.roles":              []string{"admin", "auditor"},
+		"subject.custom.department":  "sales",
+		"subject.custom.level":       "3",
+		"resource.custom.department": "sales",
+		"resource.custom.level":      "5",
+		"resource.email":             "jane@example.com",
+		"context.ip":                 "10.1.2.3",
+		"context.hour":               float64(14),
+		"context.api_key":            false,
+	}
+
+	tests := []struct {
+		name      string
+		attribute string
+		operator  string
+		value     string
+		valueFrom string
+		want      bool
+	}{
+		{"eq string", "subject.status", models.PolicyOpEquals, `"active"`, "", true},
+		{"eq string mismatch", "subject.status", models.PolicyOpEquals, `"disabled"`, "", false},
+		{"eq number against numeric string", "subject.custom.level", models.PolicyOpEquals, `3`, "", true},
+		{"eq bool", "context.api_key", models.PolicyOpEquals, `false`, "", true},
+		{"eq list as set", "subject.roles", models.PolicyOpEquals, `["auditor", "admin"]`, "", true},
+		{"eq list against scalar", "subject.roles", models.PolicyOpEquals, `"admin"`, "", false},
+		{"ne", "subject.status", models.PolicyOpNotEquals, `"disabled"`, "", true},
+		{"ne equal", "subject.status", models.PolicyOpNotEquals, `"active"`, "", false},
+		{"in scalar", "subject.status", models.PolicyOpIn, `["active", "pending_verification"]`, "", true},
+		{"in list", "subject.roles", models.PolicyOpIn, `["auditor"]`, "", true},
+		{"in none", "subject.roles", models.PolicyOpIn, `["viewer"]`, "", false},
+		{"not_in", "subject.roles", models.PolicyOpNotIn, `["viewer"]`, "", true},
+		{"not_in shared", "subject.roles", models.PolicyOpNotIn, `["admin"]`, "", false},
+		{"contains substring", "resource.email", models.PolicyOpContains, `"@example.com"`, "", true},
+		{"contains list element", "subject.roles", models.PolicyOpContains, `"admin"`, "", true},
+		{"contains missing element", "subject.roles", models.PolicyOpContains, `"viewer"`, "", false},
+		{"gt number", "context.hour", models.PolicyOpGreater, `9`, "", true},
+		{"gt numeric not lexical", "context.hour", models.PolicyOpGreater, `100`, "", false},
+		{"gte equal", "context.hour", models.PolicyOpGreaterOrEq, `14`, "", true},
+		{"lt", "context.hour", models.PolicyOpLess, `14`, "", false},
+		{"lte equal", "context.hour", models.PolicyOpLessOrEq, `14`, "", true},
+		{"gt list never orders", "subject.roles", models.PolicyOpGreater, `"a"`, "", false},
+		{"cidr block", "context.ip", models.PolicyOpCIDR, `"10.0.0.0/8"`, "", true},
+		{"cidr outside", "context.ip", models.PolicyOpCIDR, `["192.168.0.0/16"]`, "", false},
+		{"cidr single address", "context.ip", models.PolicyOpCIDR, `["192.168.0.1", "10.1.2.3"]`, "", true},
+		{"exists", "subject.id", models.PolicyOpExists, ``, "", true},
+		{"exists false on present", "subject.id", models.PolicyOpExists, `false`, "", false},
+		{"value_from equal", "resource.custom.department", models.PolicyOpEquals, ``, "subject.custom.department", true},
+		{"value_from ordered", "resource.custom.level", models.PolicyOpGreater, ``, "subject.custom.level", true},
+		{"value_from ne", "resource.custom.department", models.PolicyOpNotEquals, ``, "subject.custom.department", false},
+		{"missing attribute eq", "subject.custom.team", models.PolicyOpEquals, `"x"`, "", false},
+		{"missing attribute ne", "subject.custom.team", models.PolicyOpNotEquals, `"x"`, "", false},
+		{"missing attribute not_in", "subject.custom.team", models.PolicyOpNotIn, `["x"]`, "", false},
+		{"missing attribute exists", "subject.custom.team", models.PolicyOpExists, ``, "", false},
+		{"missing attribute exists false", "subject.custom.team", models.PolicyOpExists, `false`, "", true},
+		{"missing value_from", "resource.custom.department", models.PolicyOpEquals, ``, "subject.custom.team", false},
+		{"missing value_from ne", "resource.custom.department", models.PolicyOpNotEquals, ``, "subject.custom.team", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := models.PolicyCondition{Attribute: tt.attribute, Operator: tt.operator, ValueFrom: tt.valueFrom}
+			if tt.value != "" {
+				c.Value = json.RawMessage(tt.value)
+			}
+			if msg := ValidatePolicyCondition(c); msg != "" {
+				t.Fatalf("condition is invalid: %s", msg)
+			}
+			if got := conditionMatches(c, attrs); got != tt.want {
+				t.Errorf("conditionMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyMatchesTimeWindows(t *testing.T) {
+	businessHours := []models.PolicyCondition{
+		{Attribute: "context.time_of_day", Operator: models.PolicyOpGreaterOrEq, Value: json.RawMessage(`"09:00"`)},
+		{Attribute: "context.time_of_day", Operator: models.PolicyOpLess, Value: json.RawMessage(`"17:00"`)},
+		{Attribute: "context.weekday", Operator: models.PolicyOpIn, Value: json.RawMessage(`["monday", "tuesday", "wednesday", "thursday", "friday"]`)},
+	}
+	onDate := []models.PolicyCondition{
+		{Attribute: "context.date", Operator: models.PolicyOpEquals, Value: json.RawMessage(`"2024-03-01"`)},
+	}
+
+	tests := []struct {
+		name       string
+		conditions []models.PolicyCondition
+		timezone   string
+		now        time.Time
+		want       bool
+	}{
+		{"inside window in UTC", businessHours, "UTC", time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC), true},
+		{"end of window is exclusive", businessHours, "UTC", time.Date(2024, 3, 4, 17, 0, 0, 0, time.UTC), false},
+		{"UTC morning is before hours in New York", businessHours, "America/New_York", time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC), false},
+		{"UTC afternoon is inside hours in New York", businessHours, "America/New_York", time.Date(2024, 3, 4, 15, 0, 0, 0, time.UTC), true},
+		{"UTC night is business hours in Tokyo", businessHours, "Asia/Tokyo", time.Date(2024, 3, 4, 0, 30, 0, 0, time.UTC), true},
+		{"Friday in UTC is Saturday morning in Auckland", businessHours, "Pacific/Auckland", time.Date(2024, 3, 8, 21, 0, 0, 0, time.UTC), false},
+		{"Sunday in UTC is Monday morning in Auckland", businessHours, "Pacific/Auckland", time.Date(2024, 3, 3, 21, 0, 0, 0, time.UTC), true},
+		{"daylight saving time in Berlin", businessHours, "Europe/Berlin", time.Date(2024, 7, 1, 7, 30, 0, 0, time.UTC), true},
+		{"standard time in Berlin", businessHours, "Europe/Berlin", time.Date(2024, 1, 8, 7, 30, 0, 0, time.UTC), false},
+		{"date follows the time zone", onDate, "Pacific/Auckland", time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), true},
+		{"date in UTC", onDate, "UTC", time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), false},
+		{"unknown time zone falls back to UTC", businessHours, "Mars/Olympus", time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC), true},
+		{"no conditions", nil, "UTC", time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := models.Policy{Effect: models.PolicyEffectAllow, Permission: "view_users", Conditions: tt.conditions, Timezone: tt.timezone}
+			if got := PolicyMatches(p, Attributes{}, tt.now); got != tt.want {
+				t.Errorf("PolicyMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"database/sql"
 	"net/http"
 	"pillow/models"
@@ -14,7 +15,7 @@ func GetUserRoles(db *sql.DB, userID uuid.UUID) ([]models.Role, error) {
 	query := `
 		SELECT r.id, r.name, r.description, r.created_at
 		FROM "roles" r
-		INNER JOIN "user_roles" ur ON r.id = ur.role_id
+		INNER JOIN "active_user_roles" ur ON r.id = ur.role_id
 		WHERE ur.user_id = $1
 	`
 
@@ -37,14 +38,21 @@ func GetUserRoles(db *sql.DB, userID uuid.UUID) ([]models.Role, error) {
 	return roles, nil
 }
 
-// GetUserPermissions retrieves all permissions for a given user through their roles
+// GetUserPermissions retrieves all permissions for a given user through their
+// roles and the roles those inherit from, except those a role of a system-scope
+// assignment explicitly denies
 func GetUserPermissions(db *sql.DB, userID uuid.UUID) ([]models.Permission, error) {
 	query := `
 		SELECT DISTINCT p.id, p.name, p.description, p.scope_level
 		FROM "permissions" p
 		INNER JOIN "role_permissions" rp ON p.id = rp.permission_id
-		INNER JOIN "user_roles" ur ON rp.role_id = ur.role_id
+		INNER JOIN "role_ancestry" ra ON rp.role_id = ra.ancestor_id
+		INNER JOIN "active_user_roles" ur ON ra.role_id = ur.role_id
 		WHERE ur.user_id = $1
+		AND NOT EXISTS (SELECT 1 FROM "role_denied_permissions" rd
+			INNER JOIN "role_ancestry" dra ON rd.role_id = dra.ancestor_id
+			INNER JOIN "active_user_roles" dur ON dra.role_id = dur.role_id
+			WHERE dur.user_id = $1 AND dur.org_id IS NULL AND rd.permission_id = p.id)
 	`
 
 	rows, err := db.Query(query, userID)
@@ -66,32 +74,81 @@ func GetUserPermissions(db *sql.DB, userID uuid.UUID) ([]models.Permission, erro
 	return permissions, nil
 }
 
-// HasPermission checks if a user has a specific permission
+// HasPermission checks if a user has a specific permission globally, i.e.
+// through a system-scope role assignment. Roles granted within an organization
+// only count for HasPermissionInOrg. Inactive users have no permissions, and
+// a permission explicitly denied by a role of a system-scope assignment is not
+// held however else it is granted. The answer comes from the permission cache;
+// policies are not consulted, see CheckPermission.
 func HasPermission(db *sql.DB, userID uuid.UUID, permissionName string) (bool, error) {
-	query := `
-		SELECT COUNT(*) > 0
-		FROM "permissions" p
-		INNER JOIN "role_permissions" rp ON p.id = rp.permission_id
-		INNER JOIN "user_roles" ur ON rp.role_id = ur.role_id
-		WHERE ur.user_id = $1 AND p.name = $2
-	`
+	entry, err := permissions.user(db, userID)
+	if err != nil {
+		return false, err
+	}
+	return entry.isActive && entry.hasGlobal(permissionName) && !entry.deniedIn(permissionName, nil), nil
+}
 
-	var hasPermission bool
-	err := db.QueryRow(query, userID, permissionName).Scan(&hasPermission)
+// HasPermissionInOrg checks if a user has a specific permission in an
+// organization: through a system-scope role assignment, or through a role
+// assigned in the organization or one of its parent organizations. Permissions
+// with scope_level "system" can only be held globally. A role explicitly
+// denying the permission, assigned globally or in the organization or a
+// parent, overrides every grant.
+func HasPermissionInOrg(db *sql.DB, userID, orgID uuid.UUID, permissionName string) (bool, error) {
+	entry, err := permissions.user(db, userID)
 	if err != nil {
 		return false, err
 	}
+	if !entry.isActive || entry.deniedIn(permissionName, nil) {
+		return false, nil
+	}
+	global := entry.hasGlobal(permissionName)
+	if !global && len(entry.grants[permissionName]) == 0 {
+		return false, nil
+	}
+	if global && len(entry.denies[permissionName]) == 0 {
+		return true, nil
+	}
 
-	return hasPermission, nil
+	chain, err := permissions.orgChain(db, orgID)
+	if err != nil {
+		return false, err
+	}
+	if entry.deniedIn(permissionName, chain) {
+		return false, nil
+	}
+	return global || entry.hasInOrgs(permissionName, chain), nil
 }
 
-// HasRole checks if a user has a specific role
+// deniedByRole reports whether a role of the user explicitly denies
+// permissionName in the checked scope. Such denies are final: not even allow
+// policies override them.
+func deniedByRole(db *sql.DB, userID uuid.UUID, permissionName string, orgID *uuid.UUID) (bool, error) {
+	entry, err := permissions.user(db, userID)
+	if err != nil {
+		return false, err
+	}
+	if len(entry.denies[permissionName]) == 0 {
+		return false, nil
+	}
+	var chain []uuid.UUID
+	if orgID != nil {
+		if chain, err = permissions.orgChain(db, *orgID); err != nil {
+			return false, err
+		}
+	}
+	return entry.deniedIn(permissionName, chain), nil
+}
+
+// HasRole checks if a user has a specific role through a system-scope
+// assignment, either directly or through a role inheriting from it
 func HasRole(db *sql.DB, userID uuid.UUID, roleName string) (bool, error) {
 	query := `
 		SELECT COUNT(*) > 0
 		FROM "roles" r
-		INNER JOIN "user_roles" ur ON r.id = ur.role_id
-		WHERE ur.user_id = $1 AND r.name = $2
+		INNER JOIN "role_ancestry" ra ON r.id = ra.ancestor_id
+		INNER JOIN "active_user_roles" ur ON ra.role_id = ur.role_id
+		WHERE ur.user_id = $1 AND r.name = $2 AND ur.org_id IS NULL
 	`
 
 	var hasRole bool
@@ -103,6 +160,36 @@ func HasRole(db *sql.DB, userID uuid.UUID, roleName string) (bool, error) {
 	return hasRole, nil
 }
 
+// apiKeyAllows reports whether the credential of r covers permissionName. Access
+// tokens carry all of the user's permissions; API keys may be scoped to a subset.
+func apiKeyAllows(r *http.Request, permissionName string) bool {
+	apiKey, ok := GetAPIKeyFromContext(r.Context())
+	return !ok || apiKey.AllowsPermission(permissionName)
+}
+
+// authorize decides whether a user may use permissionName, globally when orgID
+// is nil or within the organization otherwise: the role-based decision of
+// HasPermission/HasPermissionInOrg, adjusted by the policies that apply (see
+// policy.go) unless a role explicitly denies the permission. r supplies the
+// resource and context attributes.
+func authorize(db *sql.DB, r *http.Request, userID uuid.UUID, permissionName string, orgID *uuid.UUID) (bool, error) {
+	denied, err := deniedByRole(db, userID, permissionName, orgID)
+	if err != nil || denied {
+		return false, err
+	}
+
+	var granted bool
+	if orgID == nil {
+		granted, err = HasPermission(db, userID, permissionName)
+	} else {
+		granted, err = HasPermissionInOrg(db, userID, *orgID, permissionName)
+	}
+	if err != nil {
+		return false, err
+	}
+	return applyPolicies(db, r, userID, permissionName, orgID, granted)
+}
+
 // RequirePermission creates middleware that requires a specific permission
 func RequirePermission(db *sql.DB, permissionName string) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
@@ -113,13 +200,19 @@ func RequirePermission(db *sql.DB, permissionName string) func(http.HandlerFunc)
 				return
 			}
 
-			hasPermission, err := HasPermission(db, user.ID, permissionName)
+			if !apiKeyAllows(r, permissionName) {
+				http.Error(w, "API key scope does not include this permission", http.StatusForbidden)
+				return
+			}
+
+			hasPermission, err := authorize(db, r, user.ID, permissionName, nil)
 			if err != nil {
 				http.Error(w, "Error checking permissions", http.StatusInternalServerError)
 				return
 			}
 
 			if !hasPermission {
+				w.Header().Set(RequiredPermissionHeader, permissionName)
 				http.Error(w, "Insufficient permissions", http.StatusForbidden)
 				return
 			}
@@ -167,7 +260,10 @@ func RequireAnyPermission(db *sql.DB, permissionNames ...string) func(http.Handl
 
 			hasAnyPermission := false
 			for _, permissionName := range permissionNames {
-				hasPermission, err := HasPermission(db, user.ID, permissionName)
+				if !apiKeyAllows(r, permissionName) {
+					continue
+				}
+				hasPermission, err := authorize(db, r, user.ID, permissionName, nil)
 				if err != nil {
 					http.Error(w, "Error checking permissions", http.StatusInternalServerError)
 					return
@@ -198,13 +294,19 @@ func RequirePermissionMux(db *sql.DB, permissionName string) mux.MiddlewareFunc
 				return
 			}
 
-			hasPermission, err := HasPermission(db, user.ID, permissionName)
+			if !apiKeyAllows(r, permissionName) {
+				http.Error(w, "API key scope does not include this permission", http.StatusForbidden)
+				return
+			}
+
+			hasPermission, err := authorize(db, r, user.ID, permissionName, nil)
 			if err != nil {
 				http.Error(w, "Error checking permissions", http.StatusInternalServerError)
 				return
 			}
 
 			if !hasPermission {
+				w.Header().Set(RequiredPermissionHeader, permissionName)
 				http.Error(w, "Insufficient permissions", http.StatusForbidden)
 				return
 			}
@@ -214,6 +316,95 @@ func RequirePermissionMux(db *sql.DB, permissionName string) mux.MiddlewareFunc
 	}
 }
 
+// RequiredPermissionHeader names the permission a 403 from the permission
+// middleware was missing, so clients can offer an access request for it
+const RequiredPermissionHeader = "X-Required-Permission"
+
+// CheckPermission reports whether the request's credential allows a permission,
+// globally when orgID is nil or within the organization otherwise, taking
+// policies into account. It is for handlers whose scope is only known from the
+// request body.
+func CheckPermission(db *sql.DB, r *http.Request, permissionName string, orgID *uuid.UUID) (bool, error) {
+	user, ok := GetUserFromContext(r.Context())
+	if !ok || !apiKeyAllows(r, permissionName) {
+		return false, nil
+	}
+	return authorize(db, r, user.ID, permissionName, orgID)
+}
+
+// OrgIDHeader carries the organization a request acts in, for routes whose path
+// does not contain it
+const OrgIDHeader = "X-Organization-ID"
+
+// orgIDFromRequest returns the organization a request acts in, taken from the
+// route variable routeVar when the route has one and from OrgIDHeader otherwise
+func orgIDFromRequest(r *http.Request, routeVar string) (uuid.UUID, bool, error) {
+	value := ""
+	if routeVar != "" {
+		value = mux.Vars(r)[routeVar]
+	}
+	if value == "" {
+		value = r.Header.Get(OrgIDHeader)
+	}
+	if value == "" {
+		return uuid.Nil, false, nil
+	}
+	orgID, err := uuid.Parse(value)
+	return orgID, true, err
+}
+
+// RequireOrgPermissionMux creates Gorilla Mux compatible middleware that requires
+// a permission in the organization named by the route variable routeVar (or the
+// X-Organization-ID header). The organization is added to the request context,
+// see GetOrgIDFromContext.
+func RequireOrgPermissionMux(db *sql.DB, permissionName, routeVar string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := GetUserFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+
+			orgID, ok, err := orgIDFromRequest(r, routeVar)
+			if err != nil {
+				http.Error(w, "Invalid organization ID format", http.StatusBadRequest)
+				return
+			}
+			if !ok {
+				http.Error(w, "Organization ID required", http.StatusBadRequest)
+				return
+			}
+
+			if !apiKeyAllows(r, permissionName) {
+				http.Error(w, "API key scope does not include this permission", http.StatusForbidden)
+				return
+			}
+
+			hasPermission, err := authorize(db, r, user.ID, permissionName, &orgID)
+			if err != nil {
+				http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+				return
+			}
+
+			if !hasPermission {
+				w.Header().Set(RequiredPermissionHeader, permissionName)
+				http.Error(w, "Insufficient permissions", http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), OrgContextKey, orgID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// GetOrgIDFromContext retrieves the organization set by RequireOrgPermissionMux
+func GetOrgIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	orgID, ok := ctx.Value(OrgContextKey).(uuid.UUID)
+	return orgID, ok
+}
+
 // RequireRoleMux creates Gorilla Mux compatible middleware that requires a specific role
 func RequireRoleMux(db *sql.DB, roleName string) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"database/sql"
+	"log"
+	"pillow/audit"
+	"pillow/config"
+	"pillow/models"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultRoleExpirySweepInterval is how often expired role assignments are
+// removed, and pending access requests past their expiry closed, unless
+// ROLE_EXPIRY_SWEEP_INTERVAL says otherwise. Permission checks ignore expired
+// assignments regardless; the sweep keeps user_roles tidy and records each
+// expiry in the audit log.
+const defaultRoleExpirySweepInterval = time.Minute
+
+var roleExpiry struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// expiredRole is a role assignment removed by the sweeper
+type expiredRole struct {
+	UserID     uuid.UUID  `json:"user_id"`
+	RoleID     uuid.UUID  `json:"role_id"`
+	Scope      string     `json:"scope"`
+	OrgID      *uuid.UUID `json:"org_id,omitempty"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil time.Time  `json:"valid_until"`
+}
+
+// expiredAccessRequest is a pending access request closed by the sweeper
+type expiredAccessRequest struct {
+	RequestID    uuid.UUID  `json:"request_id"`
+	RoleID       *uuid.UUID `json:"role_id,omitempty"`
+	PermissionID *uuid.UUID `json:"permission_id,omitempty"`
+	OrgID        *uuid.UUID `json:"org_id,omitempty"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	userID       uuid.UUID
+}
+
+// StartRoleExpirySweeper periodically removes role assignments whose
+// valid_until has passed, auditing each as ROLE_EXPIRED, and marks pending
+// access requests past expires_at as expired, auditing each as
+// ACCESS_REQUEST_EXPIRED. Replicas can all run it; everything is expired and
+// audited once.
+func StartRoleExpirySweeper(db *sql.DB) {
+	interval := config.Duration("ROLE_EXPIRY_SWEEP_INTERVAL", defaultRoleExpirySweepInterval)
+
+	roleExpiry.stop = make(chan struct{})
+	roleExpiry.done = make(chan struct{})
+	go func() {
+		defer close(roleExpiry.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := sweepExpiredRoles(db); err != nil {
+				log.Printf("role expiry: %v\n", err)
+			}
+			if err := sweepExpiredAccessRequests(db); err != nil {
+				log.Printf("access request expiry: %v\n", err)
+			}
+			select {
+			case <-roleExpiry.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StopRoleExpirySweeper stops the sweeper
+func StopRoleExpirySweeper() {
+	if roleExpiry.stop != nil {
+		close(roleExpiry.stop)
+		<-roleExpiry.done
+		roleExpiry.stop = nil
+	}
+}
+
+// sweepExpiredRoles removes expired role assignments and audits them. The
+// audit rows are written in the transaction of the delete, so an assignment is
+// never removed without a record of it.
+func sweepExpiredRoles(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM "user_roles" WHERE valid_until <= NOW()
+		RETURNING user_id, role_id, scope, org_id, valid_from, valid_until`)
+	if err != nil {
+		return err
+	}
+
+	var expired []expiredRole
+	for rows.Next() {
+		var e expiredRole
+		if err := rows.Scan(&e.UserID, &e.RoleID, &e.Scope, &e.OrgID, &e.ValidFrom, &e.ValidUntil); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range expired {
+		userID := e.UserID
+		if err := audit.RecordTx(tx, "ROLE_EXPIRED", &userID, e); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sweepExpiredAccessRequests closes pending access requests nobody decided in
+// time and audits them, in one transaction as sweepExpiredRoles does
+func sweepExpiredAccessRequests(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`UPDATE "access_requests" SET status = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE status = $2 AND expires_at <= NOW()
+		RETURNING id, user_id, role_id, permission_id, org_id, expires_at`, models.AccessRequestExpired, models.AccessRequestPending)
+	if err != nil {
+		return err
+	}
+
+	var expired []expiredAccessRequest
+	for rows.Next() {
+		var e expiredAccessRequest
+		if err := rows.Scan(&e.RequestID, &e.userID, &e.RoleID, &e.PermissionID, &e.OrgID, &e.ExpiresAt); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range expired {
+		userID := e.userID
+		if err := audit.RecordTx(tx, "ACCESS_REQUEST_EXPIRED", &userID, e); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Access request states stored in access_requests.status
+const (
+	AccessRequestPending   = "pending"
+	AccessRequestApproved  = "approved"
+	AccessRequestRejected  = "rejected"
+	AccessRequestCancelled = "cancelled"
+	AccessRequestExpired   = "expired"
+)
+
+// AccessRequest is a user's request for a role, or for a permission, globally or
+// in an organization. Approving it assigns the role (for a permission request, a
+// role granting the permission chosen by the approver), from the approval for
+// DurationHours when set. Pending requests expire at ExpiresAt. Approvers are
+// the role's owner and the managers of the organization and its parents;
+// holders of assign_roles in the scope can decide as well.
+type AccessRequest struct {
+	ID             uuid.UUID   `json:"id" db:"id"`
+	UserID         uuid.UUID   `json:"user_id" db:"user_id"`
+	Username       string      `json:"username" db:"-"`
+	RoleID         *uuid.UUID  `json:"role_id,omitempty" db:"role_id"`
+	RoleName       string      `json:"role_name,omitempty" db:"-"`
+	PermissionID   *uuid.UUID  `json:"permission_id,omitempty" db:"permission_id"`
+	PermissionName string      `json:"permission,omitempty" db:"-"`
+	Scope          string      `json:"scope" db:"scope"`
+	OrgID          *uuid.UUID  `json:"org_id,omitempty" db:"org_id"`
+	DurationHours  *int        `json:"duration_hours,omitempty" db:"duration_hours"`
+	Justification  string      `json:"justification" db:"justification"`
+	Status         string      `json:"status" db:"status"`
+	Approvers      []uuid.UUID `json:"approvers" db:"-"`
+	DecidedBy      *uuid.UUID  `json:"decided_by,omitempty" db:"decided_by"`
+	DecidedAt      *time.Time  `json:"decided_at,omitempty" db:"decided_at"`
+	DecisionNote   string      `json:"decision_note,omitempty" db:"decision_note"`
+	ValidFrom      *time.Time  `json:"valid_from,omitempty" db:"valid_from"`
+	ValidUntil     *time.Time  `json:"valid_until,omitempty" db:"valid_until"`
+	ExpiresAt      time.Time   `json:"expires_at" db:"expires_at"`
+	CreatedAt      time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at" db:"updated_at"`
+}
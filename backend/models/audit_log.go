@@ -7,9 +7,11 @@ import (
 )
 
 type AuditLog struct {
-	ID        uuid.UUID  `json:"id" db:"id"`
-	UserID    *uuid.UUID `json:"user_id,omitempty" db:"user_id"`
-	Action    string     `json:"action" db:"action"`
-	Timestamp time.Time  `json:"timestamp" db:"timestamp"`
-	Details   string     `json:"details,omitempty" db:"details"`
+	ID             uuid.UUID  `json:"id" db:"id"`
+	UserID         *uuid.UUID `json:"user_id,omitempty" db:"user_id"`
+	ActorType      *string    `json:"actor_type,omitempty" db:"actor_type"`           // principal type of UserID: user or service_account
+	ImpersonatorID *uuid.UUID `json:"impersonator_id,omitempty" db:"impersonator_id"` // who acted as UserID, if impersonated
+	Action         string     `json:"action" db:"action"`
+	Timestamp      time.Time  `json:"timestamp" db:"timestamp"`
+	Details        string     `json:"details,omitempty" db:"details"`
 }
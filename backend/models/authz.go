@@ -0,0 +1,61 @@
+package models
+
+import "github.com/google/uuid"
+
+// PermissionGrant is one way a user holds a permission: RoleID grants it and is,
+// or is an ancestor of, AssignedRoleID, which the user holds in Scope/OrgID
+type PermissionGrant struct {
+	RoleID           uuid.UUID  `json:"role_id"`
+	RoleName         string     `json:"role_name"`
+	AssignedRoleID   uuid.UUID  `json:"assigned_role_id"`
+	AssignedRoleName string     `json:"assigned_role_name"`
+	Scope            string     `json:"scope"`
+	OrgID            *uuid.UUID `json:"org_id,omitempty"`
+}
+
+// EffectivePermission is a permission a user holds, with every grant of it,
+// and every explicit deny of it (RoleID denies it rather than granting it).
+// Denied permissions are listed even when no role grants them.
+type EffectivePermission struct {
+	Permission
+	GrantedBy []PermissionGrant `json:"granted_by"`
+	DeniedBy  []PermissionGrant `json:"denied_by,omitempty"`
+}
+
+// Results of an authorization evaluation step
+const (
+	AuthzStepPass    = "pass"
+	AuthzStepFail    = "fail"
+	AuthzStepMatch   = "match"
+	AuthzStepNoMatch = "no_match"
+)
+
+// AuthzExplanation is an authorization decision with the steps that led to it
+type AuthzExplanation struct {
+	UserID     uuid.UUID   `json:"user_id"`
+	Permission string      `json:"permission"`
+	OrgID      *uuid.UUID  `json:"org_id,omitempty"`
+	Allowed    bool        `json:"allowed"`
+	DecidedBy  string      `json:"decided_by"`
+	Steps      []AuthzStep `json:"steps"`
+}
+
+// AuthzStep is one step of an authorization evaluation. Grants are set for the
+// role and deny steps, Policy and Conditions for policy steps.
+type AuthzStep struct {
+	Step       string            `json:"step"`
+	Result     string            `json:"result"`
+	Detail     string            `json:"detail,omitempty"`
+	OrgChain   []uuid.UUID       `json:"org_chain,omitempty"`
+	Grants     []PermissionGrant `json:"grants,omitempty"`
+	Policy     *Policy           `json:"policy,omitempty"`
+	Conditions []ConditionResult `json:"conditions,omitempty"`
+}
+
+// ConditionResult is a policy condition with the values it compared
+type ConditionResult struct {
+	PolicyCondition
+	Actual   interface{} `json:"actual"`
+	Expected interface{} `json:"expected,omitempty"`
+	Matched  bool        `json:"matched"`
+}
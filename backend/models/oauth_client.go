@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OAuthClient is an application allowed to sign users in through pillow's
+// OpenID Connect provider. Its ID doubles as the OAuth "client_id". Public
+// clients (SPAs, mobile apps) have no secret and rely on PKCE alone.
+type OAuthClient struct {
+	ID           uuid.UUID `json:"client_id" db:"id"`
+	Name         string    `json:"name" db:"name"`
+	SecretHash   *string   `json:"-" db:"secret_hash"`
+	Confidential bool      `json:"confidential"`
+	RedirectURIs []string  `json:"redirect_uris" db:"redirect_uris"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// OAuthAuthorizationCode is a single-use code handed to a client's redirect URI.
+// Only the SHA-256 hash of the code is stored.
+type OAuthAuthorizationCode struct {
+	CodeHash      string     `json:"-" db:"code_hash"`
+	ClientID      uuid.UUID  `json:"client_id" db:"client_id"`
+	UserID        uuid.UUID  `json:"user_id" db:"user_id"`
+	RedirectURI   string     `json:"redirect_uri" db:"redirect_uri"`
+	Scope         string     `json:"scope" db:"scope"`
+	Nonce         string     `json:"-" db:"nonce"`
+	CodeChallenge string     `json:"-" db:"code_challenge"`
+	ExpiresAt     time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt        *time.Time `json:"used_at,omitempty" db:"used_at"`
+	SessionID     *uuid.UUID `json:"session_id,omitempty" db:"session_id"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+}
@@ -15,6 +15,7 @@ type Organization struct {
 	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
 	ParentOrgID *uuid.UUID `json:"parent_org_id,omitempty" db:"parent_org_id"`
+	RequireMFA  bool       `json:"require_mfa" db:"require_mfa"`
 }
 
 // OrganizationWithUsers represents an organization with its associated users
@@ -33,3 +34,13 @@ type UserOrganization struct {
 	CreatedAt time.Time  `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at" db:"updated_at"`
 }
+
+// OrganizationMember is a membership with the names of the user, the
+// organization and the member's role in it
+type OrganizationMember struct {
+	UserOrganization
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	OrgName  string `json:"org_name,omitempty"`
+	RoleName string `json:"role_name,omitempty"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PasswordPolicy holds the password rules for the whole installation (OrgID nil)
+// or for one organization. A user's effective policy is the strictest
+// combination of the global policy and the policies of all their organizations.
+type PasswordPolicy struct {
+	OrgID            *uuid.UUID `json:"org_id,omitempty" db:"org_id"`
+	MinLength        int        `json:"min_length" db:"min_length"`
+	RequireUppercase bool       `json:"require_uppercase" db:"require_uppercase"`
+	RequireLowercase bool       `json:"require_lowercase" db:"require_lowercase"`
+	RequireDigit     bool       `json:"require_digit" db:"require_digit"`
+	RequireSymbol    bool       `json:"require_symbol" db:"require_symbol"`
+	BannedWords      []string   `json:"banned_words" db:"banned_words"`
+	DisallowUserInfo bool       `json:"disallow_user_info" db:"disallow_user_info"`
+	HistorySize      int        `json:"history_size" db:"history_size"`
+	MaxAgeDays       int        `json:"max_age_days" db:"max_age_days"`
+	UpdatedAt        *time.Time `json:"updated_at,omitempty" db:"updated_at"`
+}
@@ -6,6 +6,15 @@ import (
 	"github.com/google/uuid"
 )
 
+// Permission scope levels stored in permissions.scope_level. System permissions
+// only take effect through system-scope role assignments; organization and user
+// permissions can also be granted within an organization.
+const (
+	PermissionScopeSystem = "system"
+	PermissionScopeOrg    = "organization"
+	PermissionScopeUser   = "user"
+)
+
 type Permission struct {
 	ID          uuid.UUID `json:"id" db:"id"`
 	Name        string    `json:"name" db:"name"`
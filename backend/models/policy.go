@@ -0,0 +1,59 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Policy effects. A matching deny policy overrides every grant; a matching
+// allow policy grants its permission in addition to the user's roles.
+const (
+	PolicyEffectAllow = "allow"
+	PolicyEffectDeny  = "deny"
+)
+
+// PolicyAnyPermission as a policy's permission makes it apply to every permission
+const PolicyAnyPermission = "*"
+
+// Condition operators
+const (
+	PolicyOpEquals      = "eq"
+	PolicyOpNotEquals   = "ne"
+	PolicyOpIn          = "in"
+	PolicyOpNotIn       = "not_in"
+	PolicyOpContains    = "contains"
+	PolicyOpGreater     = "gt"
+	PolicyOpGreaterOrEq = "gte"
+	PolicyOpLess        = "lt"
+	PolicyOpLessOrEq    = "lte"
+	PolicyOpCIDR        = "cidr"
+	PolicyOpExists      = "exists"
+)
+
+// Policy is an attribute-based access control rule evaluated alongside the
+// role-based permissions. It applies to checks of Permission (within OrgID and
+// its child organizations when set) and matches when all Conditions hold.
+type Policy struct {
+	ID          uuid.UUID         `json:"id" db:"id"`
+	Name        string            `json:"name" db:"name"`
+	Description string            `json:"description,omitempty" db:"description"`
+	Effect      string            `json:"effect" db:"effect"`
+	Permission  string            `json:"permission" db:"permission"`
+	OrgID       *uuid.UUID        `json:"org_id,omitempty" db:"org_id"`
+	Conditions  []PolicyCondition `json:"conditions" db:"conditions"`
+	Timezone    string            `json:"timezone" db:"timezone"`
+	IsActive    bool              `json:"is_active" db:"is_active"`
+	CreatedAt   time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+// PolicyCondition compares an attribute such as "subject.custom.department"
+// with a literal Value or with another attribute named by ValueFrom
+type PolicyCondition struct {
+	Attribute string          `json:"attribute"`
+	Operator  string          `json:"operator"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	ValueFrom string          `json:"value_from,omitempty"`
+}
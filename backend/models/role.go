@@ -7,11 +7,12 @@ import (
 )
 
 type Role struct {
-	ID          uuid.UUID `json:"id" db:"id"`
-	Name        string    `json:"name" db:"name"`
-	Description string    `json:"description,omitempty" db:"description"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+	ID          uuid.UUID  `json:"id" db:"id"`
+	Name        string     `json:"name" db:"name"`
+	Description string     `json:"description,omitempty" db:"description"`
+	OwnerID     *uuid.UUID `json:"owner_id,omitempty" db:"owner_id"` // approves access requests for the role
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
 }
 
 // RoleWithPermissions represents a role with its associated permissions
@@ -27,3 +28,23 @@ type RolePermission struct {
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
 }
+
+// RoleParent links a role to a parent role whose permissions it inherits
+type RoleParent struct {
+	RoleID       uuid.UUID `json:"role_id" db:"role_id"`
+	ParentRoleID uuid.UUID `json:"parent_role_id" db:"parent_role_id"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// RelatedRole is an ancestor or descendant of a role, Depth inheritance steps away
+type RelatedRole struct {
+	Role
+	Depth int `json:"depth"`
+}
+
+// ResolvedPermission is a permission of a role's fully resolved permission set,
+// with the roles in the hierarchy that grant it directly
+type ResolvedPermission struct {
+	Permission
+	GrantedBy []uuid.UUID `json:"granted_by"`
+}
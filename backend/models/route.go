@@ -0,0 +1,25 @@
+package models
+
+// Authentication a route requires, listed by the route catalog
+const (
+	RouteAuthPublic        = "public"
+	RouteAuthOptional      = "optional"
+	RouteAuthAccessToken   = "access_token"
+	RouteAuthAuthenticated = "authenticated"
+	RouteAuthSession       = "session"
+)
+
+// RouteInfo describes a registered route and what authorizes a request to it.
+// Permission is checked globally, or within the organization named by the
+// OrgParam path variable when set. ClientScope is the scope a token issued to an
+// OAuth client needs for the route to accept it. HandlerCheck describes checks
+// the handler makes itself, on top of (or instead of) a permission.
+type RouteInfo struct {
+	Method         string `json:"method"`
+	Path           string `json:"path"`
+	Authentication string `json:"authentication"`
+	Permission     string `json:"permission,omitempty"`
+	OrgParam       string `json:"org_param,omitempty"`
+	ClientScope    string `json:"client_scope,omitempty"`
+	HandlerCheck   string `json:"handler_check,omitempty"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ServiceAccount is a non-human principal owned by an organization. It is backed
+// by a "users" row (principal_type service_account) so it gets roles through
+// user_roles like any user; ID doubles as the OAuth2 client_id for the
+// client_credentials grant. Only the SHA-256 hash of the client secret is stored.
+type ServiceAccount struct {
+	ID          uuid.UUID  `json:"id" db:"user_id"`
+	Name        string     `json:"name" db:"username"`
+	Description string     `json:"description,omitempty" db:"description"`
+	OrgID       uuid.UUID  `json:"org_id" db:"org_id"`
+	IsActive    bool       `json:"is_active" db:"is_active"`
+	SecretHash  string     `json:"-" db:"secret_hash"`
+	CreatedBy   *uuid.UUID `json:"created_by,omitempty" db:"created_by"`
+	LastTokenAt *time.Time `json:"last_token_at,omitempty" db:"last_token_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SoDConstraint is a separation-of-duties constraint: no user may hold more
+// than one of Permissions through their role assignments, in any scope
+type SoDConstraint struct {
+	ID          uuid.UUID `json:"id" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description,omitempty" db:"description"`
+	Permissions []string  `json:"permissions" db:"permissions"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// SoDViolation is a user holding more than one permission of a constraint
+type SoDViolation struct {
+	ConstraintID   uuid.UUID `json:"constraint_id"`
+	ConstraintName string    `json:"constraint_name"`
+	UserID         uuid.UUID `json:"user_id"`
+	Username       string    `json:"username"`
+	Permissions    []string  `json:"permissions"`
+}
@@ -55,12 +55,30 @@ type CustomMetadata struct {
 	LastUpdated time.Time `json:"last_updated"`
 }
 
+// Principal types stored in users.principal_type. Service accounts are
+// non-human principals without a password that authenticate with the OAuth2
+// client_credentials grant.
+const (
+	PrincipalTypeUser           = "user"
+	PrincipalTypeServiceAccount = "service_account"
+)
+
+// Account states stored in users.status
+const (
+	UserStatusActive              = "active"
+	UserStatusPendingVerification = "pending_verification"
+)
+
 type User struct {
-	ID           uuid.UUID `json:"id" db:"id"`
-	Username     string    `json:"username" db:"username"`
-	PasswordHash string    `json:"password_hash,omitempty" db:"password_hash"`
-	Email        string    `json:"email" db:"email"`
-	IsActive     bool      `json:"is_active" db:"is_active"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	ID              uuid.UUID  `json:"id" db:"id"`
+	Username        string     `json:"username" db:"username"`
+	PasswordHash    string     `json:"-" db:"password_hash"`
+	Email           string     `json:"email" db:"email"`
+	IsActive        bool       `json:"is_active" db:"is_active"`
+	Status          string     `json:"status,omitempty" db:"status"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty" db:"email_verified_at"`
+	PrincipalType   string     `json:"principal_type,omitempty" db:"principal_type"`
+	ImpersonatorID  *uuid.UUID `json:"impersonator_id,omitempty" db:"-"` // set on requests made with an impersonation token
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at" db:"updated_at"`
 }
@@ -6,11 +6,45 @@ import (
 	"github.com/google/uuid"
 )
 
+// Role assignment scopes stored in user_roles.scope. A system assignment applies
+// everywhere; an organization assignment only in OrgID and its sub-organizations.
+const (
+	RoleScopeSystem = "system"
+	RoleScopeOrg    = "organization"
+)
+
 type UserRole struct {
 	UserID       uuid.UUID  `json:"user_id" db:"user_id"`
 	RoleID       uuid.UUID  `json:"role_id" db:"role_id"`
 	Scope        string     `json:"scope" db:"scope"`
+	OrgID        *uuid.UUID `json:"org_id,omitempty" db:"org_id"`
 	ParentRoleID *uuid.UUID `json:"parent_role_id,omitempty" db:"parent_role_id"`
+	ValidFrom    *time.Time `json:"valid_from,omitempty" db:"valid_from"`
+	ValidUntil   *time.Time `json:"valid_until,omitempty" db:"valid_until"`
 	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
 	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
 }
+
+// RoleAssignment is a role held by a user in a given scope, between ValidFrom
+// and ValidUntil when set
+type RoleAssignment struct {
+	UserID     uuid.UUID  `json:"user_id"`
+	Role       Role       `json:"role"`
+	Scope      string     `json:"scope"`
+	OrgID      *uuid.UUID `json:"org_id,omitempty"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// RoleMember is a user holding a role in a given scope
+type RoleMember struct {
+	UserID     uuid.UUID  `json:"user_id"`
+	Username   string     `json:"username"`
+	Email      string     `json:"email"`
+	Scope      string     `json:"scope"`
+	OrgID      *uuid.UUID `json:"org_id,omitempty"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
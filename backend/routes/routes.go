@@ -3,9 +3,12 @@ package routes
 import (
 	"database/sql"
 	"net/http"
+	"pillow/auth"
 	"pillow/database"
 	"pillow/handlers"
+	"pillow/mail"
 	"pillow/middleware"
+	"pillow/sso"
 
 	cors "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -24,103 +27,225 @@ func SetupRoutes(db interface{}, logger *logrus.Logger, isLoggingEnabled bool) h
 		panic("db must be *sql.DB or *database.LoggingDB")
 	}
 
+	mailer := mail.NewFromEnv()
+	ssoProviders := sso.NewRegistryFromEnv()
+
+	uploads := http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads/")))
+
+	// Every route declares what authorizes it; SetupRoutes refuses to start with
+	// a route that does not
+	var table Table
+	table = Table{
+		// Public key set for verifying tokens signed with RS256/EdDSA
+		{"GET", "/.well-known/jwks.json", handlers.GetJWKS(), Public()},
+
+		// OpenID Connect provider (authorization code flow with PKCE, client_credentials for service accounts)
+		{"GET", "/.well-known/openid-configuration", handlers.GetOpenIDConfiguration(), Public()},
+		{"GET", "/authorize", handlers.Authorize(sqlDB), OptionalAuth().CheckedBy("signed-in user, otherwise redirected to the login page")},
+		{"POST", "/token", handlers.Token(sqlDB), Public().CheckedBy("client credentials or authorization code")},
+		{"GET", "/userinfo", handlers.UserInfo(sqlDB), AccessToken().ForClients(auth.ScopeOpenID)},
+		{"POST", "/userinfo", handlers.UserInfo(sqlDB), AccessToken().ForClients(auth.ScopeOpenID)},
+
+		// Public authentication routes
+		{"POST", "/api/register", handlers.CreateUser(sqlDB, mailer), Public()},
+		{"POST", "/api/login", handlers.Login(sqlDB), Public()},
+		{"POST", "/api/login/mfa", handlers.LoginMFA(sqlDB), Public()},
+		{"POST", "/api/token/refresh", handlers.RefreshToken(sqlDB), Public()},
+		{"POST", "/api/password/forgot", handlers.ForgotPassword(sqlDB, mailer), Public()},
+		{"POST", "/api/password/reset", handlers.ResetPassword(sqlDB), Public()},
+		{"POST", "/api/verify-email", handlers.VerifyEmail(sqlDB), Public()},
+		{"POST", "/api/verify-email/resend", handlers.ResendVerificationEmail(sqlDB, mailer), Public()},
+		{"GET", "/api/password-policy", handlers.GetPasswordPolicy(sqlDB), Public()},
+
+		// Federated login through upstream OIDC identity providers
+		{"GET", "/api/sso/providers", handlers.GetSSOProviders(ssoProviders), Public()},
+		{"POST", "/api/sso/token", handlers.SSOToken(sqlDB), Public()},
+		{"GET", "/api/sso/{provider}/login", handlers.SSOLogin(sqlDB, ssoProviders), Public()},
+		{"GET", "/api/sso/{provider}/callback", handlers.SSOCallback(sqlDB, ssoProviders), Public()},
+
+		// Logout also ends an impersonation session early
+		{"POST", "/api/logout", handlers.Logout(sqlDB), Authenticated()},
+
+		// Routes that manage the session or credentials themselves cannot be called with
+		// an API key, by a service account or while impersonating someone
+
+		// Completes an OIDC authorization request for the signed-in user
+		{"POST", "/api/oauth/authorize", handlers.ApproveAuthorization(sqlDB), Session()},
+
+		// Multi-factor authentication (available to sessions restricted to MFA enrollment)
+		{"GET", "/api/mfa", handlers.GetMFAStatus(sqlDB), Session()},
+		{"POST", "/api/mfa/totp/enroll", handlers.EnrollTOTP(sqlDB), Session()},
+		{"POST", "/api/mfa/totp/confirm", handlers.ConfirmTOTP(sqlDB), Session()},
+		{"POST", "/api/mfa/totp/disable", handlers.DisableTOTP(sqlDB), Session()},
+		{"POST", "/api/mfa/recovery-codes", handlers.RegenerateRecoveryCodes(sqlDB), Session()},
+
+		{"POST", "/api/users/profile/password", handlers.ChangePassword(sqlDB), Session()},
+
+		// Personal access tokens (API keys) of the current user
+		{"GET", "/api/api-keys", handlers.GetAPIKeys(sqlDB), Session()},
+		{"POST", "/api/api-keys", handlers.CreateAPIKey(sqlDB), Session()},
+		{"DELETE", "/api/api-keys/{id}", handlers.RevokeAPIKey(sqlDB), Session()},
+
+		// Access requests for a role or permission; deciding needs to be an approver
+		// or hold assign_roles in the scope of the request, checked by the handlers
+		{"GET", "/api/access-requests", handlers.GetMyAccessRequests(sqlDB), Session()},
+		{"POST", "/api/access-requests", handlers.CreateAccessRequest(sqlDB), Session()},
+		{"GET", "/api/access-requests/pending", handlers.GetPendingAccessRequests(sqlDB), Session()},
+		{"GET", "/api/access-requests/{id}", handlers.GetAccessRequest(sqlDB), Session().CheckedBy("requester, approver or assign_roles in the scope of the request")},
+		{"POST", "/api/access-requests/{id}/approve", handlers.ApproveAccessRequest(sqlDB), Session().CheckedBy("approver or assign_roles in the scope of the request")},
+		{"POST", "/api/access-requests/{id}/reject", handlers.RejectAccessRequest(sqlDB), Session().CheckedBy("approver or assign_roles in the scope of the request")},
+		{"POST", "/api/access-requests/{id}/cancel", handlers.CancelAccessRequest(sqlDB), Session().CheckedBy("requester")},
+
+		// Impersonation issues a short-lived token acting as another user
+		{"POST", "/api/users/{id}/impersonate", handlers.ImpersonateUser(sqlDB), Permission(middleware.ImpersonatePermission).InSession()},
+
+		// User routes
+		{"GET", "/api/users", handlers.GetUsers(sqlDB), Authenticated()},
+		{"GET", "/api/users/profile", handlers.GetUserProfile(sqlDB), Authenticated()},
+		{"GET", "/api/users/profile/permissions", handlers.GetMyPermissions(sqlDB), Authenticated()},
+
+		{"GET", "/api/users/{id}", handlers.GetUser(sqlDB), Authenticated()},
+
+		// User-role assignments; the handlers check assign_roles in the scope of each assignment
+		{"GET", "/api/users/{id}/roles", handlers.GetUserRoleAssignments(sqlDB), Authenticated().CheckedBy("own roles, or view_roles")},
+		{"POST", "/api/users/{id}/roles", handlers.GrantUserRole(sqlDB), Authenticated().CheckedBy("assign_roles in the scope of the assignment and every permission of the role")},
+		{"DELETE", "/api/users/{id}/roles/{roleId}", handlers.RevokeUserRole(sqlDB), Authenticated().CheckedBy("assign_roles in the scope of the assignment")},
+		{"GET", "/api/users/{id}/effective-permissions", handlers.GetUserEffectivePermissions(sqlDB), Authenticated().CheckedBy("own permissions, or view_roles")},
+		{"GET", "/api/users/{id}/organizations", handlers.GetUserOrganizations(sqlDB), Authenticated().CheckedBy("own memberships, or those in organizations where manage_own_organization is held")},
+
+		// User custom field values
+		{"GET", "/api/users/{userId}/custom-field-values", handlers.GetUserCustomFieldValues(sqlDB), Authenticated().CheckedBy("own values")},
+		{"PUT", "/api/users/{userId}/custom-field-values", handlers.UpdateUserCustomFieldValues(sqlDB), Authenticated().CheckedBy("own values")},
+
+		// User administration
+		{"PUT", "/api/users/{id}", handlers.UpdateUser(sqlDB), Permission("manage_users")},
+		{"DELETE", "/api/users/{id}", handlers.DeleteUser(sqlDB), Permission("manage_users")},
+		{"POST", "/api/users/{id}/revoke-tokens", handlers.RevokeUserTokens(sqlDB), Permission("manage_users")},
+		{"POST", "/api/users/{id}/unlock", handlers.UnlockUser(sqlDB), Permission("manage_users")},
+		{"PUT", "/api/password-policy", handlers.UpdatePasswordPolicy(sqlDB), Permission("manage_users")},
+
+		// Audit log routes - require admin permission for viewing transaction logs
+		{"GET", "/api/audit-logs", handlers.GetAuditLogs(sqlDB), Permission("manage_users")},
+		{"GET", "/api/audit-logs/{id}", handlers.GetAuditLog(sqlDB), Permission("manage_users")},
+
+		// Every route with its authorization requirement
+		{"GET", "/api/routes", handlers.GetRoutes(&table), Permission("manage_users")},
+
+		// Role management routes
+		{"GET", "/api/roles", handlers.GetRoles(sqlDB), Permission("manage_roles")},
+		{"POST", "/api/roles", handlers.CreateRole(sqlDB), Permission("manage_roles")},
+		{"GET", "/api/roles/{id}", handlers.GetRole(sqlDB), Permission("manage_roles")},
+		{"PUT", "/api/roles/{id}", handlers.UpdateRole(sqlDB), Permission("manage_roles")},
+		{"DELETE", "/api/roles/{id}", handlers.DeleteRole(sqlDB), Permission("manage_roles")},
+
+		// Role-permission relationship management
+		{"GET", "/api/roles/{roleId}/permissions", handlers.GetRolePermissions(sqlDB), Permission("manage_roles")},
+		{"POST", "/api/roles/{roleId}/permissions", handlers.AssignPermissionToRole(sqlDB), Permission("manage_roles")},
+		{"DELETE", "/api/roles/{roleId}/permissions/{permissionId}", handlers.RemovePermissionFromRole(sqlDB), Permission("manage_roles")},
+		{"GET", "/api/roles/{roleId}/effective-permissions", handlers.GetRoleEffectivePermissions(sqlDB), Permission("manage_roles")},
+		{"GET", "/api/roles/{roleId}/denied-permissions", handlers.GetRoleDeniedPermissions(sqlDB), Permission("manage_roles")},
+		{"POST", "/api/roles/{roleId}/denied-permissions", handlers.DenyPermissionForRole(sqlDB), Permission("manage_roles")},
+		{"DELETE", "/api/roles/{roleId}/denied-permissions/{permissionId}", handlers.RemoveRoleDeniedPermission(sqlDB), Permission("manage_roles")},
+
+		// Role hierarchy: a role inherits the permissions of its parents
+		{"GET", "/api/roles/{roleId}/parents", handlers.GetRoleParents(sqlDB), Permission("manage_roles")},
+		{"POST", "/api/roles/{roleId}/parents", handlers.AddRoleParent(sqlDB), Permission("manage_roles")},
+		{"DELETE", "/api/roles/{roleId}/parents/{parentId}", handlers.RemoveRoleParent(sqlDB), Permission("manage_roles")},
+		{"GET", "/api/roles/{roleId}/ancestors", handlers.GetRoleAncestors(sqlDB), Permission("manage_roles")},
+		{"GET", "/api/roles/{roleId}/descendants", handlers.GetRoleDescendants(sqlDB), Permission("manage_roles")},
+
+		{"GET", "/api/roles/{roleId}/users", handlers.GetRoleUsers(sqlDB), Permission("view_roles")},
+		{"GET", "/api/authz/explain", handlers.ExplainAuthorization(sqlDB), Permission("view_roles")},
+
+		// Permission management routes
+		{"GET", "/api/permissions", handlers.GetPermissions(sqlDB), Permission("manage_permissions")},
+		{"POST", "/api/permissions", handlers.CreatePermission(sqlDB), Permission("manage_permissions")},
+		{"GET", "/api/permissions/{id}", handlers.GetPermission(sqlDB), Permission("manage_permissions")},
+		{"PUT", "/api/permissions/{id}", handlers.UpdatePermission(sqlDB), Permission("manage_permissions")},
+		{"DELETE", "/api/permissions/{id}", handlers.DeletePermission(sqlDB), Permission("manage_permissions")},
+
+		// Permission-role relationship queries
+		{"GET", "/api/permissions/{permissionId}/roles", handlers.GetPermissionRoles(sqlDB), Permission("manage_permissions")},
+
+		// Attribute-based access policies, evaluated alongside role permissions
+		{"GET", "/api/policies", handlers.GetPolicies(sqlDB), Permission("manage_policies")},
+		{"POST", "/api/policies", handlers.CreatePolicy(sqlDB), Permission("manage_policies")},
+		{"GET", "/api/policies/{id}", handlers.GetPolicy(sqlDB), Permission("manage_policies")},
+		{"PUT", "/api/policies/{id}", handlers.UpdatePolicy(sqlDB), Permission("manage_policies")},
+		{"DELETE", "/api/policies/{id}", handlers.DeletePolicy(sqlDB), Permission("manage_policies")},
+
+		// Separation-of-duties constraints and the report of current violations
+		{"GET", "/api/sod-constraints", handlers.GetSoDConstraints(sqlDB), Permission("manage_policies")},
+		{"POST", "/api/sod-constraints", handlers.CreateSoDConstraint(sqlDB), Permission("manage_policies")},
+		{"GET", "/api/sod-constraints/violations", handlers.GetSoDViolations(sqlDB), Permission("manage_policies")},
+		{"GET", "/api/sod-constraints/{id}", handlers.GetSoDConstraint(sqlDB), Permission("manage_policies")},
+		{"PUT", "/api/sod-constraints/{id}", handlers.UpdateSoDConstraint(sqlDB), Permission("manage_policies")},
+		{"DELETE", "/api/sod-constraints/{id}", handlers.DeleteSoDConstraint(sqlDB), Permission("manage_policies")},
+
+		// Custom fields management routes
+		{"GET", "/api/global-custom-fields", handlers.GetGlobalCustomFields(sqlDB), Permission("manage_custom_fields")},
+		{"POST", "/api/global-custom-fields", handlers.CreateGlobalCustomField(sqlDB), Permission("manage_custom_fields")},
+		{"PUT", "/api/global-custom-fields/{fieldId}", handlers.UpdateGlobalCustomField(sqlDB), Permission("manage_custom_fields")},
+		{"DELETE", "/api/global-custom-fields/{fieldId}", handlers.DeleteGlobalCustomField(sqlDB), Permission("manage_custom_fields")},
+		{"POST", "/api/upload", handlers.UploadFile(sqlDB), Permission("manage_custom_fields")},
+
+		// Organization management routes
+		{"GET", "/api/organizations", handlers.GetOrganizations(sqlDB), Permission("manage_organizations")},
+		{"POST", "/api/organizations", handlers.CreateOrganization(sqlDB), Permission("manage_organizations")},
+		{"DELETE", "/api/organizations/{id}", handlers.DeleteOrganization(sqlDB), Permission("manage_organizations")},
+
+		// Routes of a single organization are authorized within that organization, so
+		// manage_own_organization granted in an organization covers it and its children
+		{"GET", "/api/organizations/{id}", handlers.GetOrganization(sqlDB), OrgPermission("manage_own_organization", "id")},
+		{"PUT", "/api/organizations/{id}", handlers.UpdateOrganization(sqlDB), OrgPermission("manage_own_organization", "id").CheckedBy("manage_own_organization in the new parent organization when moving it")},
+		{"GET", "/api/organizations/{id}/password-policy", handlers.GetOrganizationPasswordPolicy(sqlDB), OrgPermission("manage_own_organization", "id")},
+		{"PUT", "/api/organizations/{id}/password-policy", handlers.UpdateOrganizationPasswordPolicy(sqlDB), OrgPermission("manage_own_organization", "id")},
+		{"DELETE", "/api/organizations/{id}/password-policy", handlers.DeleteOrganizationPasswordPolicy(sqlDB), OrgPermission("manage_own_organization", "id")},
+
+		// Organization members and their role in the organization
+		{"GET", "/api/organizations/{id}/members", handlers.GetOrganizationMembers(sqlDB), OrgPermission("manage_own_organization", "id")},
+		{"POST", "/api/organizations/{id}/members", handlers.AddOrganizationMember(sqlDB), OrgPermission("manage_own_organization", "id").CheckedBy("assign_roles in the organization and every permission of the role when giving or replacing a role")},
+		{"DELETE", "/api/organizations/{id}/members/{userId}", handlers.RemoveOrganizationMember(sqlDB), OrgPermission("manage_own_organization", "id").CheckedBy("assign_roles in the organization when the member holds roles in it")},
+
+		// OAuth/OIDC client registry
+		{"GET", "/api/oauth/clients", handlers.GetOAuthClients(sqlDB), Permission("manage_oauth_clients")},
+		{"POST", "/api/oauth/clients", handlers.CreateOAuthClient(sqlDB), Permission("manage_oauth_clients")},
+		{"GET", "/api/oauth/clients/{id}", handlers.GetOAuthClient(sqlDB), Permission("manage_oauth_clients")},
+		{"PUT", "/api/oauth/clients/{id}", handlers.UpdateOAuthClient(sqlDB), Permission("manage_oauth_clients")},
+		{"DELETE", "/api/oauth/clients/{id}", handlers.DeleteOAuthClient(sqlDB), Permission("manage_oauth_clients")},
+		{"POST", "/api/oauth/clients/{id}/secret", handlers.RotateOAuthClientSecret(sqlDB), Permission("manage_oauth_clients")},
+
+		// Service accounts (non-human principals using the client_credentials grant)
+		{"GET", "/api/service-accounts", handlers.GetServiceAccounts(sqlDB), Permission("manage_service_accounts")},
+		{"POST", "/api/service-accounts", handlers.CreateServiceAccount(sqlDB), Permission("manage_service_accounts").CheckedBy("assign_roles in the organization of the account and every permission of its roles")},
+		{"GET", "/api/service-accounts/{id}", handlers.GetServiceAccount(sqlDB), Permission("manage_service_accounts")},
+		{"PUT", "/api/service-accounts/{id}", handlers.UpdateServiceAccount(sqlDB), Permission("manage_service_accounts")},
+		{"DELETE", "/api/service-accounts/{id}", handlers.DeleteServiceAccount(sqlDB), Permission("manage_service_accounts")},
+		{"POST", "/api/service-accounts/{id}/secret", handlers.RotateServiceAccountSecret(sqlDB), Permission("manage_service_accounts")},
+
+		// Static file server for uploaded files
+		{"GET", "/uploads/{file:.*}", uploads, Public()},
+		{"HEAD", "/uploads/{file:.*}", uploads, Public()},
+	}
+	if err := table.validate(); err != nil {
+		panic(err)
+	}
+	if err := table.checkPermissions(sqlDB); err != nil {
+		panic(err)
+	}
+
 	r := mux.NewRouter()
 
 	// Add logging middleware to all routes
 	r.Use(middleware.LoggingMiddlewareMux(logger, isLoggingEnabled))
 
-	// API routes group
-	api := r.PathPrefix("/api").Subrouter()
-
-	// Public authentication routes
-	api.HandleFunc("/register", handlers.CreateUser(sqlDB)).Methods("POST")
-	api.HandleFunc("/login", handlers.Login(sqlDB)).Methods("POST")
-
-	// Protected routes - require authentication
-	protected := api.PathPrefix("").Subrouter()
-	protected.Use(middleware.AuthMiddlewareMux(sqlDB))
-	// Audit middleware must run after authentication so actor is available in context
-	protected.Use(middleware.AuditMiddlewareMux(sqlDB))
-
-	// User routes (protected)
-	protected.HandleFunc("/users", handlers.GetUsers(sqlDB)).Methods("GET")
-	protected.HandleFunc("/users/profile", handlers.GetUserProfile(sqlDB)).Methods("GET")
-
-	protected.HandleFunc("/users/{id}", handlers.GetUser(sqlDB)).Methods("GET")
-
-	// User custom field values (protected)
-	protected.HandleFunc("/users/{userId}/custom-field-values", handlers.GetUserCustomFieldValues(sqlDB)).Methods("GET")
-	protected.HandleFunc("/users/{userId}/custom-field-values", handlers.UpdateUserCustomFieldValues(sqlDB)).Methods("PUT")
-	// Admin-only routes - require specific permissions
-	admin := protected.PathPrefix("").Subrouter()
-	admin.Use(middleware.RequirePermissionMux(sqlDB, "manage_users"))
-
-	admin.HandleFunc("/users/{id}", handlers.UpdateUser(sqlDB)).Methods("PUT")
-	admin.HandleFunc("/users/{id}", handlers.DeleteUser(sqlDB)).Methods("DELETE")
-	// Global custom fields management - require admin permission
-	// admin.HandleFunc("/global-custom-fields", handlers.GetGlobalCustomFields(sqlDB)).Methods("GET")
-	// admin.HandleFunc("/global-custom-fields", handlers.CreateGlobalCustomField(sqlDB)).Methods("POST")
-	// admin.HandleFunc("/global-custom-fields/{fieldId}", handlers.UpdateGlobalCustomField(sqlDB)).Methods("PUT")
-	// admin.HandleFunc("/global-custom-fields/{fieldId}", handlers.DeleteGlobalCustomField(sqlDB)).Methods("DELETE")
-
-	// Audit log routes - require admin permission for viewing transaction logs
-	admin.HandleFunc("/audit-logs", handlers.GetAuditLogs(sqlDB)).Methods("GET")
-	admin.HandleFunc("/audit-logs/{id}", handlers.GetAuditLog(sqlDB)).Methods("GET")
-
-	// Role management routes - require role management permission
-	roleManager := protected.PathPrefix("").Subrouter()
-	roleManager.Use(middleware.RequirePermissionMux(sqlDB, "manage_roles"))
-
-	roleManager.HandleFunc("/roles", handlers.GetRoles(sqlDB)).Methods("GET")
-	roleManager.HandleFunc("/roles", handlers.CreateRole(sqlDB)).Methods("POST")
-	roleManager.HandleFunc("/roles/{id}", handlers.GetRole(sqlDB)).Methods("GET")
-	roleManager.HandleFunc("/roles/{id}", handlers.UpdateRole(sqlDB)).Methods("PUT")
-	roleManager.HandleFunc("/roles/{id}", handlers.DeleteRole(sqlDB)).Methods("DELETE")
-
-	// Role-permission relationship management
-	roleManager.HandleFunc("/roles/{roleId}/permissions", handlers.GetRolePermissions(sqlDB)).Methods("GET")
-	roleManager.HandleFunc("/roles/{roleId}/permissions", handlers.AssignPermissionToRole(sqlDB)).Methods("POST")
-	roleManager.HandleFunc("/roles/{roleId}/permissions/{permissionId}", handlers.RemovePermissionFromRole(sqlDB)).Methods("DELETE")
-
-	// Permission management routes
-	permissionManager := protected.PathPrefix("").Subrouter()
-	permissionManager.Use(middleware.RequirePermissionMux(sqlDB, "manage_permissions"))
-
-	permissionManager.HandleFunc("/permissions", handlers.GetPermissions(sqlDB)).Methods("GET")
-	permissionManager.HandleFunc("/permissions", handlers.CreatePermission(sqlDB)).Methods("POST")
-	permissionManager.HandleFunc("/permissions/{id}", handlers.GetPermission(sqlDB)).Methods("GET")
-	permissionManager.HandleFunc("/permissions/{id}", handlers.UpdatePermission(sqlDB)).Methods("PUT")
-	permissionManager.HandleFunc("/permissions/{id}", handlers.DeletePermission(sqlDB)).Methods("DELETE")
-
-	// Permission-role relationship queries
-	permissionManager.HandleFunc("/permissions/{permissionId}/roles", handlers.GetPermissionRoles(sqlDB)).Methods("GET")
-
-	// Custom fields management routes - require custom fields management permission
-	customFieldsManager := protected.PathPrefix("").Subrouter()
-	customFieldsManager.Use(middleware.RequirePermissionMux(sqlDB, "manage_custom_fields"))
-
-	customFieldsManager.HandleFunc("/global-custom-fields", handlers.GetGlobalCustomFields(sqlDB)).Methods("GET")
-	customFieldsManager.HandleFunc("/global-custom-fields", handlers.CreateGlobalCustomField(sqlDB)).Methods("POST")
-	customFieldsManager.HandleFunc("/global-custom-fields/{fieldId}", handlers.UpdateGlobalCustomField(sqlDB)).Methods("PUT")
-	customFieldsManager.HandleFunc("/global-custom-fields/{fieldId}", handlers.DeleteGlobalCustomField(sqlDB)).Methods("DELETE")
-	customFieldsManager.HandleFunc("/upload", handlers.UploadFile(sqlDB)).Methods("POST")
-
-	// Organization management routes
-	orgManager := protected.PathPrefix("").Subrouter()
-	orgManager.Use(middleware.RequirePermissionMux(sqlDB, "manage_organizations"))
-
-	orgManager.HandleFunc("/organizations", handlers.GetOrganizations(sqlDB)).Methods("GET")
-	orgManager.HandleFunc("/organizations", handlers.CreateOrganization(sqlDB)).Methods("POST")
-	orgManager.HandleFunc("/organizations/{id}", handlers.UpdateOrganization(sqlDB)).Methods("PUT")
-	orgManager.HandleFunc("/organizations/{id}", handlers.DeleteOrganization(sqlDB)).Methods("DELETE")
-
-	// Static file server for uploaded files
-	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads/"))))
+	table.register(r, sqlDB)
 
 	return cors.CORS(
 		cors.AllowedOrigins([]string{"http://localhost:3000"}),
 		cors.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		cors.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+		cors.AllowedHeaders([]string{"Content-Type", "Authorization", middleware.OrgIDHeader}),
+		cors.ExposedHeaders([]string{middleware.RequiredPermissionHeader}),
 		cors.AllowCredentials(),
 	)(r)
 }
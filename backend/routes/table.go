@@ -0,0 +1,215 @@
+package routes
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"pillow/middleware"
+	"pillow/models"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Access is what authorizes a request to a route. The zero value is rejected
+// when the routes are registered, so every route has to state it.
+type Access struct {
+	auth       string
+	permission string
+	orgParam   string
+	scope      string
+	check      string
+}
+
+// Public routes need no credentials
+func Public() Access {
+	return Access{auth: models.RouteAuthPublic}
+}
+
+// OptionalAuth routes identify the caller from an access token when one is sent
+func OptionalAuth() Access {
+	return Access{auth: models.RouteAuthOptional}
+}
+
+// AccessToken routes need an access token; API keys are not accepted and the
+// requests are not audited
+func AccessToken() Access {
+	return Access{auth: models.RouteAuthAccessToken}
+}
+
+// Authenticated routes are open to any caller with an access token or API key
+func Authenticated() Access {
+	return Access{auth: models.RouteAuthAuthenticated}
+}
+
+// Session routes need a signed-in person: no API key, service account or
+// impersonation token
+func Session() Access {
+	return Access{auth: models.RouteAuthSession}
+}
+
+// Permission routes need an authenticated caller holding the permission globally
+func Permission(name string) Access {
+	return Access{auth: models.RouteAuthAuthenticated, permission: name}
+}
+
+// OrgPermission routes need an authenticated caller holding the permission in
+// the organization named by the routeVar path variable, or one of its parents
+func OrgPermission(name, routeVar string) Access {
+	return Access{auth: models.RouteAuthAuthenticated, permission: name, orgParam: routeVar}
+}
+
+// InSession additionally requires a signed-in person, as Session does
+func (a Access) InSession() Access {
+	a.auth = models.RouteAuthSession
+	return a
+}
+
+// ForClients also accepts access tokens issued to OAuth clients that were
+// granted scope. Only AccessToken routes can serve OAuth clients.
+func (a Access) ForClients(scope string) Access {
+	a.scope = scope
+	return a
+}
+
+// CheckedBy records the checks the handler makes itself, so the route catalog
+// shows them
+func (a Access) CheckedBy(check string) Access {
+	a.check = check
+	return a
+}
+
+// wrap puts the middleware enforcing the requirement around a handler. The
+// permission check runs after authentication and the audit middleware, so
+// refused requests are attributed to their caller.
+func (a Access) wrap(db *sql.DB, h http.Handler) http.Handler {
+	switch a.auth {
+	case models.RouteAuthPublic:
+		return h
+	case models.RouteAuthOptional:
+		return middleware.OptionalAuthMiddleware(db)(h.ServeHTTP)
+	case models.RouteAuthAccessToken:
+		return middleware.ClientAuthMiddleware(db, a.scope)(h.ServeHTTP)
+	}
+
+	if a.orgParam != "" {
+		h = middleware.RequireOrgPermissionMux(db, a.permission, a.orgParam)(h)
+	} else if a.permission != "" {
+		h = middleware.RequirePermissionMux(db, a.permission)(h)
+	}
+	if a.auth == models.RouteAuthSession {
+		h = middleware.RequireSessionMux()(h)
+	}
+	h = middleware.AuditMiddlewareMux(db)(h)
+	return middleware.AuthMiddlewareMux(db)(h)
+}
+
+// Route is an entry of the route table
+type Route struct {
+	Method  string
+	Path    string
+	Handler http.Handler
+	Access  Access
+}
+
+// Table is the list of routes the API serves, matched in order
+type Table []Route
+
+// Describe lists the routes with their authorization requirement
+func (t Table) Describe() []models.RouteInfo {
+	infos := make([]models.RouteInfo, 0, len(t))
+	for _, route := range t {
+		infos = append(infos, models.RouteInfo{
+			Method:         route.Method,
+			Path:           route.Path,
+			Authentication: route.Access.auth,
+			Permission:     route.Access.permission,
+			OrgParam:       route.Access.orgParam,
+			ClientScope:    route.Access.scope,
+			HandlerCheck:   route.Access.check,
+		})
+	}
+	return infos
+}
+
+// validate reports routes without an authorization requirement, requirements
+// that cannot be enforced and routes registered twice
+func (t Table) validate() error {
+	seen := make(map[string]bool, len(t))
+	for _, route := range t {
+		key := route.Method + " " + route.Path
+		if route.Method == "" || route.Path == "" || route.Handler == nil {
+			return fmt.Errorf("route %q needs a method, a path and a handler", key)
+		}
+		if seen[key] {
+			return fmt.Errorf("route %q is registered twice", key)
+		}
+		seen[key] = true
+
+		a := route.Access
+		switch a.auth {
+		case "":
+			return fmt.Errorf("route %q declares no authorization requirement", key)
+		case models.RouteAuthPublic, models.RouteAuthOptional, models.RouteAuthAccessToken:
+			if a.permission != "" {
+				return fmt.Errorf("route %q requires a permission without authentication", key)
+			}
+		}
+		if a.scope != "" && a.auth != models.RouteAuthAccessToken {
+			return fmt.Errorf("route %q accepts OAuth client tokens but not on an access token route", key)
+		}
+		if a.orgParam != "" && !strings.Contains(route.Path, "{"+a.orgParam+"}") {
+			return fmt.Errorf("route %q has no {%s} path variable to check %s in", key, a.orgParam, a.permission)
+		}
+	}
+	return nil
+}
+
+// checkPermissions reports permissions required by routes that are missing from
+// the permissions table, so a typo cannot leave a route that nobody can use
+func (t Table) checkPermissions(db *sql.DB) error {
+	declared := make(map[string]bool)
+	var names []string
+	for _, route := range t {
+		if name := route.Access.permission; name != "" && !declared[name] {
+			declared[name] = true
+			names = append(names, name)
+		}
+	}
+
+	rows, err := db.Query(`SELECT name FROM "permissions" WHERE name = ANY($1)`, pq.Array(names))
+	if err != nil {
+		return fmt.Errorf("checking route permissions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("checking route permissions: %w", err)
+		}
+		delete(declared, name)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("checking route permissions: %w", err)
+	}
+
+	if len(declared) > 0 {
+		missing := make([]string, 0, len(declared))
+		for _, name := range names {
+			if declared[name] {
+				missing = append(missing, name)
+			}
+		}
+		return fmt.Errorf("routes require permissions that do not exist: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// register adds the routes to the router with the middleware enforcing their
+// requirements
+func (t Table) register(r *mux.Router, db *sql.DB) {
+	for _, route := range t {
+		r.Handle(route.Path, route.Access.wrap(db, route.Handler)).Methods(route.Method)
+	}
+}
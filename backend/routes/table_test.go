@@ -0,0 +1,69 @@
+package routes
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTableValidate(t *testing.T) {
+	h := http.NotFoundHandler()
+
+	tests := []struct {
+		name    string
+		table   Table
+		wantErr string
+	}{
+		{"valid", Table{
+			{"GET", "/api/health", h, Public()},
+			{"GET", "/api/users", h, Permission("manage_users")},
+			{"GET", "/api/organizations/{orgId}/members", h, OrgPermission("manage_organizations", "orgId")},
+			{"GET", "/userinfo", h, AccessToken().ForClients("openid")},
+			{"POST", "/api/logout", h, Session()},
+		}, ""},
+		{"same path with another method", Table{
+			{"GET", "/uploads/{file:.*}", h, Public()},
+			{"HEAD", "/uploads/{file:.*}", h, Public()},
+		}, ""},
+		{"missing authorization requirement", Table{
+			{"GET", "/api/users", h, Access{}},
+		}, "declares no authorization requirement"},
+		{"missing handler", Table{
+			{"GET", "/api/users", nil, Public()},
+		}, "needs a method, a path and a handler"},
+		{"permission on a public route", Table{
+			{"GET", "/api/users", h, Access{auth: Public().auth, permission: "manage_users"}},
+		}, "requires a permission without authentication"},
+		{"permission on an access token route", Table{
+			{"GET", "/userinfo", h, Access{auth: AccessToken().auth, permission: "manage_users"}},
+		}, "requires a permission without authentication"},
+		{"duplicate route", Table{
+			{"GET", "/api/users", h, Permission("manage_users")},
+			{"GET", "/api/users", h, Permission("view_users")},
+		}, "is registered twice"},
+		{"missing organization variable", Table{
+			{"GET", "/api/organizations/{id}/members", h, OrgPermission("manage_organizations", "orgId")},
+		}, "has no {orgId} path variable"},
+		{"client scope on an authenticated route", Table{
+			{"GET", "/api/profile", h, Authenticated().ForClients("openid")},
+		}, "accepts OAuth client tokens but not on an access token route"},
+		{"client scope on a public route", Table{
+			{"GET", "/api/health", h, Public().ForClients("openid")},
+		}, "accepts OAuth client tokens but not on an access token route"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.table.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
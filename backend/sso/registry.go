@@ -0,0 +1,83 @@
+package sso
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Registry holds the configured upstream identity providers
+type Registry struct {
+	providers map[string]*Provider
+	order     []string
+}
+
+// NewRegistryFromEnv builds the provider registry from environment variables.
+// SSO_PROVIDERS is a comma separated list of provider IDs; each ID is configured
+// through variables prefixed with SSO_<ID>_:
+//
+//	SSO_CORP_NAME           display name (default: the ID)
+//	SSO_CORP_ISSUER         issuer URL, used for discovery
+//	SSO_CORP_CLIENT_ID      client ID registered at the provider
+//	SSO_CORP_CLIENT_SECRET  client secret (empty for public clients)
+//	SSO_CORP_SCOPES         requested scopes (default: "openid email profile")
+//	SSO_CORP_AUTO_PROVISION create accounts for unknown users ("true"/"false")
+//	SSO_CORP_ORG_BY_DOMAIN  add provisioned users to the organization matching their email domain
+//
+// Providers missing an issuer or client ID are skipped with a warning.
+func NewRegistryFromEnv() *Registry {
+	registry := &Registry{providers: make(map[string]*Provider)}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for _, id := range strings.Split(os.Getenv("SSO_PROVIDERS"), ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if id == "" || registry.providers[id] != nil {
+			continue
+		}
+
+		prefix := "SSO_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+		provider := &Provider{
+			ID:                   id,
+			Name:                 os.Getenv(prefix + "NAME"),
+			Issuer:               strings.TrimRight(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:             os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret:         os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:               strings.Fields(os.Getenv(prefix + "SCOPES")),
+			AutoProvision:        os.Getenv(prefix+"AUTO_PROVISION") == "true",
+			ProvisionOrgByDomain: os.Getenv(prefix+"ORG_BY_DOMAIN") == "true",
+			client:               client,
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			log.Printf("WARNING: SSO provider %q needs %sISSUER and %sCLIENT_ID; skipping\n", id, prefix, prefix)
+			continue
+		}
+		if provider.Name == "" {
+			provider.Name = id
+		}
+		if len(provider.Scopes) == 0 {
+			provider.Scopes = []string{"openid", "email", "profile"}
+		}
+
+		registry.providers[id] = provider
+		registry.order = append(registry.order, id)
+	}
+
+	return registry
+}
+
+// Get returns the provider with the given ID
+func (r *Registry) Get(id string) (*Provider, bool) {
+	provider, ok := r.providers[id]
+	return provider, ok
+}
+
+// List returns all providers in configuration order
+func (r *Registry) List() []*Provider {
+	list := make([]*Provider, 0, len(r.order))
+	for _, id := range r.order {
+		list = append(list, r.providers[id])
+	}
+	return list
+}
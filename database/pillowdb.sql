@@ -185,3 +185,715 @@ ALTER TABLE "public"."user_organizations" ADD FOREIGN KEY ("role_id") REFERENCES
 ALTER TABLE "public"."user_organizations" ADD FOREIGN KEY ("user_id") REFERENCES "public"."users"("id");
 ALTER TABLE "public"."user_organizations" ADD FOREIGN KEY ("org_id") REFERENCES "public"."organizations"("id");
 ALTER TABLE "public"."audit_log" ADD FOREIGN KEY ("user_id") REFERENCES "public"."users"("id");
+
+-- Create sessions table for refresh tokens (one row per token, rotated within a family)
+CREATE TABLE IF NOT EXISTS "public"."sessions" (
+    "id" uuid NOT NULL,
+    "user_id" uuid NOT NULL,
+    "family_id" uuid NOT NULL,
+    "refresh_token_hash" varchar(64) NOT NULL,
+    "expires_at" timestamp NOT NULL,
+    "revoked_at" timestamp,
+    "replaced_by" uuid,
+    "user_agent" text,
+    "ip_address" varchar(100),
+    "created_at" timestamp DEFAULT now(),
+    "last_used_at" timestamp,
+    PRIMARY KEY ("id")
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS "sessions_refresh_token_hash_key" ON "public"."sessions" ("refresh_token_hash");
+CREATE INDEX IF NOT EXISTS "sessions_family_id_idx" ON "public"."sessions" ("family_id");
+CREATE INDEX IF NOT EXISTS "sessions_user_id_idx" ON "public"."sessions" ("user_id");
+
+ALTER TABLE "public"."sessions"
+ADD CONSTRAINT "fk_sessions_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+COMMENT ON TABLE "public"."sessions" IS 'Refresh tokens (SHA-256 hashed); rows sharing family_id belong to one login session';
+
+-- Token revocation: per-token denylist (jti) and per-user "revoke all" cutoff
+ALTER TABLE "public"."users" ADD COLUMN IF NOT EXISTS "tokens_valid_after" timestamp;
+
+CREATE TABLE IF NOT EXISTS "public"."revoked_tokens" (
+    "jti" varchar(64) NOT NULL,
+    "user_id" uuid,
+    "expires_at" timestamp NOT NULL,
+    "revoked_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("jti")
+);
+
+CREATE INDEX IF NOT EXISTS "revoked_tokens_expires_at_idx" ON "public"."revoked_tokens" ("expires_at");
+
+ALTER TABLE "public"."revoked_tokens"
+ADD CONSTRAINT "fk_revoked_tokens_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+COMMENT ON TABLE "public"."revoked_tokens" IS 'Denylist of revoked access token IDs (jti); rows can be purged once expires_at has passed';
+COMMENT ON COLUMN "public"."users"."tokens_valid_after" IS 'Access tokens issued before this time are rejected';
+
+-- Password reset tokens (SHA-256 hashed, single use, time limited)
+CREATE TABLE IF NOT EXISTS "public"."password_reset_tokens" (
+    "id" uuid NOT NULL,
+    "user_id" uuid NOT NULL,
+    "token_hash" varchar(64) NOT NULL,
+    "expires_at" timestamp NOT NULL,
+    "used_at" timestamp,
+    "requested_ip" varchar(100),
+    "created_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("id")
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS "password_reset_tokens_token_hash_key" ON "public"."password_reset_tokens" ("token_hash");
+CREATE INDEX IF NOT EXISTS "password_reset_tokens_user_id_idx" ON "public"."password_reset_tokens" ("user_id");
+
+ALTER TABLE "public"."password_reset_tokens"
+ADD CONSTRAINT "fk_password_reset_tokens_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+-- Email verification: new registrations start as pending_verification
+ALTER TABLE "public"."users" ADD COLUMN IF NOT EXISTS "status" varchar(30) NOT NULL DEFAULT 'active';
+ALTER TABLE "public"."users" ADD COLUMN IF NOT EXISTS "email_verified_at" timestamp;
+ALTER TABLE "public"."users" ADD COLUMN IF NOT EXISTS "verification_sent_at" timestamp;
+
+COMMENT ON COLUMN "public"."users"."status" IS 'Account state: active, pending_verification';
+
+-- Multi-factor authentication (TOTP) and one-time recovery codes
+CREATE TABLE IF NOT EXISTS "public"."user_mfa" (
+    "user_id" uuid NOT NULL,
+    "secret" varchar(64) NOT NULL,
+    "enabled" boolean DEFAULT false,
+    "confirmed_at" timestamp,
+    "last_used_step" bigint,
+    "created_at" timestamp DEFAULT now(),
+    "updated_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("user_id")
+);
+
+CREATE TABLE IF NOT EXISTS "public"."mfa_recovery_codes" (
+    "id" uuid NOT NULL,
+    "user_id" uuid NOT NULL,
+    "code_hash" varchar(64) NOT NULL,
+    "used_at" timestamp,
+    "created_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("id")
+);
+
+CREATE INDEX IF NOT EXISTS "mfa_recovery_codes_user_id_idx" ON "public"."mfa_recovery_codes" ("user_id");
+
+ALTER TABLE "public"."user_mfa"
+ADD CONSTRAINT "fk_user_mfa_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."mfa_recovery_codes"
+ADD CONSTRAINT "fk_mfa_recovery_codes_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."organizations" ADD COLUMN IF NOT EXISTS "require_mfa" boolean NOT NULL DEFAULT false;
+
+COMMENT ON COLUMN "public"."user_mfa"."last_used_step" IS 'Last accepted TOTP time step; codes for this step or earlier are rejected as replays';
+COMMENT ON COLUMN "public"."organizations"."require_mfa" IS 'Members without MFA are restricted to the enrollment endpoints';
+
+-- Asymmetric JWT signing keys (RS256 / EdDSA), rotated on a schedule and shared by all replicas
+CREATE TABLE IF NOT EXISTS "public"."signing_keys" (
+    "kid" varchar(64) NOT NULL,
+    "algorithm" varchar(10) NOT NULL,
+    "private_key" text NOT NULL,
+    "created_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("kid")
+);
+
+CREATE INDEX IF NOT EXISTS "signing_keys_algorithm_created_at_idx" ON "public"."signing_keys" ("algorithm", "created_at" DESC);
+
+COMMENT ON TABLE "public"."signing_keys" IS 'The newest key signs tokens; the one before it is still accepted for verification';
+
+-- OpenID Connect provider: registered client applications and authorization codes
+CREATE TABLE IF NOT EXISTS "public"."oauth_clients" (
+    "id" uuid NOT NULL,
+    "name" varchar(100) NOT NULL,
+    "secret_hash" varchar(64),
+    "redirect_uris" text[] NOT NULL DEFAULT '{}',
+    "created_at" timestamp DEFAULT now(),
+    "updated_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE IF NOT EXISTS "public"."oauth_authorization_codes" (
+    "code_hash" varchar(64) NOT NULL,
+    "client_id" uuid NOT NULL,
+    "user_id" uuid NOT NULL,
+    "redirect_uri" text NOT NULL,
+    "scope" text NOT NULL,
+    "nonce" text NOT NULL DEFAULT '',
+    "code_challenge" varchar(128) NOT NULL,
+    "expires_at" timestamp NOT NULL,
+    "used_at" timestamp,
+    "session_id" uuid,
+    "created_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("code_hash")
+);
+
+ALTER TABLE "public"."oauth_authorization_codes"
+ADD CONSTRAINT "fk_oauth_authorization_codes_client_id"
+FOREIGN KEY ("client_id") REFERENCES "public"."oauth_clients"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."oauth_authorization_codes"
+ADD CONSTRAINT "fk_oauth_authorization_codes_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+COMMENT ON COLUMN "public"."oauth_clients"."secret_hash" IS 'SHA-256 of the client secret; NULL for public clients, which must use PKCE';
+COMMENT ON COLUMN "public"."oauth_authorization_codes"."session_id" IS 'Session family created when the code was redeemed; revoked if the code is replayed';
+
+-- Federated login: identities at upstream OIDC providers linked to pillow users,
+-- and in-flight logins (state/nonce/PKCE verifier, then a one-time login code)
+CREATE TABLE IF NOT EXISTS "public"."user_identities" (
+    "id" uuid NOT NULL,
+    "user_id" uuid NOT NULL,
+    "provider" varchar(50) NOT NULL,
+    "subject" varchar(255) NOT NULL,
+    "email" varchar(100),
+    "created_at" timestamp DEFAULT now(),
+    "last_login_at" timestamp,
+    PRIMARY KEY ("id"),
+    UNIQUE ("provider", "subject")
+);
+
+CREATE INDEX IF NOT EXISTS "user_identities_user_id_idx" ON "public"."user_identities" ("user_id");
+
+ALTER TABLE "public"."user_identities"
+ADD CONSTRAINT "fk_user_identities_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+CREATE TABLE IF NOT EXISTS "public"."sso_logins" (
+    "id" uuid NOT NULL,
+    "provider" varchar(50) NOT NULL,
+    "state_hash" varchar(64),
+    "nonce" varchar(64) NOT NULL,
+    "code_verifier" varchar(128) NOT NULL,
+    "return_to" text,
+    "user_id" uuid,
+    "login_code_hash" varchar(64),
+    "expires_at" timestamp NOT NULL,
+    "completed_at" timestamp,
+    "created_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("id")
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS "sso_logins_state_hash_key" ON "public"."sso_logins" ("state_hash");
+CREATE UNIQUE INDEX IF NOT EXISTS "sso_logins_login_code_hash_key" ON "public"."sso_logins" ("login_code_hash");
+
+ALTER TABLE "public"."sso_logins"
+ADD CONSTRAINT "fk_sso_logins_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+COMMENT ON COLUMN "public"."sso_logins"."state_hash" IS 'Cleared when the provider calls back, so each login completes once';
+COMMENT ON COLUMN "public"."sso_logins"."login_code_hash" IS 'One-time code handed to the frontend after the callback; cleared when redeemed';
+
+-- Brute-force protection: failed login counters per account ("account:<user id>") and per IP ("ip:<address>")
+CREATE TABLE IF NOT EXISTS "public"."login_throttle" (
+    "key" varchar(100) NOT NULL,
+    "failures" integer NOT NULL DEFAULT 0,
+    "last_failure_at" timestamp NOT NULL,
+    "next_attempt_at" timestamp,
+    "locked_until" timestamp,
+    PRIMARY KEY ("key")
+);
+
+COMMENT ON COLUMN "public"."login_throttle"."next_attempt_at" IS 'Progressive delay: attempts before this time are rejected';
+COMMENT ON COLUMN "public"."login_throttle"."locked_until" IS 'Temporary lockout after too many failures within the window';
+
+-- Password policies: org_id NULL is the global policy; organization policies
+-- tighten it for their members (the strictest combination applies)
+CREATE TABLE IF NOT EXISTS "public"."password_policies" (
+    "id" uuid NOT NULL,
+    "org_id" uuid,
+    "min_length" integer NOT NULL DEFAULT 8,
+    "require_uppercase" boolean NOT NULL DEFAULT false,
+    "require_lowercase" boolean NOT NULL DEFAULT false,
+    "require_digit" boolean NOT NULL DEFAULT false,
+    "require_symbol" boolean NOT NULL DEFAULT false,
+    "banned_words" text[] NOT NULL DEFAULT '{}',
+    "disallow_user_info" boolean NOT NULL DEFAULT true,
+    "history_size" integer NOT NULL DEFAULT 0,
+    "max_age_days" integer NOT NULL DEFAULT 0,
+    "created_at" timestamp DEFAULT now(),
+    "updated_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("id")
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS "password_policies_org_id_key" ON "public"."password_policies" ("org_id") WHERE "org_id" IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS "password_policies_global_key" ON "public"."password_policies" (("org_id" IS NULL)) WHERE "org_id" IS NULL;
+
+ALTER TABLE "public"."password_policies"
+ADD CONSTRAINT "fk_password_policies_org_id"
+FOREIGN KEY ("org_id") REFERENCES "public"."organizations"("id") ON DELETE CASCADE;
+
+COMMENT ON COLUMN "public"."password_policies"."history_size" IS 'Number of previous passwords (including the current one) that may not be reused; 0 disables the check';
+COMMENT ON COLUMN "public"."password_policies"."max_age_days" IS 'Passwords older than this must be changed at the next request; 0 disables expiry';
+
+-- Previous password hashes, checked against password_policies.history_size
+CREATE TABLE IF NOT EXISTS "public"."password_history" (
+    "id" uuid NOT NULL,
+    "user_id" uuid NOT NULL,
+    "password_hash" text NOT NULL,
+    "created_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("id")
+);
+
+CREATE INDEX IF NOT EXISTS "password_history_user_id_idx" ON "public"."password_history" ("user_id", "created_at");
+
+ALTER TABLE "public"."password_history"
+ADD CONSTRAINT "fk_password_history_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."users" ADD COLUMN IF NOT EXISTS "password_changed_at" timestamp;
+
+COMMENT ON COLUMN "public"."users"."password_changed_at" IS 'Start of the password age; NULL falls back to created_at';
+
+-- Personal access tokens (API keys) for scripts and CI jobs
+CREATE TABLE IF NOT EXISTS "public"."api_keys" (
+    "id" uuid NOT NULL,
+    "user_id" uuid NOT NULL,
+    "name" varchar(100) NOT NULL,
+    "prefix" varchar(32) NOT NULL,
+    "key_hash" varchar(64) NOT NULL,
+    "scopes" text[] NOT NULL DEFAULT '{}',
+    "expires_at" timestamp NOT NULL,
+    "last_used_at" timestamp,
+    "revoked_at" timestamp,
+    "created_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("id"),
+    UNIQUE ("key_hash")
+);
+
+CREATE INDEX IF NOT EXISTS "api_keys_user_id_idx" ON "public"."api_keys" ("user_id");
+
+ALTER TABLE "public"."api_keys"
+ADD CONSTRAINT "fk_api_keys_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+COMMENT ON COLUMN "public"."api_keys"."prefix" IS 'Leading characters of the key, shown in listings to recognize it';
+COMMENT ON COLUMN "public"."api_keys"."key_hash" IS 'SHA-256 of the key; the key itself is only returned once on creation';
+COMMENT ON COLUMN "public"."api_keys"."scopes" IS 'Permission names the key is limited to; empty means all of the owner''s permissions';
+
+-- Service accounts: non-human principals backed by a "users" row so they get
+-- roles through user_roles. They have no password and authenticate with the
+-- OAuth2 client_credentials grant (client_id = user id).
+ALTER TABLE "public"."users" ADD COLUMN IF NOT EXISTS "principal_type" varchar(20) NOT NULL DEFAULT 'user';
+
+ALTER TABLE "public"."users"
+ADD CONSTRAINT "users_principal_type_check" CHECK ("principal_type" IN ('user', 'service_account'));
+
+CREATE TABLE IF NOT EXISTS "public"."service_accounts" (
+    "user_id" uuid NOT NULL,
+    "org_id" uuid NOT NULL,
+    "description" text,
+    "secret_hash" varchar(64) NOT NULL,
+    "created_by" uuid,
+    "last_token_at" timestamp,
+    "created_at" timestamp DEFAULT now(),
+    "updated_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("user_id")
+);
+
+CREATE INDEX IF NOT EXISTS "service_accounts_org_id_idx" ON "public"."service_accounts" ("org_id");
+
+ALTER TABLE "public"."service_accounts"
+ADD CONSTRAINT "fk_service_accounts_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."service_accounts"
+ADD CONSTRAINT "fk_service_accounts_org_id"
+FOREIGN KEY ("org_id") REFERENCES "public"."organizations"("id");
+
+ALTER TABLE "public"."service_accounts"
+ADD CONSTRAINT "fk_service_accounts_created_by"
+FOREIGN KEY ("created_by") REFERENCES "public"."users"("id") ON DELETE SET NULL;
+
+COMMENT ON COLUMN "public"."users"."principal_type" IS 'user for people, service_account for non-human principals (see service_accounts)';
+COMMENT ON COLUMN "public"."service_accounts"."secret_hash" IS 'SHA-256 of the client secret; the secret is only returned on creation and rotation';
+
+-- Impersonation: administrators holding impersonate_users can act as another
+-- user with a short-lived token. Everything done with such a token is logged
+-- with both the impersonated user (user_id) and the administrator.
+ALTER TABLE "public"."audit_log" ADD COLUMN IF NOT EXISTS "impersonator_id" uuid;
+
+CREATE INDEX IF NOT EXISTS "audit_log_impersonator_id_idx" ON "public"."audit_log" ("impersonator_id") WHERE "impersonator_id" IS NOT NULL;
+
+ALTER TABLE "public"."audit_log"
+ADD CONSTRAINT "fk_audit_log_impersonator_id"
+FOREIGN KEY ("impersonator_id") REFERENCES "public"."users"("id");
+
+COMMENT ON COLUMN "public"."audit_log"."impersonator_id" IS 'Administrator who performed the action while impersonating user_id';
+
+-- Organization-scoped role assignments. A role assigned with scope 'system'
+-- applies everywhere; with scope 'organization' it applies in org_id and its
+-- sub-organizations. Permissions with scope_level 'system' only take effect
+-- through system assignments. Existing assignments stay global.
+ALTER TABLE "public"."user_roles" ADD COLUMN IF NOT EXISTS "org_id" uuid;
+
+UPDATE "public"."user_roles" SET "scope" = 'system' WHERE "org_id" IS NULL;
+
+ALTER TABLE "public"."user_roles" ALTER COLUMN "scope" SET DEFAULT 'system';
+ALTER TABLE "public"."user_roles" ALTER COLUMN "scope" SET NOT NULL;
+
+ALTER TABLE "public"."user_roles"
+ADD CONSTRAINT "user_roles_scope_check"
+CHECK (("scope" = 'system' AND "org_id" IS NULL) OR ("scope" = 'organization' AND "org_id" IS NOT NULL));
+
+CREATE INDEX IF NOT EXISTS "user_roles_user_id_org_id_idx" ON "public"."user_roles" ("user_id", "org_id");
+
+ALTER TABLE "public"."user_roles"
+ADD CONSTRAINT "fk_user_roles_org_id"
+FOREIGN KEY ("org_id") REFERENCES "public"."organizations"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."permissions"
+ADD CONSTRAINT "permissions_scope_level_check" CHECK ("scope_level" IN ('system', 'organization', 'user')) NOT VALID;
+
+COMMENT ON COLUMN "public"."user_roles"."scope" IS 'system (global) or organization (only in org_id and its sub-organizations)';
+COMMENT ON COLUMN "public"."user_roles"."org_id" IS 'Organization an org-scoped assignment applies to; NULL for system assignments';
+COMMENT ON COLUMN "public"."permissions"."scope_level" IS 'system permissions can only be granted globally; organization and user permissions also within an organization';
+
+-- Role hierarchy: a role inherits every permission of its parent roles, and of
+-- their parents in turn. Cycles are rejected by the API. role_ancestry resolves
+-- the hierarchy: one row per role and each of its ancestors (including the
+-- role itself at depth 0). user_roles.parent_role_id predates this table; its
+-- values are carried over once and it is no longer read.
+CREATE TABLE IF NOT EXISTS "public"."role_parents" (
+    "role_id" uuid NOT NULL,
+    "parent_role_id" uuid NOT NULL,
+    "created_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("role_id", "parent_role_id"),
+    CONSTRAINT "role_parents_not_self" CHECK ("role_id" <> "parent_role_id")
+);
+
+CREATE INDEX IF NOT EXISTS "role_parents_parent_role_id_idx" ON "public"."role_parents" ("parent_role_id");
+
+ALTER TABLE "public"."role_parents"
+ADD CONSTRAINT "fk_role_parents_role_id"
+FOREIGN KEY ("role_id") REFERENCES "public"."roles"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."role_parents"
+ADD CONSTRAINT "fk_role_parents_parent_role_id"
+FOREIGN KEY ("parent_role_id") REFERENCES "public"."roles"("id") ON DELETE CASCADE;
+
+INSERT INTO "public"."role_parents" ("role_id", "parent_role_id")
+SELECT DISTINCT "role_id", "parent_role_id" FROM "public"."user_roles"
+WHERE "role_id" IS NOT NULL AND "parent_role_id" IS NOT NULL AND "role_id" <> "parent_role_id"
+ON CONFLICT DO NOTHING;
+
+CREATE OR REPLACE RECURSIVE VIEW "public"."role_ancestry" ("role_id", "ancestor_id", "depth", "path") AS
+    SELECT "id", "id", 0, ARRAY["id"] FROM "public"."roles"
+    UNION ALL
+    SELECT ra."role_id", rp."parent_role_id", ra."depth" + 1, ra."path" || rp."parent_role_id"
+    FROM "role_ancestry" ra
+    INNER JOIN "public"."role_parents" rp ON rp."role_id" = ra."ancestor_id"
+    WHERE NOT rp."parent_role_id" = ANY(ra."path");
+
+COMMENT ON TABLE "public"."role_parents" IS 'Role inheritance: role_id gets every permission of parent_role_id';
+COMMENT ON VIEW "public"."role_ancestry" IS 'Transitive closure of role_parents; a role reaching an ancestor over several paths appears once per path';
+COMMENT ON COLUMN "public"."user_roles"."parent_role_id" IS 'Deprecated; superseded by role_parents';
+
+-- Permission cache invalidation. Every replica caches effective permissions
+-- and the account state checked on authentication (status, token cutoff,
+-- session restrictions) per user and listens on the pillow_permissions channel.
+-- The payload is 'user:<id>' when a single user's role assignments, account,
+-- memberships or MFA enrollment changed and '*' when roles, permissions, the
+-- role hierarchy, the organization tree or password policies changed.
+-- Notifications are delivered on commit.
+CREATE OR REPLACE FUNCTION "public"."notify_permissions_changed"() RETURNS trigger AS $$
+BEGIN
+    IF TG_LEVEL = 'STATEMENT' THEN
+        PERFORM pg_notify('pillow_permissions', '*');
+    ELSIF TG_TABLE_NAME = 'users' THEN
+        PERFORM pg_notify('pillow_permissions', 'user:' || OLD.id::text);
+    ELSE
+        IF TG_OP IN ('UPDATE', 'DELETE') THEN
+            PERFORM pg_notify('pillow_permissions', 'user:' || OLD.user_id::text);
+        END IF;
+        IF TG_OP IN ('INSERT', 'UPDATE') THEN
+            PERFORM pg_notify('pillow_permissions', 'user:' || NEW.user_id::text);
+        END IF;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS "user_roles_notify_permissions" ON "public"."user_roles";
+CREATE TRIGGER "user_roles_notify_permissions"
+AFTER INSERT OR UPDATE OR DELETE ON "public"."user_roles"
+FOR EACH ROW EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+DROP TRIGGER IF EXISTS "users_notify_permissions" ON "public"."users";
+CREATE TRIGGER "users_notify_permissions"
+AFTER UPDATE OF "is_active", "status", "username", "email", "password_hash", "password_changed_at", "tokens_valid_after" OR DELETE ON "public"."users"
+FOR EACH ROW EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+DROP TRIGGER IF EXISTS "user_organizations_notify_permissions" ON "public"."user_organizations";
+CREATE TRIGGER "user_organizations_notify_permissions"
+AFTER INSERT OR UPDATE OR DELETE ON "public"."user_organizations"
+FOR EACH ROW EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+DROP TRIGGER IF EXISTS "user_mfa_notify_permissions" ON "public"."user_mfa";
+CREATE TRIGGER "user_mfa_notify_permissions"
+AFTER INSERT OR UPDATE OF "enabled" OR DELETE ON "public"."user_mfa"
+FOR EACH ROW EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+DROP TRIGGER IF EXISTS "password_policies_notify_permissions" ON "public"."password_policies";
+CREATE TRIGGER "password_policies_notify_permissions"
+AFTER INSERT OR UPDATE OR DELETE ON "public"."password_policies"
+FOR EACH STATEMENT EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+DROP TRIGGER IF EXISTS "roles_notify_permissions" ON "public"."roles";
+CREATE TRIGGER "roles_notify_permissions"
+AFTER INSERT OR UPDATE OR DELETE ON "public"."roles"
+FOR EACH STATEMENT EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+DROP TRIGGER IF EXISTS "permissions_notify_permissions" ON "public"."permissions";
+CREATE TRIGGER "permissions_notify_permissions"
+AFTER INSERT OR UPDATE OR DELETE ON "public"."permissions"
+FOR EACH STATEMENT EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+DROP TRIGGER IF EXISTS "role_permissions_notify_permissions" ON "public"."role_permissions";
+CREATE TRIGGER "role_permissions_notify_permissions"
+AFTER INSERT OR UPDATE OR DELETE ON "public"."role_permissions"
+FOR EACH STATEMENT EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+DROP TRIGGER IF EXISTS "role_parents_notify_permissions" ON "public"."role_parents";
+CREATE TRIGGER "role_parents_notify_permissions"
+AFTER INSERT OR UPDATE OR DELETE ON "public"."role_parents"
+FOR EACH STATEMENT EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+DROP TRIGGER IF EXISTS "organizations_notify_permissions" ON "public"."organizations";
+CREATE TRIGGER "organizations_notify_permissions"
+AFTER INSERT OR UPDATE OF "parent_org_id", "require_mfa" OR DELETE ON "public"."organizations"
+FOR EACH STATEMENT EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+-- Attribute-based access policies. A policy applies to checks of permission
+-- ('*' for all) within org_id and its child organizations, or everywhere when
+-- org_id is NULL, and matches when all of its conditions hold. Matching deny
+-- policies override role grants; matching allow policies grant the permission.
+CREATE TABLE IF NOT EXISTS "public"."policies" (
+    "id" uuid NOT NULL DEFAULT gen_random_uuid(),
+    "name" varchar(100) NOT NULL,
+    "description" text,
+    "effect" varchar(10) NOT NULL,
+    "permission" varchar(100) NOT NULL,
+    "org_id" uuid,
+    "conditions" jsonb NOT NULL DEFAULT '[]'::jsonb,
+    "timezone" varchar(64) NOT NULL DEFAULT 'UTC',
+    "is_active" boolean NOT NULL DEFAULT true,
+    "created_at" timestamp DEFAULT now(),
+    "updated_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("id"),
+    UNIQUE ("name"),
+    CONSTRAINT "policies_effect_check" CHECK ("effect" IN ('allow', 'deny'))
+);
+
+CREATE INDEX IF NOT EXISTS "policies_permission_idx" ON "public"."policies" ("permission") WHERE "is_active";
+
+ALTER TABLE "public"."policies"
+ADD CONSTRAINT "fk_policies_org_id"
+FOREIGN KEY ("org_id") REFERENCES "public"."organizations"("id") ON DELETE CASCADE;
+
+DROP TRIGGER IF EXISTS "policies_notify_permissions" ON "public"."policies";
+CREATE TRIGGER "policies_notify_permissions"
+AFTER INSERT OR UPDATE OR DELETE ON "public"."policies"
+FOR EACH STATEMENT EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+COMMENT ON TABLE "public"."policies" IS 'Attribute-based access control rules evaluated alongside role permissions';
+COMMENT ON COLUMN "public"."policies"."permission" IS 'Permission name the policy applies to, or * for every permission';
+COMMENT ON COLUMN "public"."policies"."conditions" IS 'JSON array of {attribute, operator, value | value_from}; all must hold';
+COMMENT ON COLUMN "public"."policies"."timezone" IS 'IANA time zone of the context.time attributes';
+
+-- Time-bound role assignments. An assignment only applies from valid_from
+-- until valid_until when they are set; active_user_roles holds the assignments
+-- that apply now and is what permission checks read. Expired assignments are
+-- removed by the API's expiry sweeper.
+ALTER TABLE "public"."user_roles" ADD COLUMN IF NOT EXISTS "valid_from" timestamptz;
+ALTER TABLE "public"."user_roles" ADD COLUMN IF NOT EXISTS "valid_until" timestamptz;
+
+ALTER TABLE "public"."user_roles"
+ADD CONSTRAINT "user_roles_validity_check" CHECK ("valid_from" IS NULL OR "valid_until" IS NULL OR "valid_from" < "valid_until");
+
+CREATE INDEX IF NOT EXISTS "user_roles_valid_until_idx" ON "public"."user_roles" ("valid_until") WHERE "valid_until" IS NOT NULL;
+
+CREATE OR REPLACE VIEW "public"."active_user_roles" AS
+    SELECT * FROM "public"."user_roles"
+    WHERE ("valid_from" IS NULL OR "valid_from" <= now())
+    AND ("valid_until" IS NULL OR "valid_until" > now());
+
+COMMENT ON COLUMN "public"."user_roles"."valid_from" IS 'Start of a time-bound assignment; NULL applies immediately';
+COMMENT ON COLUMN "public"."user_roles"."valid_until" IS 'End of a time-bound assignment; NULL never expires';
+COMMENT ON VIEW "public"."active_user_roles" IS 'Role assignments within their validity window';
+
+-- Just-in-time access requests. A user asks for a role for duration_hours
+-- with a justification; approving the request assigns the role from the
+-- approval (valid_from) until valid_until.
+CREATE TABLE IF NOT EXISTS "public"."access_requests" (
+    "id" uuid NOT NULL DEFAULT gen_random_uuid(),
+    "user_id" uuid NOT NULL,
+    "role_id" uuid NOT NULL,
+    "scope" varchar(50) NOT NULL DEFAULT 'system',
+    "org_id" uuid,
+    "duration_hours" integer NOT NULL,
+    "justification" text NOT NULL,
+    "status" varchar(20) NOT NULL DEFAULT 'pending',
+    "decided_by" uuid,
+    "decided_at" timestamptz,
+    "decision_note" text,
+    "valid_from" timestamptz,
+    "valid_until" timestamptz,
+    "created_at" timestamp DEFAULT now(),
+    "updated_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("id"),
+    CONSTRAINT "access_requests_duration_check" CHECK ("duration_hours" > 0),
+    CONSTRAINT "access_requests_status_check" CHECK ("status" IN ('pending', 'approved', 'rejected', 'cancelled')),
+    CONSTRAINT "access_requests_scope_check"
+        CHECK (("scope" = 'system' AND "org_id" IS NULL) OR ("scope" = 'organization' AND "org_id" IS NOT NULL))
+);
+
+CREATE INDEX IF NOT EXISTS "access_requests_user_id_idx" ON "public"."access_requests" ("user_id");
+CREATE INDEX IF NOT EXISTS "access_requests_pending_idx" ON "public"."access_requests" ("created_at") WHERE "status" = 'pending';
+
+ALTER TABLE "public"."access_requests"
+ADD CONSTRAINT "fk_access_requests_user_id"
+FOREIGN KEY ("user_id") REFERENCES "public"."users"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."access_requests"
+ADD CONSTRAINT "fk_access_requests_role_id"
+FOREIGN KEY ("role_id") REFERENCES "public"."roles"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."access_requests"
+ADD CONSTRAINT "fk_access_requests_org_id"
+FOREIGN KEY ("org_id") REFERENCES "public"."organizations"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."access_requests"
+ADD CONSTRAINT "fk_access_requests_decided_by"
+FOREIGN KEY ("decided_by") REFERENCES "public"."users"("id") ON DELETE SET NULL;
+
+COMMENT ON TABLE "public"."access_requests" IS 'Requests for a role for a limited time, decided by a user holding assign_roles in the scope';
+
+-- Access requests for a role or a permission (globally or in an
+-- organization), optionally limited to a number of hours. Approving a
+-- permission request records the role the approver assigned in role_id.
+-- Approvers are the role's owner and the managers (managed_by) of the
+-- organization and its parents; holders of assign_roles in the scope can
+-- decide as well. Pending requests expire at expires_at.
+ALTER TABLE "public"."roles" ADD COLUMN IF NOT EXISTS "owner_id" uuid;
+
+ALTER TABLE "public"."roles"
+ADD CONSTRAINT "fk_roles_owner_id"
+FOREIGN KEY ("owner_id") REFERENCES "public"."users"("id") ON DELETE SET NULL;
+
+COMMENT ON COLUMN "public"."roles"."owner_id" IS 'User who approves access requests for the role';
+
+ALTER TABLE "public"."access_requests" ALTER COLUMN "role_id" DROP NOT NULL;
+ALTER TABLE "public"."access_requests" ALTER COLUMN "duration_hours" DROP NOT NULL;
+ALTER TABLE "public"."access_requests" ADD COLUMN IF NOT EXISTS "permission_id" uuid;
+ALTER TABLE "public"."access_requests" ADD COLUMN IF NOT EXISTS "expires_at" timestamptz;
+
+UPDATE "public"."access_requests" SET "expires_at" = "created_at" + interval '7 days' WHERE "expires_at" IS NULL;
+
+ALTER TABLE "public"."access_requests" ALTER COLUMN "expires_at" SET NOT NULL;
+
+ALTER TABLE "public"."access_requests" DROP CONSTRAINT "access_requests_status_check";
+ALTER TABLE "public"."access_requests"
+ADD CONSTRAINT "access_requests_status_check"
+CHECK ("status" IN ('pending', 'approved', 'rejected', 'cancelled', 'expired'));
+
+ALTER TABLE "public"."access_requests"
+ADD CONSTRAINT "access_requests_target_check" CHECK ("role_id" IS NOT NULL OR "permission_id" IS NOT NULL);
+
+ALTER TABLE "public"."access_requests"
+ADD CONSTRAINT "fk_access_requests_permission_id"
+FOREIGN KEY ("permission_id") REFERENCES "public"."permissions"("id") ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS "access_requests_expires_at_idx" ON "public"."access_requests" ("expires_at") WHERE "status" = 'pending';
+
+COMMENT ON TABLE "public"."access_requests" IS 'Requests for a role or permission, decided by an approver or a user holding assign_roles in the scope';
+COMMENT ON COLUMN "public"."access_requests"."role_id" IS 'Requested role; for permission requests the role assigned on approval';
+COMMENT ON COLUMN "public"."access_requests"."duration_hours" IS 'How long approved access lasts; NULL does not expire';
+COMMENT ON COLUMN "public"."access_requests"."expires_at" IS 'When a pending request expires';
+
+-- Explicit denies. A role listed here denies the permission to everyone
+-- holding it (or a role inheriting from it) in the scope of that assignment:
+-- globally for system assignments, in the organization and its
+-- sub-organizations otherwise. Denies override every role grant and allow
+-- policy.
+CREATE TABLE IF NOT EXISTS "public"."role_denied_permissions" (
+    "role_id" uuid NOT NULL,
+    "permission_id" uuid NOT NULL,
+    "created_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("role_id", "permission_id")
+);
+
+CREATE INDEX IF NOT EXISTS "role_denied_permissions_permission_id_idx" ON "public"."role_denied_permissions" ("permission_id");
+
+ALTER TABLE "public"."role_denied_permissions"
+ADD CONSTRAINT "fk_role_denied_permissions_role_id"
+FOREIGN KEY ("role_id") REFERENCES "public"."roles"("id") ON DELETE CASCADE;
+
+ALTER TABLE "public"."role_denied_permissions"
+ADD CONSTRAINT "fk_role_denied_permissions_permission_id"
+FOREIGN KEY ("permission_id") REFERENCES "public"."permissions"("id") ON DELETE CASCADE;
+
+DROP TRIGGER IF EXISTS "role_denied_permissions_notify_permissions" ON "public"."role_denied_permissions";
+CREATE TRIGGER "role_denied_permissions_notify_permissions"
+AFTER INSERT OR UPDATE OR DELETE ON "public"."role_denied_permissions"
+FOR EACH STATEMENT EXECUTE FUNCTION "public"."notify_permissions_changed"();
+
+COMMENT ON TABLE "public"."role_denied_permissions" IS 'Permissions a role explicitly denies, overriding grants';
+
+-- Separation-of-duties constraints: no user may hold more than one of the
+-- listed permissions through their role assignments. Role assignments and
+-- changes to role permissions or the role hierarchy that would introduce a
+-- violation are rejected by the API.
+CREATE TABLE IF NOT EXISTS "public"."sod_constraints" (
+    "id" uuid NOT NULL DEFAULT gen_random_uuid(),
+    "name" varchar(100) NOT NULL,
+    "description" text,
+    "permissions" text[] NOT NULL,
+    "created_at" timestamp DEFAULT now(),
+    "updated_at" timestamp DEFAULT now(),
+    PRIMARY KEY ("id"),
+    UNIQUE ("name"),
+    CONSTRAINT "sod_constraints_permissions_check" CHECK (cardinality("permissions") >= 2)
+);
+
+COMMENT ON TABLE "public"."sod_constraints" IS 'Separation-of-duties rules: mutually exclusive permissions';
+COMMENT ON COLUMN "public"."sod_constraints"."permissions" IS 'Permission names of which a user may hold at most one';
+
+-- Organization memberships. A user is a member of an organization at most
+-- once; role_id is the member's role in the organization, which the API keeps
+-- assigned in user_roles with scope 'organization'. user_roles.membership_id
+-- marks the assignment a membership made, which is the one replaced when the
+-- member's role changes; assignments granted otherwise are left alone. Of
+-- duplicate memberships the most recently updated one is kept, and the roles
+-- of existing memberships are assigned where they are not yet.
+DELETE FROM "public"."user_organizations" a USING "public"."user_organizations" b
+WHERE a."user_id" = b."user_id" AND a."org_id" = b."org_id"
+AND (COALESCE(a."updated_at", a."created_at", '-infinity'), a."id")
+    < (COALESCE(b."updated_at", b."created_at", '-infinity'), b."id");
+
+CREATE UNIQUE INDEX IF NOT EXISTS "user_organizations_user_id_org_id_key" ON "public"."user_organizations" ("user_id", "org_id");
+CREATE INDEX IF NOT EXISTS "user_organizations_org_id_idx" ON "public"."user_organizations" ("org_id");
+
+ALTER TABLE "public"."user_roles" ADD COLUMN IF NOT EXISTS "membership_id" uuid;
+
+ALTER TABLE "public"."user_roles"
+ADD CONSTRAINT "fk_user_roles_membership_id"
+FOREIGN KEY ("membership_id") REFERENCES "public"."user_organizations"("id") ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS "user_roles_membership_id_idx" ON "public"."user_roles" ("membership_id") WHERE "membership_id" IS NOT NULL;
+
+INSERT INTO "public"."user_roles" ("user_id", "role_id", "scope", "org_id", "membership_id", "created_at", "updated_at")
+SELECT uo."user_id", uo."role_id", 'organization', uo."org_id", uo."id", now(), now()
+FROM "public"."user_organizations" uo
+WHERE uo."user_id" IS NOT NULL AND uo."org_id" IS NOT NULL AND uo."role_id" IS NOT NULL
+AND NOT EXISTS (SELECT 1 FROM "public"."user_roles" ur
+    WHERE ur."user_id" = uo."user_id" AND ur."role_id" = uo."role_id" AND ur."org_id" = uo."org_id");
+
+COMMENT ON COLUMN "public"."user_organizations"."role_id" IS 'Role of the member in the organization, assigned in user_roles';
+COMMENT ON COLUMN "public"."user_organizations"."invited_by" IS 'User who added the member';
+COMMENT ON COLUMN "public"."user_roles"."membership_id" IS 'Organization membership whose role this assignment is; NULL for assignments granted otherwise';
@@ -50,7 +50,19 @@ INSERT INTO "permissions" (id, name, description, scope_level) VALUES
 ('660e8400-e29b-41d4-a716-446655440016', 'system_admin', 'Full system administration access', 'system'),
 ('660e8400-e29b-41d4-a716-446655440017', 'view_system_info', 'View system information and statistics', 'system'),
 ('660e8400-e29b-41d4-a716-446655440018', 'manage_system_settings', 'Manage system-wide settings', 'system'),
-('660e8400-e29b-41d4-a716-446655440019', 'manage_custom_fields', 'Manage global custom fields', 'system');
+('660e8400-e29b-41d4-a716-446655440019', 'manage_custom_fields', 'Manage global custom fields', 'system'),
+
+-- OAuth client permissions
+('660e8400-e29b-41d4-a716-446655440020', 'manage_oauth_clients', 'Register and manage OAuth/OIDC clients', 'system'),
+
+-- Service account permissions
+('660e8400-e29b-41d4-a716-446655440021', 'manage_service_accounts', 'Create and manage service accounts', 'system'),
+
+-- Impersonation permissions
+('660e8400-e29b-41d4-a716-446655440022', 'impersonate_users', 'Sign in as another user for support', 'system'),
+
+-- Access policy permissions
+('660e8400-e29b-41d4-a716-446655440023', 'manage_policies', 'Manage access policies and separation-of-duties constraints', 'system');
 
 -- ===========================================
 -- ROLE-PERMISSION RELATIONSHIPS
@@ -78,6 +90,10 @@ INSERT INTO "role_permissions" (role_id, permission_id) VALUES
 ('550e8400-e29b-41d4-a716-446655440000', '660e8400-e29b-41d4-a716-446655440016'), -- system_admin
 ('550e8400-e29b-41d4-a716-446655440000', '660e8400-e29b-41d4-a716-446655440017'), -- view_system_info
 ('550e8400-e29b-41d4-a716-446655440000', '660e8400-e29b-41d4-a716-446655440018'), -- manage_system_settings
+('550e8400-e29b-41d4-a716-446655440000', '660e8400-e29b-41d4-a716-446655440020'), -- manage_oauth_clients
+('550e8400-e29b-41d4-a716-446655440000', '660e8400-e29b-41d4-a716-446655440021'), -- manage_service_accounts
+('550e8400-e29b-41d4-a716-446655440000', '660e8400-e29b-41d4-a716-446655440022'), -- impersonate_users
+('550e8400-e29b-41d4-a716-446655440000', '660e8400-e29b-41d4-a716-446655440023'), -- manage_policies
 
 -- Admin - Most permissions except super admin specific ones
 ('550e8400-e29b-41d4-a716-446655440001', '660e8400-e29b-41d4-a716-446655440000'), -- manage_users
@@ -96,6 +112,10 @@ INSERT INTO "role_permissions" (role_id, permission_id) VALUES
 ('550e8400-e29b-41d4-a716-446655440001', '660e8400-e29b-41d4-a716-446655440014'), -- view_content
 ('550e8400-e29b-41d4-a716-446655440001', '660e8400-e29b-41d4-a716-446655440015'), -- export_data
 ('550e8400-e29b-41d4-a716-446655440001', '660e8400-e29b-41d4-a716-446655440017'), -- view_system_info
+('550e8400-e29b-41d4-a716-446655440001', '660e8400-e29b-41d4-a716-446655440020'), -- manage_oauth_clients
+('550e8400-e29b-41d4-a716-446655440001', '660e8400-e29b-41d4-a716-446655440021'), -- manage_service_accounts
+('550e8400-e29b-41d4-a716-446655440001', '660e8400-e29b-41d4-a716-446655440022'), -- impersonate_users
+('550e8400-e29b-41d4-a716-446655440001', '660e8400-e29b-41d4-a716-446655440023'), -- manage_policies
 
 -- Manager - Team management permissions
 ('550e8400-e29b-41d4-a716-446655440002', '660e8400-e29b-41d4-a716-446655440001'), -- view_users
@@ -143,12 +163,10 @@ INSERT INTO "users" (id, username, email, password_hash, is_active) VALUES
 INSERT INTO "user_roles" (user_id, role_id, scope) VALUES
 ('43739cef-f82b-4b74-8e11-2c9c907300d1', '550e8400-e29b-41d4-a716-446655440000', 'system');
 
--- Assign other roles to sample users
+-- Assign other roles to sample users (organization-scoped roles are assigned
+-- after the organizations below)
 INSERT INTO "user_roles" (user_id, role_id, scope) VALUES
-('550e8400-e29b-41d4-a716-446655440100', '550e8400-e29b-41d4-a716-446655440001', 'system'), -- admin
-('550e8400-e29b-41d4-a716-446655440101', '550e8400-e29b-41d4-a716-446655440002', 'organization'), -- manager
-('550e8400-e29b-41d4-a716-446655440102', '550e8400-e29b-41d4-a716-446655440003', 'organization'), -- user
-('550e8400-e29b-41d4-a716-446655440103', '550e8400-e29b-41d4-a716-446655440004', 'organization'); -- viewer
+('550e8400-e29b-41d4-a716-446655440100', '550e8400-e29b-41d4-a716-446655440001', 'system'); -- admin
 
 -- ===========================================
 -- SAMPLE ORGANIZATIONS
@@ -159,6 +177,12 @@ INSERT INTO "organizations" (id, name, description, domain, managed_by) VALUES
 ('770e8400-e29b-41d4-a716-446655440001', 'Development Team', 'Software development department', 'dev.pillow.com', '550e8400-e29b-41d4-a716-446655440100'),
 ('770e8400-e29b-41d4-a716-446655440002', 'Marketing Team', 'Marketing and sales department', 'marketing.pillow.com', '550e8400-e29b-41d4-a716-446655440100');
 
+-- Organization-scoped roles apply in org_id and its sub-organizations
+INSERT INTO "user_roles" (user_id, role_id, scope, org_id) VALUES
+('550e8400-e29b-41d4-a716-446655440101', '550e8400-e29b-41d4-a716-446655440002', 'organization', '770e8400-e29b-41d4-a716-446655440001'), -- manager
+('550e8400-e29b-41d4-a716-446655440102', '550e8400-e29b-41d4-a716-446655440003', 'organization', '770e8400-e29b-41d4-a716-446655440001'), -- user
+('550e8400-e29b-41d4-a716-446655440103', '550e8400-e29b-41d4-a716-446655440004', 'organization', '770e8400-e29b-41d4-a716-446655440002'); -- viewer
+
 -- ===========================================
 -- USER-ORGANIZATION MEMBERSHIPS
 -- ===========================================
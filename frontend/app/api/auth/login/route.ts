@@ -1,5 +1,25 @@
 import { NextRequest, NextResponse } from 'next/server'
 
+// Number of reverse proxies in front of this server that append the address of
+// their peer to X-Forwarded-For
+const proxyHops = Number(process.env.TRUSTED_PROXY_HOPS || 0)
+
+// peerAddress returns the address the request reached the first trusted proxy
+// from, or null when it cannot be known. Entries further left in
+// X-Forwarded-For and any X-Real-IP header come from the browser and are never
+// forwarded. Without a proxy in front the header is client controlled: Next.js
+// only records the socket address in it when the request carries none.
+function peerAddress(request: NextRequest): string | null {
+  if (!Number.isInteger(proxyHops) || proxyHops <= 0) {
+    return null
+  }
+  const hops = (request.headers.get('x-forwarded-for') || '')
+    .split(',')
+    .map((hop) => hop.trim())
+  const hop = hops[hops.length - proxyHops]
+  return hop || null
+}
+
 export async function POST(request: NextRequest) {
   try {
     const body = await request.json()
@@ -14,10 +34,15 @@ export async function POST(request: NextRequest) {
 
     const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080'
 
+    // Pass the browser's address on so the backend can apply per-IP login limits
+    // (the backend only honours it when this server is listed in TRUSTED_PROXIES)
+    const forwardedFor = peerAddress(request)
+
     const response = await fetch(`${backendUrl}/api/login`, {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
+        ...(forwardedFor ? { 'X-Forwarded-For': forwardedFor } : {}),
       },
       body: JSON.stringify({ identifier, password }),
     })
@@ -31,9 +56,10 @@ export async function POST(request: NextRequest) {
     }
 
     if (!response.ok) {
+      const retryAfter = response.headers.get('Retry-After')
       return NextResponse.json(
         { error: data.message || data.error || 'Login failed' },
-        { status: response.status }
+        { status: response.status, headers: retryAfter ? { 'Retry-After': retryAfter } : undefined }
       )
     }
 
@@ -5,6 +5,19 @@ export async function POST(request: NextRequest) {
   try {
     // Clear authentication cookies
     const cookieStore = await cookies()
+    const token = cookieStore.get('pillow_token')?.value
+
+    // Revoke the token server-side; the cookies are cleared regardless of the outcome
+    if (token) {
+      const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080'
+      await fetch(`${backendUrl}/api/logout`, {
+        method: 'POST',
+        headers: {
+          'Authorization': `Bearer ${token}`,
+          'Content-Type': 'application/json',
+        },
+      }).catch((error) => console.error('Backend logout error:', error))
+    }
 
     // Delete the authentication tokens
     cookieStore.delete('pillow_token')
@@ -12,13 +12,7 @@ export async function POST(request: NextRequest) {
       )
     }
 
-    if (password.length < 6) {
-      return NextResponse.json(
-        { error: 'Password must be at least 6 characters' },
-        { status: 400 }
-      )
-    }
-
+    // Password rules come from the backend's password policy
     const backendUrl = process.env.BACKEND_URL || 'http://localhost:8080'
 
     const response = await fetch(`${backendUrl}/api/register`, {
@@ -26,7 +20,7 @@ export async function POST(request: NextRequest) {
       headers: {
         'Content-Type': 'application/json',
       },
-      body: JSON.stringify({ username, email, password_hash: password }),
+      body: JSON.stringify({ username, email, password }),
     })
 
     const responseText = await response.text();
@@ -38,6 +32,15 @@ export async function POST(request: NextRequest) {
     }
 
     if (!response.ok) {
+      if (data.error === 'validation_failed' && Array.isArray(data.details)) {
+        return NextResponse.json(
+          {
+            error: data.details.map((d: { reason: string }) => d.reason).join('. '),
+            details: data.details,
+          },
+          { status: response.status }
+        )
+      }
       return NextResponse.json(
         { error: data.message || data.error || 'Registration failed' },
         { status: response.status }
@@ -12,10 +12,6 @@ export async function registerAction(formData: FormData) {
     redirect(`/register?error=${encodeURIComponent('All fields are required')}`)
   }
 
-  if (password.length < 6) {
-    redirect(`/register?error=${encodeURIComponent('Password must be at least 6 characters')}`)
-  }
-
   try {
     // Call Next.js API route instead of backend directly
     const apiUrl = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000'